@@ -0,0 +1,59 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+func builtinAlias(sh *Shell, std *StdStreams, args []string) (RunningJob, error) {
+	if len(args) > 0 && args[0] == "-p" {
+		args = args[1:]
+	}
+	if len(args) == 0 {
+		names := make([]string, 0, len(sh.aliases))
+		for name := range sh.aliases {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			fmt.Fprintf(std.Out, "alias %s=%s\n", name, shellQuote(sh.aliases[name]))
+		}
+		return &ImmediateRunningJob{name: "alias"}, nil
+	}
+	code := 0
+	for _, arg := range args {
+		if i := strings.IndexByte(arg, '='); i > 0 {
+			sh.aliases[arg[:i]] = arg[i+1:]
+			continue
+		}
+		val, ok := sh.aliases[arg]
+		if !ok {
+			fmt.Fprintf(std.Err, "alias: %s: not found\n", arg)
+			code = 1
+			continue
+		}
+		fmt.Fprintf(std.Out, "alias %s=%s\n", arg, shellQuote(val))
+	}
+	return &ImmediateRunningJob{name: "alias", outcome: JobOutcome{ExitCode: code}}, nil
+}
+
+func builtinUnalias(sh *Shell, std *StdStreams, args []string) (RunningJob, error) {
+	if len(args) > 0 && args[0] == "-a" {
+		sh.aliases = map[string]string{}
+		return &ImmediateRunningJob{name: "unalias"}, nil
+	}
+	if len(args) == 0 {
+		return nil, fmt.Errorf("unalias: usage: unalias [-a] name [name ...]")
+	}
+	code := 0
+	for _, name := range args {
+		if _, ok := sh.aliases[name]; !ok {
+			fmt.Fprintf(std.Err, "unalias: %s: not found\n", name)
+			code = 1
+			continue
+		}
+		delete(sh.aliases, name)
+	}
+	return &ImmediateRunningJob{name: "unalias", outcome: JobOutcome{ExitCode: code}}, nil
+}
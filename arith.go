@@ -0,0 +1,524 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// evalArith evaluates an arithmetic expression, as used by let and when
+// assigning to integer variables.  It follows bash: values are 64 bit signed
+// integers, variable names evaluate to the expression they contain and
+// assignment operators update variables.
+func evalArith(sh *Shell, expr string) (int64, error) {
+	return evalArithDepth(sh, expr, 0)
+}
+
+// Variables can contain expressions referring to other variables, this stops
+// infinite recursion.
+const maxArithDepth = 1024
+
+func evalArithDepth(sh *Shell, expr string, depth int) (int64, error) {
+	if depth > maxArithDepth {
+		return 0, errors.New("expression recursion level exceeded")
+	}
+	p := &arithParser{sh: sh, expr: expr, depth: depth}
+	if err := p.next(); err != nil {
+		return 0, p.wrap(err)
+	}
+	if p.kind == arithEOF {
+		return 0, nil
+	}
+	n, err := p.parseComma()
+	if err == nil && p.kind != arithEOF {
+		err = errors.New("syntax error in expression")
+	}
+	if err != nil {
+		return 0, p.wrap(err)
+	}
+	return n, nil
+}
+
+const (
+	arithEOF = iota
+	arithNum
+	arithName
+	arithOp
+)
+
+type arithParser struct {
+	sh     *Shell
+	expr   string
+	pos    int
+	depth  int
+	noeval int // When > 0, the expression is parsed but has no side effects
+
+	// The current token
+	kind int
+	tok  string
+	num  int64
+}
+
+type arithState struct {
+	pos  int
+	kind int
+	tok  string
+	num  int64
+}
+
+func (p *arithParser) save() arithState {
+	return arithState{pos: p.pos, kind: p.kind, tok: p.tok, num: p.num}
+}
+
+func (p *arithParser) restore(s arithState) {
+	p.pos, p.kind, p.tok, p.num = s.pos, s.kind, s.tok, s.num
+}
+
+func (p *arithParser) wrap(err error) error {
+	expr := strings.TrimSpace(p.expr)
+	if p.kind == arithEOF {
+		return fmt.Errorf("%s: %s", expr, err)
+	}
+	tok := strings.TrimSpace(p.expr[p.pos-len(p.tok):])
+	return fmt.Errorf("%s: %s (error token is \"%s\")", expr, err, tok)
+}
+
+// Operators, longest first so that the tokeniser finds the longest match.
+var arithOps = []string{
+	"<<=", ">>=",
+	"**", "++", "--", "<<", ">>", "<=", ">=", "==", "!=", "&&", "||",
+	"*=", "/=", "%=", "+=", "-=", "&=", "^=", "|=",
+	"+", "-", "*", "/", "%", "<", ">", "=", "!", "~", "&", "^", "|", "?", ":", ",", "(", ")",
+}
+
+func (p *arithParser) next() error {
+	s := p.expr
+	for p.pos < len(s) && strings.IndexByte(" \t\n", s[p.pos]) != -1 {
+		p.pos++
+	}
+	start := p.pos
+	if start == len(s) {
+		p.kind, p.tok = arithEOF, ""
+		return nil
+	}
+	c := s[start]
+	switch {
+	case c >= '0' && c <= '9':
+		for p.pos < len(s) && isArithNumChar(s[p.pos]) {
+			p.pos++
+		}
+		p.kind, p.tok = arithNum, s[start:p.pos]
+		n, err := parseArithNum(p.tok)
+		p.num = n
+		return err
+	case c == '_' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z':
+		for p.pos < len(s) && isNameChar(s[p.pos]) {
+			p.pos++
+		}
+		p.kind, p.tok = arithName, s[start:p.pos]
+		return nil
+	}
+	for _, op := range arithOps {
+		if strings.HasPrefix(s[start:], op) {
+			p.pos += len(op)
+			p.kind, p.tok = arithOp, op
+			return nil
+		}
+	}
+	p.pos++
+	p.kind, p.tok = arithOp, s[start:p.pos]
+	return errors.New("syntax error: invalid arithmetic operator")
+}
+
+func isArithNumChar(c byte) bool {
+	return isNameChar(c) || c == '#' || c == '@'
+}
+
+func isNameChar(c byte) bool {
+	return c == '_' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9'
+}
+
+// parseArithNum parses decimal, octal (0 prefix), hexadecimal (0x prefix)
+// and base#digits numbers.  In bases up to 36 letters are case insensitive,
+// above that lowercase letters come first, then uppercase, @ and _.
+func parseArithNum(s string) (int64, error) {
+	base := int64(10)
+	digits := s
+	if i := strings.IndexByte(s, '#'); i != -1 {
+		b, err := strconv.ParseInt(s[:i], 10, 64)
+		if err != nil || b < 2 || b > 64 {
+			return 0, errors.New("invalid arithmetic base")
+		}
+		base, digits = b, s[i+1:]
+	} else if strings.HasPrefix(s, "0x") || strings.HasPrefix(s, "0X") {
+		base, digits = 16, s[2:]
+	} else if len(s) > 1 && s[0] == '0' {
+		base, digits = 8, s[1:]
+	}
+	if digits == "" {
+		return 0, errors.New("invalid number")
+	}
+	var n int64
+	for _, c := range []byte(digits) {
+		var d int64
+		switch {
+		case c >= '0' && c <= '9':
+			d = int64(c - '0')
+		case c >= 'a' && c <= 'z':
+			d = int64(c-'a') + 10
+		case c >= 'A' && c <= 'Z':
+			d = int64(c-'A') + 10
+			if base > 36 {
+				d += 26
+			}
+		case c == '@':
+			d = 62
+		case c == '_':
+			d = 63
+		default:
+			return 0, errors.New("invalid number")
+		}
+		if d >= base {
+			return 0, errors.New("value too great for base")
+		}
+		n = n*base + d
+	}
+	return n, nil
+}
+
+func (p *arithParser) isOp(ops ...string) bool {
+	if p.kind != arithOp {
+		return false
+	}
+	for _, op := range ops {
+		if p.tok == op {
+			return true
+		}
+	}
+	return false
+}
+
+func (p *arithParser) expect(op string) error {
+	if !p.isOp(op) {
+		if op == ")" {
+			return errors.New("missing `)'")
+		}
+		return fmt.Errorf("`%s' expected", op)
+	}
+	return p.next()
+}
+
+func (p *arithParser) parseComma() (int64, error) {
+	n, err := p.parseAssign()
+	for err == nil && p.isOp(",") {
+		if err = p.next(); err == nil {
+			n, err = p.parseAssign()
+		}
+	}
+	return n, err
+}
+
+func (p *arithParser) parseAssign() (int64, error) {
+	if p.kind == arithName {
+		saved := p.save()
+		name := p.tok
+		if err := p.next(); err != nil {
+			return 0, err
+		}
+		if p.isOp("=", "*=", "/=", "%=", "+=", "-=", "<<=", ">>=", "&=", "^=", "|=") {
+			op := p.tok
+			if err := p.next(); err != nil {
+				return 0, err
+			}
+			val, err := p.parseAssign()
+			if err != nil {
+				return 0, err
+			}
+			if op != "=" {
+				cur, err := p.varValue(name)
+				if err != nil {
+					return 0, err
+				}
+				val, err = p.binary(op[:len(op)-1], cur, val)
+				if err != nil {
+					return 0, err
+				}
+			}
+			return val, p.setVar(name, val)
+		}
+		p.restore(saved)
+	}
+	return p.parseCond()
+}
+
+func (p *arithParser) parseCond() (int64, error) {
+	cond, err := p.parseBinary(0)
+	if err != nil || !p.isOp("?") {
+		return cond, err
+	}
+	if err := p.next(); err != nil {
+		return 0, err
+	}
+	if cond == 0 {
+		p.noeval++
+	}
+	yes, err := p.parseComma()
+	if cond == 0 {
+		p.noeval--
+	}
+	if err != nil {
+		return 0, err
+	}
+	if err := p.expect(":"); err != nil {
+		return 0, err
+	}
+	if cond != 0 {
+		p.noeval++
+	}
+	no, err := p.parseCond()
+	if cond != 0 {
+		p.noeval--
+	}
+	if err != nil {
+		return 0, err
+	}
+	if cond != 0 {
+		return yes, nil
+	}
+	return no, nil
+}
+
+// arithLevels lists binary operators from lowest to highest precedence.
+var arithLevels = [][]string{
+	{"||"},
+	{"&&"},
+	{"|"},
+	{"^"},
+	{"&"},
+	{"==", "!="},
+	{"<", ">", "<=", ">="},
+	{"<<", ">>"},
+	{"+", "-"},
+	{"*", "/", "%"},
+}
+
+func (p *arithParser) parseBinary(level int) (int64, error) {
+	if level == len(arithLevels) {
+		return p.parsePower()
+	}
+	x, err := p.parseBinary(level + 1)
+	for err == nil && p.isOp(arithLevels[level]...) {
+		op := p.tok
+		if err = p.next(); err != nil {
+			break
+		}
+		// Short-circuit evaluation
+		skip := op == "&&" && x == 0 || op == "||" && x != 0
+		if skip {
+			p.noeval++
+		}
+		var y int64
+		y, err = p.parseBinary(level + 1)
+		if skip {
+			p.noeval--
+		}
+		if err == nil {
+			x, err = p.binary(op, x, y)
+		}
+	}
+	return x, err
+}
+
+func (p *arithParser) parsePower() (int64, error) {
+	x, err := p.parseUnary()
+	if err != nil || !p.isOp("**") {
+		return x, err
+	}
+	if err := p.next(); err != nil {
+		return 0, err
+	}
+	y, err := p.parsePower()
+	if err != nil {
+		return 0, err
+	}
+	return p.binary("**", x, y)
+}
+
+func (p *arithParser) parseUnary() (int64, error) {
+	if p.isOp("++", "--") {
+		op := p.tok
+		if err := p.next(); err != nil {
+			return 0, err
+		}
+		if p.kind != arithName {
+			return 0, errors.New("syntax error: operand expected")
+		}
+		name := p.tok
+		if err := p.next(); err != nil {
+			return 0, err
+		}
+		n, err := p.varValue(name)
+		if err != nil {
+			return 0, err
+		}
+		if op == "++" {
+			n++
+		} else {
+			n--
+		}
+		return n, p.setVar(name, n)
+	}
+	if p.isOp("-", "+", "!", "~") {
+		op := p.tok
+		if err := p.next(); err != nil {
+			return 0, err
+		}
+		n, err := p.parseUnary()
+		if err != nil {
+			return 0, err
+		}
+		switch op {
+		case "-":
+			n = -n
+		case "!":
+			n = boolToInt(n == 0)
+		case "~":
+			n = ^n
+		}
+		return n, nil
+	}
+	return p.parsePrimary()
+}
+
+func (p *arithParser) parsePrimary() (int64, error) {
+	switch p.kind {
+	case arithNum:
+		n := p.num
+		return n, p.next()
+	case arithName:
+		name := p.tok
+		if err := p.next(); err != nil {
+			return 0, err
+		}
+		n, err := p.varValue(name)
+		if err != nil {
+			return 0, err
+		}
+		if p.isOp("++", "--") {
+			m := n + 1
+			if p.tok == "--" {
+				m = n - 1
+			}
+			if err := p.next(); err != nil {
+				return 0, err
+			}
+			return n, p.setVar(name, m)
+		}
+		return n, nil
+	case arithOp:
+		if p.isOp("(") {
+			if err := p.next(); err != nil {
+				return 0, err
+			}
+			n, err := p.parseComma()
+			if err != nil {
+				return 0, err
+			}
+			return n, p.expect(")")
+		}
+	}
+	return 0, errors.New("syntax error: operand expected")
+}
+
+func (p *arithParser) binary(op string, x, y int64) (int64, error) {
+	switch op {
+	case "||":
+		return boolToInt(x != 0 || y != 0), nil
+	case "&&":
+		return boolToInt(x != 0 && y != 0), nil
+	case "|":
+		return x | y, nil
+	case "^":
+		return x ^ y, nil
+	case "&":
+		return x & y, nil
+	case "==":
+		return boolToInt(x == y), nil
+	case "!=":
+		return boolToInt(x != y), nil
+	case "<":
+		return boolToInt(x < y), nil
+	case ">":
+		return boolToInt(x > y), nil
+	case "<=":
+		return boolToInt(x <= y), nil
+	case ">=":
+		return boolToInt(x >= y), nil
+	case "<<":
+		return x << uint64(y), nil
+	case ">>":
+		return x >> uint64(y), nil
+	case "+":
+		return x + y, nil
+	case "-":
+		return x - y, nil
+	case "*":
+		return x * y, nil
+	case "/", "%":
+		if y == 0 {
+			if p.noeval > 0 {
+				return 0, nil
+			}
+			return 0, errors.New("division by 0")
+		}
+		if op == "/" {
+			return x / y, nil
+		}
+		return x % y, nil
+	case "**":
+		if y < 0 {
+			if p.noeval > 0 {
+				return 0, nil
+			}
+			return 0, errors.New("exponent less than 0")
+		}
+		n := int64(1)
+		for ; y > 0; y-- {
+			n *= x
+		}
+		return n, nil
+	default:
+		panic("bug!")
+	}
+}
+
+// varValue returns the value of a variable, evaluating its contents as an
+// expression.
+func (p *arithParser) varValue(name string) (int64, error) {
+	if p.noeval > 0 {
+		return 0, nil
+	}
+	val := p.sh.GetVar(name)
+	if val == "" {
+		return 0, nil
+	}
+	if n, err := strconv.ParseInt(val, 10, 64); err == nil {
+		return n, nil
+	}
+	return evalArithDepth(p.sh, val, p.depth+1)
+}
+
+func (p *arithParser) setVar(name string, n int64) error {
+	if p.noeval > 0 {
+		return nil
+	}
+	return p.sh.SetVar(name, strconv.FormatInt(n, 10))
+}
+
+func boolToInt(b bool) int64 {
+	if b {
+		return 1
+	}
+	return 0
+}
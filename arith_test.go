@@ -0,0 +1,74 @@
+package main
+
+import "testing"
+
+func TestEvalArith(t *testing.T) {
+	tests := []struct {
+		expr string
+		want int64
+	}{
+		{"", 0},
+		{"1+2*3", 7},
+		{"(1+2)*3", 9},
+		{"7/2", 3},
+		{"-7%3", -1},
+		{"9 % 4 * 2", 2},
+		{"2**10", 1024},
+		{"1<<4", 16},
+		{"-8>>1", -4},
+		{"-(2+3)", -5},
+		{"- -1", 1},
+		{"!0", 1},
+		{"~0", -1},
+		{"1 ^ 3", 2},
+		{"6 & 3 | 8", 10},
+		{"3 != 3", 0},
+		{"5>3&&2>1", 1},
+		{"0||0", 0},
+		{"1?2:3", 2},
+		{"0?2:3", 3},
+		{"1 , 2", 2},
+		{"010", 8},
+		{"0x1f", 31},
+		{"2#101", 5},
+		{"36#z", 35},
+		{"x=5, x*2", 10},
+		{"x=3, x+=4, x", 7},
+		{"x=3, x++ + x", 7},
+		{"x=3, ++x", 4},
+		{"y=x+1, x=2, y", 1},
+		// A variable containing an expression evaluates to its value
+		{"x=2, z", 3},
+	}
+	for _, test := range tests {
+		sh := NewShell("meshell", nil, t.TempDir())
+		if err := sh.SetVar("z", "x+1"); err != nil {
+			t.Fatal(err)
+		}
+		got, err := evalArith(sh, test.expr)
+		if err != nil {
+			t.Errorf("evalArith(%q): unexpected error: %s", test.expr, err)
+		} else if got != test.want {
+			t.Errorf("evalArith(%q) = %d, want %d", test.expr, got, test.want)
+		}
+	}
+}
+
+func TestEvalArithErrors(t *testing.T) {
+	for _, expr := range []string{
+		"1/0",
+		"1%0",
+		"1+",
+		"(1",
+		"1 2",
+		"x=",
+		"3=4",
+		"2#9",
+		"08",
+	} {
+		sh := NewShell("meshell", nil, t.TempDir())
+		if n, err := evalArith(sh, expr); err == nil {
+			t.Errorf("evalArith(%q) = %d, want an error", expr, n)
+		}
+	}
+}
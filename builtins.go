@@ -2,47 +2,62 @@ package main
 
 import (
 	"errors"
-	"os"
+	"fmt"
 	"strconv"
 )
 
-type builtinFunc func(sh *Shell, std StdStreams, args []string) (RunningJob, error)
+type builtinFunc func(sh *Shell, std *StdStreams, args []string) (RunningJob, error)
 
 var builtins map[string]builtinFunc
 
 func init() {
 	builtins = map[string]builtinFunc{
-		"cd":     builtinCd,
-		"exit":   builtinExit,
-		"return": builtinReturn,
-		"shift":  builtinShift,
+		".":        builtinSource,
+		"[":        builtinBracket,
+		"alias":    builtinAlias,
+		"bg":       builtinBg,
+		"builtin":  builtinBuiltin,
+		"cd":       builtinCd,
+		"command":  builtinCommand,
+		"declare":  builtinDeclare,
+		"dirs":     builtinDirs,
+		"disown":   builtinDisown,
+		"echo":     builtinEcho,
+		"eval":     builtinEval,
+		"exit":     builtinExit,
+		"export":   builtinExport,
+		"fg":       builtinFg,
+		"getopts":  builtinGetopts,
+		"hash":     builtinHash,
+		"jobs":     builtinJobs,
+		"kill":     builtinKill,
+		"let":      builtinLet,
+		"local":    builtinLocal,
+		"popd":     builtinPopd,
+		"printf":   builtinPrintf,
+		"pushd":    builtinPushd,
+		"pwd":      builtinPwd,
+		"read":     builtinRead,
+		"readonly": builtinReadonly,
+		"return":   builtinReturn,
+		"set":      builtinSet,
+		"source":   builtinSource,
+		"shift":    builtinShift,
+		"shopt":    builtinShopt,
+		"test":     builtinTest,
+		"times":    builtinTimes,
+		"trap":     builtinTrap,
+		"type":     builtinType,
+		"typeset":  builtinDeclare,
+		"ulimit":   builtinUlimit,
+		"umask":    builtinUmask,
+		"unalias":  builtinUnalias,
+		"unset":    builtinUnset,
+		"wait":     builtinWait,
 	}
 }
 
-func builtinCd(sh *Shell, std StdStreams, args []string) (RunningJob, error) {
-	var (
-		dir = ""
-		err error
-	)
-	switch len(args) {
-	case 0:
-		dir, err = os.UserHomeDir()
-	case 1:
-		dir = args[0]
-	default:
-		err = errors.New("cd: wrong number of arguments")
-	}
-	if err != nil {
-		return nil, err
-	}
-	err = sh.SetCwd(dir)
-	if err != nil {
-		return nil, err
-	}
-	return &ImmediateRunningJob{name: "cd"}, nil
-}
-
-func builtinExit(sh *Shell, std StdStreams, args []string) (RunningJob, error) {
+func builtinExit(sh *Shell, std *StdStreams, args []string) (RunningJob, error) {
 	var (
 		code int64
 		err  error
@@ -63,7 +78,7 @@ func builtinExit(sh *Shell, std StdStreams, args []string) (RunningJob, error) {
 	return &ImmediateRunningJob{name: "exit"}, nil
 }
 
-func builtinReturn(sh *Shell, std StdStreams, args []string) (RunningJob, error) {
+func builtinReturn(sh *Shell, std *StdStreams, args []string) (RunningJob, error) {
 	var (
 		code int64
 		err  error
@@ -87,7 +102,7 @@ func builtinReturn(sh *Shell, std StdStreams, args []string) (RunningJob, error)
 	return &ImmediateRunningJob{name: "return"}, nil
 }
 
-func builtinShift(sh *Shell, std StdStreams, args []string) (RunningJob, error) {
+func builtinShift(sh *Shell, std *StdStreams, args []string) (RunningJob, error) {
 	var (
 		shift uint64
 		err   error
@@ -110,3 +125,167 @@ func builtinShift(sh *Shell, std StdStreams, args []string) (RunningJob, error)
 	sh.ShiftArgs(int(shift))
 	return &ImmediateRunningJob{name: "shift"}, nil
 }
+
+func builtinShopt(sh *Shell, std *StdStreams, args []string) (RunningJob, error) {
+	var (
+		set, unset, quiet bool
+		names             []string
+		allNames          = shoptNames
+		isName            = isShoptName
+		getOpt            = sh.Shopt
+		setOpt            = sh.SetShopt
+	)
+	for i, arg := range args {
+		if len(arg) < 2 || arg[0] != '-' {
+			names = args[i:]
+			break
+		}
+		for _, c := range arg[1:] {
+			switch c {
+			case 's':
+				set = true
+			case 'u':
+				unset = true
+			case 'q':
+				quiet = true
+			case 'o':
+				allNames = optionNames
+				isName = isOptionName
+				getOpt = sh.Option
+				setOpt = sh.SetOption
+			default:
+				return nil, fmt.Errorf("shopt: -%c: invalid option", c)
+			}
+		}
+	}
+	if set && unset {
+		return nil, errors.New("shopt: cannot set and unset shell options simultaneously")
+	}
+	if set || unset {
+		for _, name := range names {
+			if err := setOpt(name, set); err != nil {
+				return nil, fmt.Errorf("shopt: %s", err)
+			}
+		}
+		return &ImmediateRunningJob{name: "shopt"}, nil
+	}
+	if len(names) == 0 {
+		names = allNames
+	}
+	code := 0
+	for _, name := range names {
+		if !isName(name) {
+			return nil, fmt.Errorf("shopt: %s: invalid shell option name", name)
+		}
+		status := "off"
+		if getOpt(name) {
+			status = "on"
+		} else {
+			code = 1
+		}
+		if !quiet {
+			fmt.Fprintf(std.Out, "%-15s\t%s\n", name, status)
+		}
+	}
+	return &ImmediateRunningJob{name: "shopt", outcome: JobOutcome{ExitCode: code}}, nil
+}
+
+// builtinSet sets options given as letters (-e, +x) or names (-o errexit) and
+// replaces the positional parameters with the remaining arguments.
+func builtinSet(sh *Shell, std *StdStreams, args []string) (RunningJob, error) {
+	if len(args) == 0 {
+		for _, name := range sh.varNames() {
+			fmt.Fprintf(std.Out, "%s=%s\n", name, quoteIfNeeded(sh.GetVar(name)))
+		}
+		return &ImmediateRunningJob{name: "set"}, nil
+	}
+	invalid := func(format string, a ...interface{}) (RunningJob, error) {
+		fmt.Fprintf(std.Err, "meshell: set: "+format+"\n", a...)
+		return &ImmediateRunningJob{name: "set", outcome: JobOutcome{ExitCode: 2}}, nil
+	}
+	setArgs := false
+	for len(args) > 0 {
+		arg := args[0]
+		if arg == "--" {
+			args = args[1:]
+			setArgs = true
+			break
+		}
+		if arg == "-" {
+			// Historical form: turn off -x and -v, the remaining arguments
+			// are positional parameters.
+			_ = sh.SetOption("xtrace", false)
+			_ = sh.SetOption("verbose", false)
+			args = args[1:]
+			setArgs = len(args) > 0
+			break
+		}
+		if len(arg) < 2 || (arg[0] != '-' && arg[0] != '+') {
+			break
+		}
+		args = args[1:]
+		on := arg[0] == '-'
+		for i := 1; i < len(arg); i++ {
+			c := arg[i]
+			if c != 'o' {
+				name, ok := optionLetterName(c)
+				if !ok {
+					return invalid("%c%c: invalid option", arg[0], c)
+				}
+				_ = sh.SetOption(name, on)
+				continue
+			}
+			if len(args) == 0 || args[0] == "" || args[0][0] == '-' || args[0][0] == '+' {
+				printSetOptions(sh, std, on)
+				continue
+			}
+			if err := sh.SetOption(args[0], on); err != nil {
+				return invalid("%s: invalid option name", args[0])
+			}
+			args = args[1:]
+		}
+	}
+	if setArgs || len(args) > 0 {
+		sh.SetArgs(args)
+	}
+	return &ImmediateRunningJob{name: "set"}, nil
+}
+
+// printSetOptions prints the state of all options, as a table for set -o or
+// as commands that restore it for set +o.
+func printSetOptions(sh *Shell, std *StdStreams, table bool) {
+	for _, name := range optionNames {
+		on := sh.Option(name)
+		switch {
+		case table && on:
+			fmt.Fprintf(std.Out, "%-15s\ton\n", name)
+		case table:
+			fmt.Fprintf(std.Out, "%-15s\toff\n", name)
+		case on:
+			fmt.Fprintf(std.Out, "set -o %s\n", name)
+		default:
+			fmt.Fprintf(std.Out, "set +o %s\n", name)
+		}
+	}
+}
+
+func builtinLet(sh *Shell, std *StdStreams, args []string) (RunningJob, error) {
+	if len(args) == 0 {
+		return nil, errors.New("let: expression expected")
+	}
+	var (
+		n   int64
+		err error
+	)
+	for _, arg := range args {
+		n, err = evalArith(sh, arg)
+		if err != nil {
+			return nil, fmt.Errorf("let: %s", err)
+		}
+	}
+	code := 0
+	if n == 0 {
+		code = 1
+	}
+	return &ImmediateRunningJob{name: "let", outcome: JobOutcome{ExitCode: code}}, nil
+}
@@ -6,15 +6,142 @@ import (
 	"io"
 	"os"
 	"os/exec"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
 )
 
+// StdStreams is the table of file descriptors a command is started with.  It
+// is shared by commands running in the same context, so that e.g. `exec 3>log`
+// affects the commands that follow it.  Redirections, pipes, subshells, etc.
+// work on a clone.
 type StdStreams struct {
+	*fdTable
+
+	// The streams are passed along to every command that runs, so they also
+	// carry whether errexit applies to them.  It does not in the condition of
+	// if or while or on the left hand side of && or ||.
+	errexitIgnored bool
+}
+
+type fdTable struct {
 	In       io.Reader
 	Out, Err io.Writer
+	Files    map[int]*os.File // File descriptors 3 and above
+}
+
+// NewStdStreams returns streams with the given standard file descriptors.
+func NewStdStreams(in io.Reader, out, err io.Writer) *StdStreams {
+	return &StdStreams{fdTable: &fdTable{In: in, Out: out, Err: err}}
+}
+
+// ignoringErrexit returns streams like std for commands that errexit does not
+// apply to.  They share the file descriptor table of std so that permanent
+// redirections (exec 3>log) still apply to std.
+func (std *StdStreams) ignoringErrexit() *StdStreams {
+	if std.errexitIgnored {
+		return std
+	}
+	return &StdStreams{fdTable: std.fdTable, errexitIgnored: true}
+}
+
+// Clone returns a copy of std which can be modified without affecting std.
+func (std *StdStreams) Clone() *StdStreams {
+	table := *std.fdTable
+	table.Files = make(map[int]*os.File, len(std.Files))
+	for fd, f := range std.Files {
+		table.Files[fd] = f
+	}
+	return &StdStreams{fdTable: &table, errexitIgnored: std.errexitIgnored}
+}
+
+// Get returns the stream open at file descriptor fd, or nil if it is not open.
+func (std *StdStreams) Get(fd int) interface{} {
+	var stream interface{}
+	switch fd {
+	case 0:
+		stream = std.In
+	case 1:
+		stream = std.Out
+	case 2:
+		stream = std.Err
+	default:
+		if f, ok := std.Files[fd]; ok {
+			return f
+		}
+		return nil
+	}
+	if stream == nil || stream == closedStream {
+		return nil
+	}
+	return stream
+}
+
+// Set replaces file descriptor fd with stream.  If stream is nil the file
+// descriptor is closed.  File descriptors above 2 can only be *os.File.
+func (std *StdStreams) Set(fd int, stream interface{}) error {
+	if stream == nil {
+		stream = closedStream
+	}
+	var ok bool
+	switch fd {
+	case 0:
+		std.In, ok = stream.(io.Reader)
+	case 1:
+		std.Out, ok = stream.(io.Writer)
+	case 2:
+		std.Err, ok = stream.(io.Writer)
+	default:
+		if std.Files == nil {
+			std.Files = map[int]*os.File{}
+		}
+		if f, isFile := stream.(*os.File); isFile {
+			std.Files[fd], ok = f, true
+		} else if stream == closedStream {
+			delete(std.Files, fd)
+			ok = true
+		}
+	}
+	if !ok {
+		return fmt.Errorf("%d: bad file descriptor", fd)
+	}
+	return nil
+}
+
+// nextFreeFD returns the lowest file descriptor greater than or equal to min
+// that is not open.
+func (std *StdStreams) nextFreeFD(min int) int {
+	fd := min
+	for std.Get(fd) != nil {
+		fd++
+	}
+	return fd
+}
+
+// closedStreamType is used to mark file descriptors 0 to 2 as closed.  Child
+// processes get /dev/null instead as os/exec doesn't let us close them.
+type closedStreamType struct{}
+
+var closedStream = closedStreamType{}
+
+func (closedStreamType) Read([]byte) (int, error) {
+	return 0, syscall.EBADF
+}
+
+func (closedStreamType) Write([]byte) (int, error) {
+	return 0, syscall.EBADF
+}
+
+func childStream(stream interface{}) interface{} {
+	if stream == closedStream {
+		return nil
+	}
+	return stream
 }
 
 type Command interface {
-	StartJob(*Shell, StdStreams) (RunningJob, error)
+	StartJob(*Shell, *StdStreams) (RunningJob, error)
 	// String() string
 }
 
@@ -47,9 +174,43 @@ func errorOutcome(err error) JobOutcome {
 	}
 }
 
+// startJobOrReport starts cmd.  If the job cannot be started, the error is
+// reported on std.Err and a job that has already failed is returned, so that
+// the shell can carry on with the next command.
+func startJobOrReport(cmd Command, sh *Shell, std *StdStreams) RunningJob {
+	job, err := cmd.StartJob(sh, std)
+	if err != nil {
+		var unbound *UnboundVarError
+		if errors.As(err, &unbound) && !sh.interactive {
+			// A non-interactive shell exits, as in bash
+			sh.Exit(1)
+		}
+		if sh.scriptPos != "" {
+			fmt.Fprintf(std.Err, "meshell: %s: %s\n", sh.scriptPos, err)
+		} else {
+			fmt.Fprintf(std.Err, "meshell: %s\n", err)
+		}
+		var execErr *ExecError
+		failedExec := errors.As(err, &execErr)
+		code := 1
+		if errors.Is(err, exec.ErrNotFound) || failedExec && errors.Is(err, os.ErrNotExist) {
+			code = 127
+		} else if failedExec {
+			code = 126
+		}
+		if failedExec && !sh.interactive {
+			// A non-interactive shell exits, as in bash
+			sh.Exit(code)
+		}
+		return &ImmediateRunningJob{name: "error", outcome: JobOutcome{ExitCode: code}}
+	}
+	return job
+}
+
 type AssignDef struct {
 	Name string
-	Val  ValueDef
+	Sub  ValueDef // Subscript of an array element, nil if it is not one
+	Val  ValueDef // A CompoundValueDef to assign a whole array
 }
 
 //
@@ -64,17 +225,23 @@ type SimpleCommand struct {
 
 var _ Command = (*SimpleCommand)(nil)
 
-func (d *SimpleCommand) StartJob(sh *Shell, std StdStreams) (RunningJob, error) {
-	var env []string
+func (d *SimpleCommand) StartJob(sh *Shell, std *StdStreams) (RunningJob, error) {
+	sh.RunTrap(trapDebug)
+	var (
+		env  = sh.Environ()
+		vars map[string]string
+	)
 	if len(d.Assigns) > 0 {
-		env = os.Environ()
+		vars = make(map[string]string, len(d.Assigns))
 		for _, varDef := range d.Assigns {
 			val, err := varDef.Val.Value(sh, std)
 			if err != nil {
 				return nil, err
 			}
 			env = append(env, fmt.Sprintf("%s=%s", varDef.Name, val))
+			vars[varDef.Name] = val
 		}
+		env = dedupEnv(env)
 	}
 	cmdName, err := d.CmdName.Value(sh, std)
 	if err != nil {
@@ -88,40 +255,69 @@ func (d *SimpleCommand) StartJob(sh *Shell, std StdStreams) (RunningJob, error)
 		}
 		args = append(args, chunk...)
 	}
-	if cmd := sh.GetFunction(cmdName); cmd != nil {
-		return CallFunction(sh, std, cmd, cmdName, args)
+	if sh.Option("xtrace") {
+		traceCommand(sh, std, d.Assigns, vars, append([]string{cmdName}, args...))
 	}
-	if f := builtins[cmdName]; f != nil {
-		return f(sh, std, args)
+	if f := sh.GetFunction(cmdName); f != nil {
+		return CallFunction(sh, std, f.Body, cmdName, args, vars)
 	}
-	cmdPath, err := LookPath(sh.GetVar("PATH"), sh.GetCwd(), cmdName)
-	if err != nil {
-		return nil, err
+	if f := builtins[cmdName]; f != nil {
+		restore, err := sh.SetTempVars(vars)
+		if err != nil {
+			return nil, err
+		}
+		job, err := f(sh, std, args)
+		if err != nil {
+			restore()
+			return nil, err
+		}
+		// Some builtins (e.g. eval) are still running when they return, so
+		// the variables are only restored when the job is done.
+		return &RedirectJob{job: job, cleanup: restore}, nil
 	}
+	return startExternal(sh, std, cmdName, args, env)
+}
+
+// newExecCmd prepares an *exec.Cmd that runs the executable at cmdPath in
+// the shell's current directory, with the file descriptors in std.
+func newExecCmd(sh *Shell, std *StdStreams, cmdPath string, args []string, env []string) *exec.Cmd {
 	cmd := exec.Command(cmdPath, args...)
 	cmd.Dir = sh.GetCwd()
-	cmd.Stdin = std.In
-	cmd.Stdout = std.Out
-	cmd.Stderr = std.Err
-	cmd.Env = env
-	err = cmd.Start()
-	if err != nil {
-		return nil, err
+	cmd.Stdin, _ = childStream(std.In).(io.Reader)
+	cmd.Stdout, _ = childStream(std.Out).(io.Writer)
+	cmd.Stderr, _ = childStream(std.Err).(io.Writer)
+	for fd, f := range std.Files {
+		if sh.privateFiles[f] {
+			continue
+		}
+		for len(cmd.ExtraFiles) <= fd-3 {
+			cmd.ExtraFiles = append(cmd.ExtraFiles, nil)
+		}
+		cmd.ExtraFiles[fd-3] = f
 	}
-	return &ExecJob{cmd: cmd}, nil
+	cmd.Env = env
+	return cmd
 }
 
 type ExecJob struct {
-	cmd *exec.Cmd
+	cmd   *exec.Cmd
+	group *processGroup // Set if the process was started with job control
 }
 
 var _ RunningJob = (*ExecJob)(nil)
 
 func (j *ExecJob) Wait() JobOutcome {
+	if j.group != nil {
+		return j.waitStoppable()
+	}
 	err := j.cmd.Wait()
-	if err != nil {
+	if _, ok := err.(*exec.ExitError); err != nil && !ok {
 		return errorOutcome(err)
 	}
+	// Like in bash, a process killed by a signal has status 128+signal
+	if ws, ok := j.cmd.ProcessState.Sys().(syscall.WaitStatus); ok && ws.Signaled() {
+		return JobOutcome{ExitCode: 128 + int(ws.Signal())}
+	}
 	return JobOutcome{
 		ExitCode: j.cmd.ProcessState.ExitCode(),
 	}
@@ -132,7 +328,7 @@ func (j *ExecJob) Signal(sig os.Signal) {
 }
 
 func (j *ExecJob) String() string {
-	return j.cmd.String()
+	return strings.Join(childArgs(j.cmd), " ")
 }
 
 type SetVarsCommand struct {
@@ -141,101 +337,252 @@ type SetVarsCommand struct {
 
 var _ Command = (*SetVarsCommand)(nil)
 
-func (d *SetVarsCommand) StartJob(sh *Shell, std StdStreams) (RunningJob, error) {
+func (d *SetVarsCommand) StartJob(sh *Shell, std *StdStreams) (RunningJob, error) {
+	sh.RunTrap(trapDebug)
 	for _, varDef := range d.Assigns {
-		val, err := varDef.Val.Value(sh, std)
+		var err error
+		compound, isCompound := varDef.Val.(CompoundValueDef)
+		switch {
+		case isCompound:
+			err = assignArray(sh, std, varDef.Name, compound)
+		case varDef.Sub != nil:
+			err = setArrayElement(sh, std, varDef)
+		default:
+			var val string
+			if val, err = varDef.Val.Value(sh, std); err != nil {
+				break
+			}
+			if sh.Option("xtrace") {
+				traceCommand(sh, std, []AssignDef{varDef}, map[string]string{varDef.Name: val}, nil)
+			}
+			err = sh.SetVar(varDef.Name, val)
+		}
 		if err != nil {
 			return nil, err
 		}
-		sh.SetVar(varDef.Name, val)
 	}
 	return &ImmediateRunningJob{name: "setvars"}, nil
 }
 
+// setArrayElement performs an assignment name[sub]=val.
+func setArrayElement(sh *Shell, std *StdStreams, varDef AssignDef) error {
+	sub, err := varDef.Sub.Value(sh, std)
+	if err != nil {
+		return err
+	}
+	val, err := varDef.Val.Value(sh, std)
+	if err != nil {
+		return err
+	}
+	if sh.Option("xtrace") {
+		traceWords(sh, std, []string{fmt.Sprintf("%s[%s]=%s", varDef.Name, sub, quoteIfNeeded(val))})
+	}
+	return sh.SetArrayElement(varDef.Name, sub, val)
+}
+
+// assignArray performs a compound assignment name=(...).
+func assignArray(sh *Shell, std *StdStreams, name string, compound CompoundValueDef) error {
+	elems, err := compound.elems(sh, std)
+	if err != nil {
+		return err
+	}
+	if sh.Option("xtrace") {
+		traceWords(sh, std, []string{name + "=" + formatArrayElems(elems)})
+	}
+	return sh.AssignArray(name, elems)
+}
+
+// traceCommand prints a command about to be run for the xtrace option,
+// preceded by the expansion of PS4.
+func traceCommand(sh *Shell, std *StdStreams, assigns []AssignDef, vals map[string]string, args []string) {
+	words := make([]string, 0, len(assigns)+len(args))
+	for _, a := range assigns {
+		words = append(words, a.Name+"="+quoteIfNeeded(vals[a.Name]))
+	}
+	for _, arg := range args {
+		words = append(words, quoteIfNeeded(arg))
+	}
+	traceWords(sh, std, words)
+}
+
+// traceWords prints words for the xtrace option, preceded by the expansion of
+// PS4.
+func traceWords(sh *Shell, std *StdStreams, words []string) {
+	ps4 := "+ "
+	if v := sh.lookupVar("PS4"); v != nil {
+		ps4 = v.Value
+	}
+	fmt.Fprintf(std.Err, "%s%s\n", ps4, strings.Join(words, " "))
+}
+
 const (
 	RM_Read int = iota
 	RM_Truncate
 	RM_Append
 	RM_ReadWrite
+	RM_Clobber // Like RM_Truncate but ignores the noclobber option
+	RM_HereDoc // The replacement is the content of the stream
 )
 
 type RedirectCommand struct {
 	FD          int      // File descriptor to redirect
+	FDVar       string   // If not empty, allocate a file descriptor and store it in this variable
 	Replacement ValueDef // Replacement (file name or fd)
 	Mode        int      // Mode to open file in
 	Cmd         Command  // Command to run
 	Ref         bool     // True if expecting an fd
+	Both        bool     // True if stderr should also be redirected (&>, &>>)
 }
 
 var _ Command = (*RedirectCommand)(nil)
 
-func (d *RedirectCommand) StartJob(sh *Shell, std StdStreams) (RunningJob, error) {
-	repl, err := d.Replacement.Value(sh, std)
+func (d *RedirectCommand) StartJob(sh *Shell, std *StdStreams) (RunningJob, error) {
+	std = std.Clone()
+	cleanup, err := d.Apply(sh, std)
 	if err != nil {
 		return nil, err
 	}
-	var f *os.File
+	// Errors are reported here so that they go to the redirected stderr.
+	job := startJobOrReport(d.Cmd, sh, std)
+	return &RedirectJob{
+		job:     job,
+		cleanup: cleanup,
+	}, nil
+}
+
+// Apply performs the redirection on std.  The returned cleanup function must
+// be called when the redirected streams are no longer needed.
+func (d *RedirectCommand) Apply(sh *Shell, std *StdStreams) (func(), error) {
+	noop := func() {}
+	repl, err := d.Replacement.Value(sh, std)
+	if err != nil {
+		return noop, err
+	}
+	fd := d.FD
+	if d.FDVar != "" {
+		if d.Ref && repl == "-" {
+			fd, err = strconv.Atoi(getVarRef(sh, d.FDVar))
+			if err != nil {
+				return noop, fmt.Errorf("%s: invalid file descriptor", d.FDVar)
+			}
+		} else {
+			fd = std.nextFreeFD(10)
+			if err := sh.SetVar(d.FDVar, strconv.Itoa(fd)); err != nil {
+				return noop, err
+			}
+		}
+	}
 	if d.Ref {
-		var ok bool
-		switch repl {
-		case "0":
-			f, ok = std.In.(*os.File)
-		case "1":
-			f, ok = std.Out.(*os.File)
-		case "2":
-			f, ok = std.Err.(*os.File)
-		default:
-			return nil, errors.New("fd must be 0, 1, 2 for now")
+		if repl == "-" {
+			return noop, std.Set(fd, nil)
 		}
-		if !ok {
-			return nil, fmt.Errorf("fd%s is not a file", repl)
+		srcFD, convErr := strconv.Atoi(repl)
+		if convErr == nil {
+			stream := std.Get(srcFD)
+			if stream == nil {
+				return noop, fmt.Errorf("%d: bad file descriptor", srcFD)
+			}
+			return setStream(std, fd, stream)
 		}
-	} else {
-		switch d.Mode {
-		case RM_Read:
-			f, err = os.Open(repl)
-		case RM_Truncate:
-			f, err = os.Create(repl)
-		case RM_Append:
-			f, err = os.OpenFile(repl, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0666)
-		case RM_ReadWrite:
-			f, err = os.OpenFile(repl, os.O_CREATE|os.O_APPEND, 0666)
+		if d.FD != 1 || d.FDVar != "" {
+			return noop, fmt.Errorf("%s: ambiguous redirect", repl)
 		}
-		if err != nil {
-			return nil, err
+		// Like bash, >&word is the same as &>word when word is not a number
+		return (&RedirectCommand{
+			FD:          1,
+			Replacement: LiteralValueDef{Val: repl},
+			Mode:        RM_Truncate,
+			Both:        true,
+		}).Apply(sh, std)
+	}
+	if d.Mode == RM_HereDoc {
+		return setStream(std, fd, strings.NewReader(repl))
+	}
+	f, err := openRedirectFile(sh, sh.AbsPath(repl), d.Mode)
+	if err != nil {
+		return noop, err
+	}
+	err = std.Set(fd, f)
+	if err == nil && d.Both {
+		err = std.Set(2, f)
+	}
+	if err != nil {
+		f.Close()
+		return noop, err
+	}
+	return func() { f.Close() }, nil
+}
+
+func openRedirectFile(sh *Shell, path string, mode int) (*os.File, error) {
+	switch mode {
+	case RM_Read:
+		return os.Open(path)
+	case RM_Truncate:
+		if sh.Option("noclobber") {
+			fi, err := os.Stat(path)
+			if err == nil && fi.Mode().IsRegular() {
+				return nil, fmt.Errorf("%s: cannot overwrite existing file", path)
+			}
 		}
+		return createFile(sh, path, os.O_CREATE|os.O_TRUNC|os.O_WRONLY)
+	case RM_Clobber:
+		return createFile(sh, path, os.O_CREATE|os.O_TRUNC|os.O_WRONLY)
+	case RM_Append:
+		return createFile(sh, path, os.O_APPEND|os.O_CREATE|os.O_WRONLY)
+	case RM_ReadWrite:
+		return createFile(sh, path, os.O_CREATE|os.O_RDWR)
+	default:
+		panic("bug!")
 	}
-	switch d.FD {
-	case 0: // stdin
-		std.In = f
-	case 1:
-		std.Out = f
-	case 2:
-		std.Err = f
+}
+
+// setStream makes fd refer to stream in std.  File descriptors above 2 can
+// only be files, so other streams are connected to them through a pipe.
+func setStream(std *StdStreams, fd int, stream interface{}) (func(), error) {
+	noop := func() {}
+	_, isFile := stream.(*os.File)
+	if fd <= 2 || isFile {
+		return noop, std.Set(fd, stream)
 	}
-	job, err := d.Cmd.StartJob(sh, std)
+	r, w, err := os.Pipe()
 	if err != nil {
-		return nil, err
+		return noop, err
 	}
-	if d.Ref {
-		// We don't want to close the file
-		return job, nil
+	done := make(chan struct{})
+	switch s := stream.(type) {
+	case io.Writer:
+		go func() {
+			io.Copy(s, r)
+			close(done)
+		}()
+		return func() {
+			w.Close()
+			<-done
+			r.Close()
+		}, std.Set(fd, w)
+	case io.Reader:
+		go func() {
+			io.Copy(w, s)
+			w.Close()
+			close(done)
+		}()
+		return func() {
+			r.Close()
+		}, std.Set(fd, r)
+	default:
+		panic("bug!")
 	}
-	return &RedirectJob{
-		job:  job,
-		file: f,
-	}, nil
 }
 
 type RedirectJob struct {
-	job  RunningJob
-	file *os.File
+	job     RunningJob
+	cleanup func()
 }
 
 var _ RunningJob = (*RedirectJob)(nil)
 
 func (c *RedirectJob) Wait() JobOutcome {
-	defer c.file.Close()
+	defer c.cleanup()
 	return c.job.Wait()
 }
 
@@ -257,35 +604,39 @@ type PipelineCommand struct {
 
 var _ Command = (*PipelineCommand)(nil)
 
-func (d *PipelineCommand) StartJob(sh *Shell, std StdStreams) (RunningJob, error) {
+func (d *PipelineCommand) StartJob(sh *Shell, std *StdStreams) (RunningJob, error) {
 	r, w, err := os.Pipe()
 	if err != nil {
 		return nil, err
 	}
-	rstd := std
-	std.Out = w
+	lstd, rstd := std.Clone(), std.Clone()
+	lstd.Out = w
 	rstd.In = r
 
-	left, err := d.Left.StartJob(sh, std)
-	if err != nil {
-		return nil, err
-	}
-	right, err := d.Right.StartJob(sh, rstd)
-	if err != nil {
-		return nil, err
-	}
-	w.Close()
+	left := startJobOrReport(d.Left, sh, lstd)
+	leftDone := make(chan JobOutcome, 1)
+	go func() {
+		// The left job may be a compound command that starts more commands
+		// writing to the pipe, so only close it when it is all done.
+		res := left.Wait()
+		w.Close()
+		leftDone <- res
+	}()
+	right := startJobOrReport(d.Right, sh, rstd)
 	return &PipelineJob{
-		left:  left,
-		right: right,
-		pipeR: r,
-		pipeW: w,
+		left:     left,
+		right:    right,
+		leftDone: leftDone,
+		pipeR:    r,
+		pipefail: sh.Option("pipefail"),
 	}, nil
 }
 
 type PipelineJob struct {
-	left, right  RunningJob
-	pipeR, pipeW *os.File
+	left, right RunningJob
+	leftDone    <-chan JobOutcome
+	pipeR       *os.File
+	pipefail    bool // Fail if any command fails, not just the last one
 }
 
 var _ RunningJob = (*PipelineJob)(nil)
@@ -293,9 +644,10 @@ var _ RunningJob = (*PipelineJob)(nil)
 func (p *PipelineJob) Wait() JobOutcome {
 	r1 := p.right.Wait()
 	p.pipeR.Close()
-	r2 := p.left.Wait()
-
-	_ = r2 // TODO: handle this error (ala bash set -o pipefail)
+	r2 := <-p.leftDone
+	if p.pipefail && r1.Success() {
+		return r2
+	}
 	return r1
 }
 
@@ -327,14 +679,21 @@ type CommandSequence struct {
 
 var _ Command = (*CommandSequence)(nil)
 
-func (d *CommandSequence) StartJob(sh *Shell, std StdStreams) (RunningJob, error) {
-	left, err := d.Left.StartJob(sh, std)
-	if err != nil {
-		return nil, err
+func (d *CommandSequence) StartJob(sh *Shell, std *StdStreams) (RunningJob, error) {
+	conditional := d.SeqType != UncondSeq
+	lstd := std
+	if conditional {
+		lstd = std.ignoringErrexit()
 	}
-	resCh := make(chan JobOutcome)
+	seq := newJobSequence()
+	left := seq.track(startJobOrReport(d.Left, sh, lstd))
 	go func() {
 		res := left.Wait()
+		sh.lastCommandExitCode = res.ExitCode
+		if !conditional {
+			sh.CheckErrexit(std, d.Left, res)
+		}
+		sh.runSignalTraps()
 		var shouldStartSecond bool
 		if !sh.ShouldStop() {
 			switch d.SeqType {
@@ -349,35 +708,60 @@ func (d *CommandSequence) StartJob(sh *Shell, std StdStreams) (RunningJob, error
 			}
 		}
 		if shouldStartSecond {
-			var right RunningJob
-			right, err = d.Right.StartJob(sh, std)
-			if err != nil {
-				res = errorOutcome(err)
-			} else {
-				res = right.Wait()
-			}
+			res = seq.track(startJobOrReport(d.Right, sh, std)).Wait()
+			sh.CheckErrexit(std, d.Right, res)
+			sh.runSignalTraps()
 		}
-		resCh <- res
+		seq.resCh <- res
 	}()
-	return &JobSequence{resCh: resCh}, nil
+	return seq, nil
 }
 
+// A JobSequence is a job made of jobs started one after the other by a
+// goroutine, which sends the outcome of the whole to resCh.
 type JobSequence struct {
-	resCh chan JobOutcome
+	resCh   chan JobOutcome
+	mutex   sync.Mutex
+	current RunningJob // The job running now, which signals are passed to
 }
 
 var _ RunningJob = (*JobSequence)(nil)
 
+func newJobSequence() *JobSequence {
+	return &JobSequence{resCh: make(chan JobOutcome)}
+}
+
+// track makes job the one that signals are passed to and returns it.
+func (s *JobSequence) track(job RunningJob) RunningJob {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.current = job
+	return job
+}
+
 func (s *JobSequence) Wait() JobOutcome {
 	return <-s.resCh
 }
 
 func (s *JobSequence) Signal(sig os.Signal) {
-	// TODO
+	s.mutex.Lock()
+	job := s.current
+	s.mutex.Unlock()
+	if job != nil {
+		job.Signal(sig)
+	}
 }
 
+// String returns the name of the job running now, which is what a stopped
+// sequence is named after, as in bash.
 func (s *JobSequence) String() string {
-	return "seqcmd"
+	s.mutex.Lock()
+	job := s.current
+	s.mutex.Unlock()
+	if job == nil {
+		return "seqcmd"
+	}
+	return job.String()
 }
 
 //
@@ -385,40 +769,82 @@ func (s *JobSequence) String() string {
 //
 
 type BackgroundCommand struct {
-	Cmd Command
+	Cmd    Command
+	Source string // Source code of the command, for the jobs builtin
 }
 
 var _ Command = (*BackgroundCommand)(nil)
 
-func (d *BackgroundCommand) StartJob(sh *Shell, std StdStreams) (RunningJob, error) {
-	job, err := d.Cmd.StartJob(sh, std)
-	if err != nil {
-		return nil, err
+func (d *BackgroundCommand) StartJob(sh *Shell, std *StdStreams) (RunningJob, error) {
+	// The command runs in a subshell which owns the process group of the
+	// job, so that all its processes join it however late they start.
+	subshell := sh.Subshell()
+	subshell.fds = std.Clone()
+	var group *processGroup
+	if sh.JobControl() {
+		group = sh.newProcessGroup(false)
+		subshell.group = group
 	}
-	// job := sh.StartJob(c)
-	go func() {
-		job.Wait()
-		// sh.StopJob(job)
-	}()
-	return &BackgroundJob{job: job}, nil
-}
-
-type BackgroundJob struct {
-	job RunningJob
+	job := startSubshell(subshell, d.Cmd, d.Source)
+	j := sh.addJob(job, d.Source, group, nil)
+	sh.lastBackgroundPid = j.Pid
+	if sh.interactive {
+		fmt.Fprintf(std.Err, "[%d] %d\n", j.ID, j.Pid)
+	}
+	// The job is not waited for, so it is not the one to signal
+	return &ImmediateRunningJob{name: "background"}, nil
 }
 
-var _ RunningJob = (*BackgroundJob)(nil)
+//
+// Coprocess
+//
 
-func (c *BackgroundJob) Wait() JobOutcome {
-	return JobOutcome{}
+type CoprocCommand struct {
+	Name string
+	Body Command
 }
 
-func (c *BackgroundJob) Signal(sig os.Signal) {
-	c.job.Signal(sig)
-}
+var _ Command = (*CoprocCommand)(nil)
 
-func (c *BackgroundJob) String() string {
-	return ""
+func (c *CoprocCommand) StartJob(sh *Shell, std *StdStreams) (RunningJob, error) {
+	inR, inW, err := os.Pipe()
+	if err != nil {
+		return nil, err
+	}
+	outR, outW, err := os.Pipe()
+	if err != nil {
+		inR.Close()
+		inW.Close()
+		return nil, err
+	}
+	subshell := sh.Subshell()
+	subshell.fds = std.Clone()
+	subshell.fds.In = inR
+	subshell.fds.Out = outW
+	name := "coproc " + c.Name
+	job := startSubshell(subshell, c.Body, name)
+	readFD := std.nextFreeFD(10)
+	std.Set(readFD, outR)
+	writeFD := std.nextFreeFD(10)
+	std.Set(writeFD, inW)
+	// Like bash, do not let other commands inherit the coprocess pipes, or
+	// it may never see the end of its input.
+	sh.privateFiles[outR] = true
+	sh.privateFiles[inW] = true
+	sh.ownedFiles[outR] = true
+	sh.ownedFiles[inW] = true
+	sh.SetArray(c.Name, []string{strconv.Itoa(readFD), strconv.Itoa(writeFD)})
+	j := sh.AddJob(&RedirectJob{
+		job: job,
+		cleanup: func() {
+			inR.Close()
+			outW.Close()
+		},
+	}, name)
+	if err := sh.SetVar(c.Name+"_PID", strconv.Itoa(j.Pid)); err != nil {
+		return nil, err
+	}
+	return &ImmediateRunningJob{name: "coproc"}, nil
 }
 
 //
@@ -431,22 +857,40 @@ type SubshellCommand struct {
 
 var _ Command = (*SubshellCommand)(nil)
 
-func (d *SubshellCommand) StartJob(sh *Shell, std StdStreams) (RunningJob, error) {
+func (d *SubshellCommand) StartJob(sh *Shell, std *StdStreams) (RunningJob, error) {
 	subshell := sh.Subshell()
-	job, err := d.Body.StartJob(subshell, std)
-	if err != nil {
-		return nil, err
+	subshell.fds = std.Clone()
+	return startSubshell(subshell, d.Body, ""), nil
+}
+
+// startSubshell starts cmd in subshell.  The job ends when the subshell exits,
+// with its exit status.  Errors starting cmd are reported by the subshell,
+// which may exit because of them.
+func startSubshell(subshell *Shell, cmd Command, name string) *SubshellJob {
+	// As in bash, ( ... ) & is a single subshell, so that signals sent to
+	// the job are only acted on once.
+	if sc, ok := cmd.(*SubshellCommand); ok {
+		cmd = sc.Body
 	}
+	job := startJobOrReport(cmd, subshell, subshell.fds)
 	go func() {
-		subshell.Exit(job.Wait().ExitCode)
+		res := job.Wait()
+		// A signal caught while the last command ran, e.g. a loop
+		// condition, still ends the subshell.
+		subshell.runSignalTraps()
+		subshell.Exit(res.ExitCode)
 	}()
 	return &SubshellJob{
 		subshell: subshell,
-	}, nil
+		job:      job,
+		name:     name,
+	}
 }
 
 type SubshellJob struct {
 	subshell *Shell
+	job      RunningJob // The command run by the subshell
+	name     string     // If empty, the job is named after the command
 }
 
 var _ RunningJob = &SubshellJob{}
@@ -455,12 +899,18 @@ func (c *SubshellJob) Wait() JobOutcome {
 	return JobOutcome{ExitCode: c.subshell.Wait()}
 }
 
+// Signal passes sig to the command being run and to the subshell, which acts
+// on it before running the next command as a shell process would.
 func (c *SubshellJob) Signal(sig os.Signal) {
-	// TODO
+	c.subshell.signal(sig)
+	c.job.Signal(sig)
 }
 
 func (c *SubshellJob) String() string {
-	return "subshell"
+	if c.name == "" {
+		return "( " + c.job.String() + " )"
+	}
+	return c.name
 }
 
 type IfCommand struct {
@@ -470,29 +920,25 @@ type IfCommand struct {
 
 var _ Command = (*IfCommand)(nil)
 
-func (c *IfCommand) StartJob(sh *Shell, std StdStreams) (RunningJob, error) {
-	job, err := c.Condition.StartJob(sh, std)
-	if err != nil {
-		return nil, err
-	}
-	resCh := make(chan JobOutcome)
+func (c *IfCommand) StartJob(sh *Shell, std *StdStreams) (RunningJob, error) {
+	seq := newJobSequence()
+	job := seq.track(startJobOrReport(c.Condition, sh, std.ignoringErrexit()))
 	go func() {
 		res := job.Wait()
-		var condJob RunningJob
-		if res.Success() {
-			condJob, err = c.Then.StartJob(sh, std)
-		} else if c.Else != nil {
-			condJob, err = c.Else.StartJob(sh, std)
+		sh.lastCommandExitCode = res.ExitCode
+		branch := c.Then
+		if !res.Success() {
+			branch = c.Else
 		}
-		if err != nil {
-			resCh <- errorOutcome(err)
-		} else if condJob != nil {
-			resCh <- condJob.Wait()
-		} else {
-			resCh <- JobOutcome{}
+		if branch == nil {
+			seq.resCh <- JobOutcome{}
+			return
 		}
+		res = seq.track(startJobOrReport(branch, sh, std)).Wait()
+		sh.CheckErrexit(std, branch, res)
+		seq.resCh <- res
 	}()
-	return &JobSequence{resCh: resCh}, nil
+	return seq, nil
 }
 
 type WhileCommand struct {
@@ -502,67 +948,69 @@ type WhileCommand struct {
 
 var _ Command = (*WhileCommand)(nil)
 
-func (c *WhileCommand) StartJob(sh *Shell, std StdStreams) (RunningJob, error) {
-	resCh := make(chan JobOutcome)
+func (c *WhileCommand) StartJob(sh *Shell, std *StdStreams) (RunningJob, error) {
+	seq := newJobSequence()
 	go func() {
 		var res JobOutcome
 		for !sh.ShouldStop() {
-			job, err := c.Condition.StartJob(sh, std)
-			if err != nil {
-				res = errorOutcome(err)
-				break
-			}
-			res = job.Wait()
+			res = seq.track(startJobOrReport(c.Condition, sh, std.ignoringErrexit())).Wait()
+			sh.lastCommandExitCode = res.ExitCode
 			if !res.Success() {
 				res = JobOutcome{}
 				break
 			}
-			job, err = c.Body.StartJob(sh, std)
-			if err != nil {
-				res = errorOutcome(err)
-				break
-			}
-			job.Wait()
+			body := seq.track(startJobOrReport(c.Body, sh, std)).Wait()
+			sh.lastCommandExitCode = body.ExitCode
+			sh.CheckErrexit(std, c.Body, body)
+			// Like bash, run the traps of the signals caught during each
+			// iteration, so that a loop can be interrupted by a trap.
+			sh.runSignalTraps()
 		}
-		resCh <- res
+		seq.resCh <- res
 	}()
-	return &JobSequence{resCh: resCh}, nil
+	return seq, nil
 }
 
 type FunctionDefCommand struct {
-	Name ValueDef
-	Body Command
+	Name   ValueDef
+	Body   Command
+	Source string // Source code of the body, for declare -f
 }
 
 var _ Command = (*FunctionDefCommand)(nil)
 
-func (c *FunctionDefCommand) StartJob(sh *Shell, std StdStreams) (RunningJob, error) {
+func (c *FunctionDefCommand) StartJob(sh *Shell, std *StdStreams) (RunningJob, error) {
 	name, err := c.Name.Value(sh, std)
 	if err != nil {
 		return nil, err
 	}
-	sh.SetFunction(name, c.Body)
+	sh.SetFunction(name, &Function{Body: c.Body, Source: c.Source})
 	return &ImmediateRunningJob{name: "define function"}, nil
 }
 
-func CallFunction(sh *Shell, std StdStreams, f Command, fname string, args []string) (RunningJob, error) {
+func CallFunction(sh *Shell, std *StdStreams, f Command, fname string, args []string, vars map[string]string) (RunningJob, error) {
 	sh.PushFrame(fname, args)
+	// Assignments preceding the call last until the function returns
+	for name, val := range vars {
+		sh.SetLocalVar(name, val)
+	}
 	fjob, err := f.StartJob(sh, std)
 	if err != nil {
 		sh.PopFrame()
 		return nil, err
 	}
-	resCh := make(chan JobOutcome)
+	seq := newJobSequence()
+	seq.track(fjob)
 	go func() {
 		res := fjob.Wait()
 		code, returned := sh.PopFrame()
 		if returned {
-			resCh <- JobOutcome{ExitCode: code}
+			seq.resCh <- JobOutcome{ExitCode: code}
 		} else {
-			resCh <- res
+			seq.resCh <- res
 		}
 	}()
-	return &JobSequence{resCh: resCh}, nil
+	return seq, nil
 }
 
 //
@@ -603,7 +1051,9 @@ func (a *SetVarsCmd) Add(key, value string) {
 
 func (a *SetVarsCmd) Start() error {
 	for _, item := range a.items {
-		a.shell.SetVar(item.key, item.value)
+		if err := a.shell.SetVar(item.key, item.value); err != nil {
+			return err
+		}
 	}
 	return nil
 }
@@ -0,0 +1,392 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"os/exec"
+	"os/user"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// ChangeDir makes dir the current directory and updates PWD and OLDPWD.  If
+// physical is true, symbolic links are resolved in the new path.
+func (s *Shell) ChangeDir(dir string, physical bool) error {
+	cwd, err := LookDir(s.cwd, dir, physical)
+	if err != nil {
+		return err
+	}
+	if err := s.setPwdVar("OLDPWD", s.cwd); err != nil {
+		return err
+	}
+	s.cwd = cwd
+	return s.setPwdVar("PWD", cwd)
+}
+
+func (s *Shell) setPwdVar(name, dir string) error {
+	if err := s.SetVar(name, dir); err != nil {
+		return err
+	}
+	s.SetVarAttrs(name, VarExport)
+	return nil
+}
+
+// initPwd sets PWD when the shell starts.  An inherited PWD is kept if it
+// names the current directory, so that the logical path survives.
+func (s *Shell) initPwd() {
+	if pwd := s.GetVar("PWD"); filepath.IsAbs(pwd) && sameFile(pwd, s.cwd) {
+		s.cwd = filepath.Clean(pwd)
+	}
+	s.setPwdVar("PWD", s.cwd)
+}
+
+func sameFile(path1, path2 string) bool {
+	fi1, err1 := os.Stat(path1)
+	fi2, err2 := os.Stat(path2)
+	return err1 == nil && err2 == nil && os.SameFile(fi1, fi2)
+}
+
+// HomeDir returns the value of HOME, or the user's home directory if it is not
+// set.
+func (s *Shell) HomeDir() string {
+	if home := s.GetVar("HOME"); home != "" {
+		return home
+	}
+	home, _ := os.UserHomeDir()
+	return home
+}
+
+// parsePathMode parses the -L and -P options of cd and pwd.  The default is
+// given by the physical option (set -P).
+func parsePathMode(sh *Shell, cmd string, args []string) (bool, []string, error) {
+	physical := sh.Option("physical")
+	for len(args) > 0 && len(args[0]) > 1 && args[0][0] == '-' {
+		arg := args[0]
+		if arg == "--" {
+			args = args[1:]
+			break
+		}
+		for _, c := range arg[1:] {
+			switch c {
+			case 'L':
+				physical = false
+			case 'P':
+				physical = true
+			default:
+				return false, nil, fmt.Errorf("%s: -%c: invalid option", cmd, c)
+			}
+		}
+		args = args[1:]
+	}
+	return physical, args, nil
+}
+
+func builtinCd(sh *Shell, std *StdStreams, args []string) (RunningJob, error) {
+	physical, args, err := parsePathMode(sh, "cd", args)
+	if err != nil {
+		return nil, err
+	}
+	var (
+		dir   string
+		print bool // Print the new directory, for "cd -" and CDPATH
+	)
+	switch len(args) {
+	case 0:
+		dir = sh.HomeDir()
+	case 1:
+		dir = args[0]
+	default:
+		return nil, errors.New("cd: too many arguments")
+	}
+	if dir == "-" {
+		dir = sh.GetVar("OLDPWD")
+		if dir == "" {
+			return nil, errors.New("cd: OLDPWD not set")
+		}
+		print = true
+	} else if found, ok := searchCdPath(sh, dir); ok {
+		dir = found
+		print = true
+	}
+	if err := sh.ChangeDir(dir, physical); err != nil {
+		return nil, fmt.Errorf("cd: %s: %s", dir, dirErrorReason(err))
+	}
+	if print {
+		fmt.Fprintln(std.Out, sh.GetCwd())
+	}
+	return &ImmediateRunningJob{name: "cd"}, nil
+}
+
+// searchCdPath looks for dir in the directories listed in CDPATH.  It returns
+// false if dir should be used as it is, i.e. if it is absolute or starts with
+// . or .., or if it is found in the current directory through an empty entry
+// of CDPATH.
+func searchCdPath(sh *Shell, dir string) (string, bool) {
+	cdpath := sh.GetVar("CDPATH")
+	if cdpath == "" || filepath.IsAbs(dir) || dir == "." || dir == ".." ||
+		strings.HasPrefix(dir, "./") || strings.HasPrefix(dir, "../") {
+		return "", false
+	}
+	for _, base := range filepath.SplitList(cdpath) {
+		if base == "" {
+			if findDirectory(sh.AbsPath(dir)) == nil {
+				return "", false
+			}
+			continue
+		}
+		path := filepath.Join(sh.AbsPath(base), dir)
+		if findDirectory(path) == nil {
+			return path, true
+		}
+	}
+	return "", false
+}
+
+// dirErrorReason returns the reason why a directory could not be used, e.g.
+// "no such file or directory".
+func dirErrorReason(err error) error {
+	var execErr *exec.Error
+	if errors.As(err, &execErr) {
+		err = execErr.Err
+	}
+	var pathErr *fs.PathError
+	if errors.As(err, &pathErr) {
+		err = pathErr.Err
+	}
+	return err
+}
+
+func builtinPwd(sh *Shell, std *StdStreams, args []string) (RunningJob, error) {
+	physical, args, err := parsePathMode(sh, "pwd", args)
+	if err != nil {
+		return nil, err
+	}
+	if len(args) > 0 {
+		return nil, errors.New("pwd: too many arguments")
+	}
+	dir := sh.GetCwd()
+	if physical {
+		if dir, err = filepath.EvalSymlinks(dir); err != nil {
+			return nil, fmt.Errorf("pwd: %w", err)
+		}
+	}
+	fmt.Fprintln(std.Out, dir)
+	return &ImmediateRunningJob{name: "pwd"}, nil
+}
+
+//
+// Directory stack
+//
+
+// Dirs returns the directory stack, starting with the current directory.
+func (s *Shell) Dirs() []string {
+	return append([]string{s.cwd}, s.dirStack...)
+}
+
+// dirIndex converts +N (counting from the left of the output of dirs, from 0)
+// or -N (counting from the right) to an index in the stack, whose size is n.
+func dirIndex(spec string, n int) (int, bool) {
+	if len(spec) < 2 || (spec[0] != '+' && spec[0] != '-') {
+		return 0, false
+	}
+	i, err := strconv.Atoi(spec[1:])
+	if err != nil || i < 0 {
+		return 0, false
+	}
+	if spec[0] == '-' {
+		i = n - 1 - i
+	}
+	return i, true
+}
+
+func isDirIndex(spec string) bool {
+	_, ok := dirIndex(spec, 0)
+	return ok
+}
+
+// printDirs prints the directory stack.
+func printDirs(sh *Shell, std *StdStreams, long, perLine, numbered bool) {
+	dirs := sh.Dirs()
+	for i, dir := range dirs {
+		if !long {
+			dir = abbreviateHome(sh, dir)
+		}
+		switch {
+		case numbered:
+			fmt.Fprintf(std.Out, "%2d  %s\n", i, dir)
+		case perLine:
+			fmt.Fprintln(std.Out, dir)
+		case i < len(dirs)-1:
+			fmt.Fprint(std.Out, dir, " ")
+		default:
+			fmt.Fprintln(std.Out, dir)
+		}
+	}
+}
+
+// abbreviateHome replaces the home directory with ~ at the start of dir.
+func abbreviateHome(sh *Shell, dir string) string {
+	home := sh.HomeDir()
+	if home != "" && (dir == home || strings.HasPrefix(dir, home+"/")) {
+		return "~" + dir[len(home):]
+	}
+	return dir
+}
+
+func builtinDirs(sh *Shell, std *StdStreams, args []string) (RunningJob, error) {
+	var long, perLine, numbered bool
+	for len(args) > 0 && len(args[0]) > 1 && args[0][0] == '-' && !isDirIndex(args[0]) {
+		for _, c := range args[0][1:] {
+			switch c {
+			case 'c':
+				sh.dirStack = nil
+			case 'l':
+				long = true
+			case 'p':
+				perLine = true
+			case 'v':
+				perLine = true
+				numbered = true
+			default:
+				return nil, fmt.Errorf("dirs: -%c: invalid option", c)
+			}
+		}
+		args = args[1:]
+	}
+	if len(args) > 0 {
+		dirs := sh.Dirs()
+		i, ok := dirIndex(args[0], len(dirs))
+		if !ok || i < 0 || i >= len(dirs) {
+			return nil, fmt.Errorf("dirs: %s: directory stack index out of range", args[0])
+		}
+		dir := dirs[i]
+		if !long {
+			dir = abbreviateHome(sh, dir)
+		}
+		fmt.Fprintln(std.Out, dir)
+		return &ImmediateRunningJob{name: "dirs"}, nil
+	}
+	printDirs(sh, std, long, perLine, numbered)
+	return &ImmediateRunningJob{name: "dirs"}, nil
+}
+
+// parseNoCd parses the -n option of pushd and popd, which manipulates the
+// stack without changing directory when adding or removing an entry.
+func parseNoCd(args []string) (bool, []string) {
+	if len(args) > 0 && args[0] == "-n" {
+		return true, args[1:]
+	}
+	if len(args) > 0 && args[0] == "--" {
+		return false, args[1:]
+	}
+	return false, args
+}
+
+func builtinPushd(sh *Shell, std *StdStreams, args []string) (RunningJob, error) {
+	noCd, args := parseNoCd(args)
+	if len(args) > 1 {
+		return nil, errors.New("pushd: too many arguments")
+	}
+	dirs := sh.Dirs()
+	var newDirs []string
+	switch {
+	case len(args) == 0:
+		// Exchange the top two directories
+		if len(dirs) < 2 {
+			return nil, errors.New("pushd: no other directory")
+		}
+		newDirs = append([]string{dirs[1], dirs[0]}, dirs[2:]...)
+	case isDirIndex(args[0]):
+		// Rotate the stack to bring the Nth directory to the top
+		i, _ := dirIndex(args[0], len(dirs))
+		if i < 0 || i >= len(dirs) {
+			return nil, fmt.Errorf("pushd: %s: directory stack index out of range", args[0])
+		}
+		newDirs = append(append([]string{}, dirs[i:]...), dirs[:i]...)
+	case noCd:
+		sh.dirStack = append([]string{args[0]}, sh.dirStack...)
+		printDirs(sh, std, false, false, false)
+		return &ImmediateRunningJob{name: "pushd"}, nil
+	default:
+		newDirs = append([]string{args[0]}, dirs...)
+	}
+	if err := sh.ChangeDir(newDirs[0], sh.Option("physical")); err != nil {
+		return nil, fmt.Errorf("pushd: %s: %s", newDirs[0], dirErrorReason(err))
+	}
+	sh.dirStack = newDirs[1:]
+	printDirs(sh, std, false, false, false)
+	return &ImmediateRunningJob{name: "pushd"}, nil
+}
+
+func builtinPopd(sh *Shell, std *StdStreams, args []string) (RunningJob, error) {
+	noCd, args := parseNoCd(args)
+	if len(args) > 1 {
+		return nil, errors.New("popd: too many arguments")
+	}
+	if len(sh.dirStack) == 0 {
+		return nil, errors.New("popd: directory stack empty")
+	}
+	dirs := sh.Dirs()
+	i := 0
+	if noCd {
+		i = 1
+	}
+	if len(args) == 1 {
+		var ok bool
+		i, ok = dirIndex(args[0], len(dirs))
+		if !ok {
+			return nil, fmt.Errorf("popd: %s: invalid argument", args[0])
+		}
+		if i < 0 || i >= len(dirs) {
+			return nil, fmt.Errorf("popd: %s: directory stack index out of range", args[0])
+		}
+	}
+	newDirs := append(append([]string{}, dirs[:i]...), dirs[i+1:]...)
+	if i == 0 {
+		if err := sh.ChangeDir(newDirs[0], sh.Option("physical")); err != nil {
+			return nil, fmt.Errorf("popd: %s: %s", newDirs[0], dirErrorReason(err))
+		}
+	}
+	sh.dirStack = newDirs[1:]
+	printDirs(sh, std, false, false, false)
+	return &ImmediateRunningJob{name: "popd"}, nil
+}
+
+//
+// Tilde expansion
+//
+
+// ExpandTilde returns the expansion of a tilde prefix (without the ~): the
+// home directory of the given user, or of the current user if it is empty,
+// PWD for +, OLDPWD for - and an entry of the directory stack for N, +N or
+// -N.  It returns false if prefix cannot be expanded, in which case it is left
+// as it is.
+func (s *Shell) ExpandTilde(prefix string) (string, bool) {
+	switch prefix {
+	case "":
+		return s.HomeDir(), true
+	case "+":
+		return s.GetVar("PWD"), s.GetVar("PWD") != ""
+	case "-":
+		return s.GetVar("OLDPWD"), s.GetVar("OLDPWD") != ""
+	}
+	if c := prefix[0]; c >= '0' && c <= '9' {
+		prefix = "+" + prefix
+	}
+	if isDirIndex(prefix) {
+		dirs := s.Dirs()
+		i, _ := dirIndex(prefix, len(dirs))
+		if i < 0 || i >= len(dirs) {
+			return "", false
+		}
+		return dirs[i], true
+	}
+	u, err := user.Lookup(prefix)
+	if err != nil {
+		return "", false
+	}
+	return u.HomeDir, true
+}
@@ -0,0 +1,270 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// ExecCommand implements the exec builtin.  It is not a normal builtin
+// because with no command its redirections are applied permanently to the
+// shell's file descriptor table.
+type ExecCommand struct {
+	Args      []ValueDef
+	Assigns   []AssignDef
+	Redirects []*RedirectCommand
+}
+
+var _ Command = (*ExecCommand)(nil)
+
+// ExecError is returned when exec cannot run its command.  A non-interactive
+// shell exits then, as in bash.
+type ExecError struct {
+	Err error
+}
+
+func (e *ExecError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *ExecError) Unwrap() error {
+	return e.Err
+}
+
+func (c *ExecCommand) StartJob(sh *Shell, std *StdStreams) (RunningJob, error) {
+	var args []string
+	for _, valDef := range c.Args {
+		chunk, err := valDef.Values(sh, std)
+		if err != nil {
+			return nil, err
+		}
+		args = append(args, chunk...)
+	}
+	var (
+		argv0    string
+		clearEnv bool
+		login    bool
+	)
+argsLoop:
+	for len(args) > 0 && len(args[0]) > 1 && args[0][0] == '-' {
+		opt := args[0]
+		args = args[1:]
+		if opt == "--" {
+			break
+		}
+		for i := 1; i < len(opt); i++ {
+			switch opt[i] {
+			case 'c':
+				clearEnv = true
+			case 'l':
+				login = true
+			case 'a':
+				if len(args) == 0 {
+					return nil, errors.New("exec: -a: option requires an argument")
+				}
+				argv0 = args[0]
+				args = args[1:]
+				continue argsLoop
+			default:
+				return nil, fmt.Errorf("exec: -%c: invalid option", opt[i])
+			}
+		}
+	}
+	if len(args) == 0 {
+		return c.redirectShell(sh, std)
+	}
+
+	// The environment must not be nil, or os/exec would pass the process
+	// environment to the command.
+	env := []string{}
+	if !clearEnv {
+		env = sh.Environ()
+	}
+	for _, varDef := range c.Assigns {
+		val, err := varDef.Val.Value(sh, std)
+		if err != nil {
+			return nil, err
+		}
+		env = append(env, varDef.Name+"="+val)
+	}
+	env = dedupEnv(env)
+	cmdPath, err := sh.LookCommand(args[0])
+	if err != nil {
+		return nil, &ExecError{Err: err}
+	}
+	if argv0 == "" {
+		argv0 = args[0]
+	}
+	if login {
+		argv0 = "-" + argv0
+	}
+	cmdStd := std.Clone()
+	for _, r := range c.Redirects {
+		// The command gets its own copies of the files, so they can be
+		// closed when it has started (or failed to).
+		cleanup, err := r.Apply(sh, cmdStd)
+		defer cleanup()
+		if err != nil {
+			return nil, err
+		}
+	}
+	// Only the shell itself can be replaced.  In a subshell or a pipeline
+	// (which meshell runs in-process) we start a child instead.
+	if !sh.subshell && std == sh.Streams() {
+		err = replaceProcess(sh, cmdStd, cmdPath, append([]string{argv0}, args[1:]...), env)
+		if err != errCannotReplace {
+			return nil, &ExecError{Err: fmt.Errorf("exec: %s: %w", args[0], err)}
+		}
+	}
+	cmd := newExecCmd(sh, cmdStd, cmdPath, args[1:], env)
+	cmd.Args[0] = argv0
+	if err := sh.prepareChild(cmd); err != nil {
+		return nil, err
+	}
+	if err := cmd.Start(); err != nil {
+		return nil, &ExecError{Err: err}
+	}
+	job := &ExecJob{cmd: cmd}
+	if !sh.subshell {
+		return job, nil
+	}
+	seq := newJobSequence()
+	seq.track(job)
+	go func() {
+		res := job.Wait()
+		sh.Exit(res.ExitCode)
+		seq.resCh <- res
+	}()
+	return seq, nil
+}
+
+// redirectShell applies the redirections to std permanently.
+func (c *ExecCommand) redirectShell(sh *Shell, std *StdStreams) (RunningJob, error) {
+	before := openFiles(std)
+	for _, r := range c.Redirects {
+		if _, err := r.Apply(sh, std); err != nil {
+			return nil, err
+		}
+	}
+	// Files opened by exec (or coproc) belong to the shell, which must close
+	// them when they are no longer in use (e.g. so that the reading end of a
+	// fifo gets EOF after `exec 3>&-`).
+	after := openFiles(std)
+	for f := range after {
+		if !before[f] {
+			sh.ownedFiles[f] = true
+		}
+	}
+	inUse := openFiles(sh.Streams())
+	for f := range sh.ownedFiles {
+		if !after[f] && !inUse[f] {
+			f.Close()
+			delete(sh.ownedFiles, f)
+		}
+	}
+	return &ImmediateRunningJob{name: "exec"}, nil
+}
+
+func openFiles(std *StdStreams) map[*os.File]bool {
+	files := map[*os.File]bool{}
+	for fd := 0; fd <= 2; fd++ {
+		if f, ok := std.Get(fd).(*os.File); ok {
+			files[f] = true
+		}
+	}
+	for _, f := range std.Files {
+		files[f] = true
+	}
+	return files
+}
+
+var errCannotReplace = errors.New("cannot replace the shell process")
+
+// replaceProcess replaces the current process with the executable at path,
+// after setting up its file descriptors according to std.  It only returns if
+// it failed.  If the process could not be replaced because some of the
+// streams are not files, errCannotReplace is returned and the process is
+// unaffected.
+func replaceProcess(sh *Shell, std *StdStreams, path string, argv []string, env []string) error {
+	files := map[int]*os.File{}
+	for fd, f := range std.Files {
+		files[fd] = f
+	}
+	for fd := 0; fd <= 2; fd++ {
+		switch stream := std.Get(fd).(type) {
+		case *os.File:
+			files[fd] = stream
+		case nil:
+		default:
+			return errCannotReplace
+		}
+	}
+	if err := os.Chdir(sh.GetCwd()); err != nil {
+		return err
+	}
+	// First move all the files out of the way so that installing one file
+	// descriptor doesn't clobber another one that is yet to be installed.
+	maxFD := 2
+	for fd := range files {
+		if fd > maxFD {
+			maxFD = fd
+		}
+	}
+	tmpFDs := map[int]int{}
+	// The file descriptors that are replaced are saved, so that they can be
+	// restored if the exec fails.  -1 means it was not open.
+	savedFDs := map[int]int{}
+	restore := func() {
+		for fd, saved := range savedFDs {
+			if saved == -1 {
+				unix.Close(fd)
+			} else {
+				unix.Dup2(saved, fd)
+				unix.Close(saved)
+			}
+		}
+		for _, tmp := range tmpFDs {
+			unix.Close(tmp)
+		}
+	}
+	for fd, f := range files {
+		tmp, err := unix.FcntlInt(f.Fd(), unix.F_DUPFD_CLOEXEC, maxFD+1)
+		if err != nil {
+			restore()
+			return err
+		}
+		tmpFDs[fd] = tmp
+	}
+	for fd := 0; fd <= maxFD; fd++ {
+		if _, ok := files[fd]; !ok && fd > 2 {
+			continue
+		}
+		saved, err := unix.FcntlInt(uintptr(fd), unix.F_DUPFD_CLOEXEC, maxFD+1)
+		if err == unix.EBADF {
+			saved = -1
+		} else if err != nil {
+			restore()
+			return err
+		}
+		savedFDs[fd] = saved
+	}
+	for fd := 0; fd <= 2; fd++ {
+		if _, ok := files[fd]; !ok {
+			unix.Close(fd)
+		}
+	}
+	for fd, tmp := range tmpFDs {
+		// Dup2 clears the close-on-exec flag on the new file descriptor.
+		if err := unix.Dup2(tmp, fd); err != nil {
+			restore()
+			return err
+		}
+	}
+	err := syscall.Exec(path, argv, env)
+	// The shell goes on, so it must get its file descriptors back.
+	restore()
+	return err
+}
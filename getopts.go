@@ -0,0 +1,117 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// getoptsState remembers where getopts is within a group of options such as
+// -abc, which OPTIND alone cannot tell.
+type getoptsState struct {
+	optind int // Value of OPTIND when next was set
+	next   int // Index of the next option letter in the current argument, 0 if none
+}
+
+func builtinGetopts(sh *Shell, std *StdStreams, args []string) (RunningJob, error) {
+	if len(args) < 2 {
+		fmt.Fprintln(std.Err, "meshell: getopts: usage: getopts optstring name [arg ...]")
+		return &ImmediateRunningJob{name: "getopts", outcome: JobOutcome{ExitCode: 2}}, nil
+	}
+	optstring, name := args[0], args[1]
+	if !isName(name) {
+		return nil, fmt.Errorf("getopts: `%s': not a valid identifier", name)
+	}
+	params := args[2:]
+	if len(params) == 0 {
+		params = sh.GetArgs()
+	}
+	silent := strings.HasPrefix(optstring, ":")
+	if silent {
+		optstring = optstring[1:]
+	}
+	report := !silent && sh.GetVar("OPTERR") != "0"
+
+	optind, err := strconv.Atoi(sh.GetVar("OPTIND"))
+	if err != nil || optind < 1 {
+		optind = 1
+	}
+	// If OPTIND was changed, e.g. reset to 1 to parse new arguments, start
+	// from the beginning of the argument it points to.
+	st := &sh.getopts
+	if optind != st.optind {
+		st.next = 0
+	}
+	finish := func(opt, optarg string, setOptarg bool, code int) (RunningJob, error) {
+		st.optind = optind
+		if err := sh.SetVar("OPTIND", strconv.Itoa(optind)); err != nil {
+			return nil, err
+		}
+		if err := sh.SetVar(name, opt); err != nil {
+			return nil, err
+		}
+		if setOptarg {
+			if err := sh.SetVar("OPTARG", optarg); err != nil {
+				return nil, err
+			}
+		} else if err := sh.UnsetVar("OPTARG"); err != nil {
+			return nil, err
+		}
+		return &ImmediateRunningJob{name: "getopts", outcome: JobOutcome{ExitCode: code}}, nil
+	}
+
+	if st.next == 0 {
+		if optind > len(params) {
+			return finish("?", "", false, 1)
+		}
+		arg := params[optind-1]
+		if arg == "--" {
+			optind++
+			return finish("?", "", false, 1)
+		}
+		if len(arg) < 2 || arg[0] != '-' {
+			return finish("?", "", false, 1)
+		}
+		st.next = 1
+	}
+	arg := params[optind-1]
+	c := arg[st.next]
+	st.next++
+	if st.next >= len(arg) {
+		optind++
+		st.next = 0
+	}
+	i := strings.IndexByte(optstring, c)
+	if c == ':' || i == -1 {
+		if silent {
+			return finish("?", string(c), true, 0)
+		}
+		if report {
+			fmt.Fprintf(std.Err, "meshell: illegal option -- %c\n", c)
+		}
+		return finish("?", "", false, 0)
+	}
+	if i+1 == len(optstring) || optstring[i+1] != ':' {
+		return finish(string(c), "", false, 0)
+	}
+	// The option takes an argument, either the rest of this argument or the
+	// next one.
+	switch {
+	case st.next > 0:
+		optarg := arg[st.next:]
+		optind++
+		st.next = 0
+		return finish(string(c), optarg, true, 0)
+	case optind <= len(params):
+		optarg := params[optind-1]
+		optind++
+		return finish(string(c), optarg, true, 0)
+	case silent:
+		return finish(":", string(c), true, 0)
+	default:
+		if report {
+			fmt.Fprintf(std.Err, "meshell: option requires an argument -- %c\n", c)
+		}
+		return finish("?", "", false, 0)
+	}
+}
@@ -0,0 +1,406 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// GlobValueDef is a pattern followed by zsh-style glob qualifiers, e.g.
+// `*.log(.Lm+10om[1,5])`.  Qualifiers are only interpreted when the
+// bareglobqual shell option is set, otherwise the whole word is treated as a
+// plain pattern.
+type GlobValueDef struct {
+	Prefix     ValueDef // Expansions before the pattern, e.g. $d in $d/*(/), or nil
+	Pattern    string
+	Qualifiers string
+}
+
+var _ ValueDef = GlobValueDef{}
+
+func (d GlobValueDef) Values(sh *Shell, std *StdStreams) ([]string, error) {
+	if !sh.Shopt("bareglobqual") || sh.Option("noglob") {
+		if d.Prefix != nil {
+			return CompositeValueDef{Parts: []ValueDef{d.Prefix, LiteralValueDef{Val: d.word()}}}.Values(sh, std)
+		}
+		return LiteralValueDef{Val: d.word(), Expand: true}.Values(sh, std)
+	}
+	q, err := parseGlobQualifiers(d.Qualifiers)
+	if err != nil {
+		return nil, err
+	}
+	prefix, err := d.prefix(sh, std)
+	if err != nil {
+		return nil, err
+	}
+	// As in zsh, the value of the prefix is matched literally.
+	pattern := escapeGlob(prefix) + d.Pattern
+	paths, err := globInDir(sh.GetCwd(), pattern)
+	if err != nil {
+		return nil, err
+	}
+	paths, err = q.apply(sh.GetCwd(), pattern, paths)
+	if err != nil {
+		return nil, err
+	}
+	if len(paths) == 0 && !q.nullGlob {
+		return nil, fmt.Errorf("no matches found: %s", prefix+d.word())
+	}
+	return paths, nil
+}
+
+func (d GlobValueDef) Value(sh *Shell, std *StdStreams) (string, error) {
+	prefix, err := d.prefix(sh, std)
+	if err != nil {
+		return "", err
+	}
+	return prefix + d.word(), nil
+}
+
+func (d GlobValueDef) prefix(sh *Shell, std *StdStreams) (string, error) {
+	if d.Prefix == nil {
+		return "", nil
+	}
+	return d.Prefix.Value(sh, std)
+}
+
+func (d GlobValueDef) word() string {
+	return d.Pattern + "(" + d.Qualifiers + ")"
+}
+
+// globInDir expands pattern relative to dir (unless pattern is absolute), so
+// that globbing follows the shell's current directory rather than the
+// process's.  Returned paths are relative if the pattern is.
+func globInDir(dir, pattern string) ([]string, error) {
+	if filepath.IsAbs(pattern) {
+		return filepath.Glob(pattern)
+	}
+	prefix := escapeGlob(dir) + string(filepath.Separator)
+	matches, err := filepath.Glob(prefix + pattern)
+	if err != nil {
+		return nil, err
+	}
+	strip := len(dir) + 1
+	for i, m := range matches {
+		matches[i] = m[strip:]
+	}
+	return matches, nil
+}
+
+func escapeGlob(s string) string {
+	var b strings.Builder
+	for _, r := range s {
+		if strings.ContainsRune(`*?[\`, r) {
+			b.WriteByte('\\')
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
+
+type globFilter func(fi os.FileInfo) bool
+
+type globSortKey struct {
+	key     byte
+	reverse bool
+}
+
+type globQualifiers struct {
+	alternatives [][]globFilter // Each alternative is a conjunction of filters
+	sortKeys     []globSortKey
+	nullGlob     bool
+	dotGlob      bool
+	hasSlice     bool
+	sliceStart   int
+	sliceEnd     int
+}
+
+var errBadGlobQualifier = errors.New("bad glob qualifier")
+
+var globSizeUnits = map[byte]int64{
+	'k': 1 << 10, 'K': 1 << 10,
+	'm': 1 << 20, 'M': 1 << 20,
+	'g': 1 << 30, 'G': 1 << 30,
+	'p': 512, 'P': 512,
+}
+
+var globTimeUnits = map[byte]time.Duration{
+	'M': 30 * 24 * time.Hour,
+	'w': 7 * 24 * time.Hour,
+	'd': 24 * time.Hour,
+	'h': time.Hour,
+	'm': time.Minute,
+	's': time.Second,
+}
+
+// parseGlobQualifiers understands the following subset of zsh qualifiers:
+//
+//	/ . @ = p %       directories, regular files, symlinks, sockets, fifos, devices
+//	*                 executable regular files
+//	r w x             readable, writable, executable by the owner
+//	R W X             readable, writable, executable by others
+//	L[kmpg][+-]n      size (in bytes or the given unit)
+//	m a c[Mwhms][+-]n modification, access, change time (in days or the given unit)
+//	^                 negate the following qualifiers
+//	,                 separate alternatives
+//	o O[nLmac]        sort by name, size or time (O reverses)
+//	N D               null glob, include dot files
+//	[n] [n,m]         select a slice of the matches
+func parseGlobQualifiers(s string) (*globQualifiers, error) {
+	q := &globQualifiers{}
+	var (
+		filters []globFilter
+		negate  bool
+	)
+	addFilter := func(f globFilter) {
+		if negate {
+			g := f
+			f = func(fi os.FileInfo) bool { return !g(fi) }
+		}
+		filters = append(filters, f)
+	}
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch c {
+		case '/':
+			addFilter(func(fi os.FileInfo) bool { return fi.IsDir() })
+		case '.':
+			addFilter(func(fi os.FileInfo) bool { return fi.Mode().IsRegular() })
+		case '@':
+			addFilter(modeTypeFilter(os.ModeSymlink))
+		case '=':
+			addFilter(modeTypeFilter(os.ModeSocket))
+		case 'p':
+			addFilter(modeTypeFilter(os.ModeNamedPipe))
+		case '%':
+			addFilter(modeTypeFilter(os.ModeDevice))
+		case '*':
+			addFilter(func(fi os.FileInfo) bool { return fi.Mode().IsRegular() && fi.Mode()&0111 != 0 })
+		case 'r', 'w', 'x', 'R', 'W', 'X':
+			addFilter(permFilter(c))
+		case '^':
+			negate = !negate
+		case ',':
+			q.alternatives = append(q.alternatives, filters)
+			filters = nil
+			negate = false
+		case 'N':
+			q.nullGlob = true
+		case 'D':
+			q.dotGlob = true
+		case 'L':
+			unit := int64(1)
+			if i+1 < len(s) && globSizeUnits[s[i+1]] != 0 {
+				i++
+				unit = globSizeUnits[s[i]]
+			}
+			cmp, n, next, err := parseGlobQualNum(s, i+1)
+			if err != nil {
+				return nil, err
+			}
+			i = next - 1
+			addFilter(func(fi os.FileInfo) bool {
+				return cmpGlobQual(cmp, (fi.Size()+unit-1)/unit, n)
+			})
+		case 'm', 'a', 'c':
+			which := c
+			unit := 24 * time.Hour
+			if i+1 < len(s) && globTimeUnits[s[i+1]] != 0 {
+				i++
+				unit = globTimeUnits[s[i]]
+			}
+			cmp, n, next, err := parseGlobQualNum(s, i+1)
+			if err != nil {
+				return nil, err
+			}
+			i = next - 1
+			now := time.Now()
+			addFilter(func(fi os.FileInfo) bool {
+				age := now.Sub(fileTime(fi, which))
+				return cmpGlobQual(cmp, int64(age/unit), n)
+			})
+		case 'o', 'O':
+			if i+1 >= len(s) || strings.IndexByte("nLmac", s[i+1]) == -1 {
+				return nil, errBadGlobQualifier
+			}
+			i++
+			q.sortKeys = append(q.sortKeys, globSortKey{key: s[i], reverse: c == 'O'})
+		case '[':
+			end := strings.IndexByte(s[i:], ']')
+			if end == -1 {
+				return nil, errBadGlobQualifier
+			}
+			bounds := strings.SplitN(s[i+1:i+end], ",", 2)
+			start, err := strconv.Atoi(bounds[0])
+			if err != nil {
+				return nil, errBadGlobQualifier
+			}
+			stop := start
+			if len(bounds) == 2 {
+				stop, err = strconv.Atoi(bounds[1])
+				if err != nil {
+					return nil, errBadGlobQualifier
+				}
+			}
+			q.hasSlice = true
+			q.sliceStart, q.sliceEnd = start, stop
+			i += end
+		default:
+			return nil, fmt.Errorf("%w: %q", errBadGlobQualifier, c)
+		}
+	}
+	q.alternatives = append(q.alternatives, filters)
+	return q, nil
+}
+
+// parseGlobQualNum parses an optional sign followed by a number starting at
+// position i in s.  It returns the sign ('+', '-' or 0), the number and the
+// position after the number.
+func parseGlobQualNum(s string, i int) (byte, int64, int, error) {
+	var cmp byte
+	if i < len(s) && (s[i] == '+' || s[i] == '-') {
+		cmp = s[i]
+		i++
+	}
+	j := i
+	for j < len(s) && s[j] >= '0' && s[j] <= '9' {
+		j++
+	}
+	if j == i {
+		return 0, 0, 0, errBadGlobQualifier
+	}
+	n, err := strconv.ParseInt(s[i:j], 10, 64)
+	if err != nil {
+		return 0, 0, 0, errBadGlobQualifier
+	}
+	return cmp, n, j, nil
+}
+
+func cmpGlobQual(cmp byte, x, n int64) bool {
+	switch cmp {
+	case '+':
+		return x > n
+	case '-':
+		return x < n
+	default:
+		return x == n
+	}
+}
+
+func modeTypeFilter(t os.FileMode) globFilter {
+	return func(fi os.FileInfo) bool {
+		return fi.Mode()&t != 0
+	}
+}
+
+func permFilter(c byte) globFilter {
+	var mask os.FileMode
+	switch c {
+	case 'r':
+		mask = 0400
+	case 'w':
+		mask = 0200
+	case 'x':
+		mask = 0100
+	case 'R':
+		mask = 0004
+	case 'W':
+		mask = 0002
+	case 'X':
+		mask = 0001
+	}
+	return func(fi os.FileInfo) bool {
+		return fi.Mode().Perm()&mask != 0
+	}
+}
+
+func (q *globQualifiers) apply(dir, pattern string, paths []string) ([]string, error) {
+	// filepath.Glob lets wildcards match a leading dot, zsh doesn't unless
+	// the D qualifier is given.
+	hideDots := !q.dotGlob && !strings.HasPrefix(filepath.Base(pattern), ".")
+	type match struct {
+		path string
+		info os.FileInfo
+	}
+	var matches []match
+	for _, p := range paths {
+		if hideDots && strings.HasPrefix(filepath.Base(p), ".") {
+			continue
+		}
+		fp := p
+		if !filepath.IsAbs(fp) {
+			fp = filepath.Join(dir, fp)
+		}
+		fi, err := os.Lstat(fp)
+		if err != nil {
+			continue
+		}
+		if q.matches(fi) {
+			matches = append(matches, match{path: p, info: fi})
+		}
+	}
+	for i := len(q.sortKeys) - 1; i >= 0; i-- {
+		k := q.sortKeys[i]
+		sort.SliceStable(matches, func(i, j int) bool {
+			a, b := matches[i], matches[j]
+			if k.reverse {
+				a, b = b, a
+			}
+			switch k.key {
+			case 'n':
+				return a.path < b.path
+			case 'L':
+				return a.info.Size() < b.info.Size()
+			default:
+				// Like zsh, the most recent file comes first
+				return fileTime(a.info, k.key).After(fileTime(b.info, k.key))
+			}
+		})
+	}
+	if q.hasSlice {
+		start, end := q.sliceStart, q.sliceEnd
+		if start < 0 {
+			start += len(matches) + 1
+		}
+		if end < 0 {
+			end += len(matches) + 1
+		}
+		if start < 1 {
+			start = 1
+		}
+		if end > len(matches) {
+			end = len(matches)
+		}
+		if start > end {
+			matches = nil
+		} else {
+			matches = matches[start-1 : end]
+		}
+	}
+	res := make([]string, len(matches))
+	for i, m := range matches {
+		res[i] = m.path
+	}
+	return res, nil
+}
+
+func (q *globQualifiers) matches(fi os.FileInfo) bool {
+	for _, filters := range q.alternatives {
+		ok := true
+		for _, f := range filters {
+			if !f(fi) {
+				ok = false
+				break
+			}
+		}
+		if ok {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseGlobQualifiers(t *testing.T) {
+	dir := t.TempDir()
+	now := time.Now()
+	files := []struct {
+		name string
+		size int
+		perm os.FileMode
+		age  time.Duration
+	}{
+		{"a.txt", 10, 0644, 72 * time.Hour},
+		{"b.sh", 2000, 0755, time.Hour},
+		{".hidden", 0, 0644, 0},
+	}
+	for _, f := range files {
+		path := filepath.Join(dir, f.name)
+		if err := os.WriteFile(path, []byte(strings.Repeat("x", f.size)), f.perm); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chmod(path, f.perm); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chtimes(path, now.Add(-f.age), now.Add(-f.age)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.Mkdir(filepath.Join(dir, "dir"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink("a.txt", filepath.Join(dir, "link")); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		qualifiers string
+		want       []string
+	}{
+		{"", []string{"a.txt", "b.sh", "dir", "link"}},
+		{".", []string{"a.txt", "b.sh"}},
+		{"/", []string{"dir"}},
+		{"@", []string{"link"}},
+		{"*", []string{"b.sh"}},
+		{"^/", []string{"a.txt", "b.sh", "link"}},
+		// A second ^ ends the negation, as in zsh
+		{"^/^@", []string{"link"}},
+		{"/,@", []string{"dir", "link"}},
+		{".D", []string{".hidden", "a.txt", "b.sh"}},
+		{"L10", []string{"a.txt"}},
+		{".Lk+1", []string{"b.sh"}},
+		{".m+1", []string{"a.txt"}},
+		{".mh-2", []string{"b.sh"}},
+		{".oL", []string{"a.txt", "b.sh"}},
+		{".OL", []string{"b.sh", "a.txt"}},
+		{".om", []string{"b.sh", "a.txt"}},
+		{"On", []string{"link", "dir", "b.sh", "a.txt"}},
+		{"[1]", []string{"a.txt"}},
+		{"[-1]", []string{"link"}},
+		{"[2,3]", []string{"b.sh", "dir"}},
+		{"On[1,2]", []string{"link", "dir"}},
+		{"/.", []string{}},
+	}
+	paths, err := globInDir(dir, "*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, test := range tests {
+		q, err := parseGlobQualifiers(test.qualifiers)
+		if err != nil {
+			t.Errorf("parseGlobQualifiers(%q): unexpected error: %s", test.qualifiers, err)
+			continue
+		}
+		got, err := q.apply(dir, "*", paths)
+		if err != nil {
+			t.Errorf("qualifiers %q: unexpected error: %s", test.qualifiers, err)
+		} else if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("qualifiers %q: got %q, want %q", test.qualifiers, got, test.want)
+		}
+	}
+}
+
+func TestParseGlobQualifierFlags(t *testing.T) {
+	q, err := parseGlobQualifiers("ND")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !q.nullGlob || !q.dotGlob {
+		t.Errorf("ND: nullGlob=%t dotGlob=%t, want both set", q.nullGlob, q.dotGlob)
+	}
+}
+
+func TestParseGlobQualifiersErrors(t *testing.T) {
+	for _, s := range []string{"q", "L", "Lk", "L+", "m+", "o", "oz", "[", "[a]", "[1,b]"} {
+		if _, err := parseGlobQualifiers(s); err == nil {
+			t.Errorf("parseGlobQualifiers(%q): want an error", s)
+		}
+	}
+}
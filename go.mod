@@ -5,10 +5,10 @@ go 1.17
 require (
 	github.com/arnodel/grammar v0.1.0
 	github.com/peterh/liner v1.2.2
+	golang.org/x/sys v0.27.0
 )
 
 require (
 	github.com/mattn/go-runewidth v0.0.16 // indirect
 	github.com/rivo/uniseg v0.4.7 // indirect
-	golang.org/x/sys v0.27.0 // indirect
 )
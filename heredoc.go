@@ -0,0 +1,265 @@
+package main
+
+import (
+	"regexp"
+	"strings"
+
+	"github.com/arnodel/grammar"
+)
+
+// hereDoc is the body of a here-document (`cat <<EOF`).
+type hereDoc struct {
+	body   string
+	quoted bool // If any part of the delimiter is quoted, the body is not expanded
+}
+
+// hereDocOp is a here-document operator waiting for its body.
+type hereDocOp struct {
+	delim  string
+	strip  bool // True for <<-, which strips leading tabs
+	quoted bool
+}
+
+// scanSource finds out what the tokeniser cannot work out on its own.  It
+// returns src with the bodies of here-documents removed, the bodies in the
+// order of their operators, and what src is waiting for if it is incomplete:
+// "quote", "dquote", "heredoc" or "cont" (a line continuation).  It returns an
+// empty string if src is complete as far as it can tell.
+func scanSource(src string) (string, []hereDoc, string) {
+	var (
+		out       strings.Builder
+		docs      []hereDoc
+		pending   []hereDocOp
+		wordStart = true
+	)
+	for i := 0; i < len(src); {
+		c := src[i]
+		switch {
+		case c == '\\':
+			if src[i:] == "\\\n" {
+				out.WriteString(src[i:])
+				return out.String(), docs, "cont"
+			}
+			end := i + 2
+			if end > len(src) {
+				end = len(src)
+			}
+			out.WriteString(src[i:end])
+			i = end
+			wordStart = false
+			continue
+		case c == '\'':
+			j := strings.IndexByte(src[i+1:], '\'')
+			if j == -1 {
+				out.WriteString(src[i:])
+				return out.String(), docs, "quote"
+			}
+			out.WriteString(src[i : i+j+2])
+			i += j + 2
+			wordStart = false
+			continue
+		case c == '"':
+			j := i + 1
+			for ; j < len(src) && src[j] != '"'; j++ {
+				if src[j] == '\\' {
+					j++
+				}
+			}
+			if j >= len(src) {
+				out.WriteString(src[i:])
+				return out.String(), docs, "dquote"
+			}
+			out.WriteString(src[i : j+1])
+			i = j + 1
+			wordStart = false
+			continue
+		case c == '#' && wordStart:
+			j := strings.IndexByte(src[i:], '\n')
+			if j == -1 {
+				j = len(src) - i
+			}
+			out.WriteString(src[i : i+j])
+			i += j
+			continue
+		case strings.HasPrefix(src[i:], "<<"):
+			op, end := scanHereDocOp(src, i+2)
+			pending = append(pending, op)
+			out.WriteString(src[i:end])
+			i = end
+			wordStart = true
+			continue
+		case c == '\n':
+			out.WriteByte(c)
+			i++
+			for _, op := range pending {
+				body, n, ok := readHereDocBody(src[i:], op)
+				docs = append(docs, hereDoc{body: body, quoted: op.quoted})
+				i += n
+				if !ok {
+					return out.String(), docs, "heredoc"
+				}
+			}
+			pending = nil
+			wordStart = true
+			continue
+		}
+		wordStart = strings.IndexByte(" \t;&|()", c) != -1
+		out.WriteByte(c)
+		i++
+	}
+	if len(pending) > 0 {
+		for _, op := range pending {
+			docs = append(docs, hereDoc{quoted: op.quoted})
+		}
+		return out.String(), docs, "heredoc"
+	}
+	return out.String(), docs, ""
+}
+
+// scanHereDocOp reads the delimiter of a here-document operator, starting just
+// after the "<<".  It returns the operator and the position after it.
+func scanHereDocOp(src string, i int) (hereDocOp, int) {
+	var (
+		op    hereDocOp
+		delim strings.Builder
+	)
+	if i < len(src) && src[i] == '-' {
+		op.strip = true
+		i++
+	}
+	for i < len(src) && (src[i] == ' ' || src[i] == '\t') {
+		i++
+	}
+	for i < len(src) && strings.IndexByte(" \t\n;&|()<>", src[i]) == -1 {
+		switch c := src[i]; c {
+		case '\\':
+			op.quoted = true
+			if i+1 < len(src) {
+				delim.WriteByte(src[i+1])
+			}
+			i += 2
+		case '\'', '"':
+			op.quoted = true
+			j := strings.IndexByte(src[i+1:], c)
+			if j == -1 {
+				j = len(src) - i - 1
+			}
+			delim.WriteString(src[i+1 : i+1+j])
+			i += j + 2
+		default:
+			delim.WriteByte(c)
+			i++
+		}
+	}
+	if i > len(src) {
+		i = len(src)
+	}
+	op.delim = delim.String()
+	return op, i
+}
+
+// readHereDocBody reads the lines of src until the delimiter of op.  It
+// returns the body, the number of bytes consumed and false if the delimiter
+// was not found.
+func readHereDocBody(src string, op hereDocOp) (string, int, bool) {
+	var body strings.Builder
+	n := 0
+	for n < len(src) {
+		end := strings.IndexByte(src[n:], '\n') + 1
+		if end == 0 {
+			end = len(src) - n
+		}
+		line := src[n : n+end]
+		n += end
+		if op.strip {
+			line = strings.TrimLeft(line, "\t")
+		}
+		if strings.TrimSuffix(line, "\n") == op.delim {
+			return body.String(), n, true
+		}
+		body.WriteString(line)
+	}
+	return body.String(), n, false
+}
+
+// tokeniseHereDoc splits the body of a here-document whose delimiter is not
+// quoted into text and expansions.
+var tokeniseHereDoc = grammar.SimpleTokeniser(append([]grammar.TokenDef{
+	{
+		Mode: "doc",
+		Name: "envvar",
+		Ptn:  `\$[a-zA-Z_][a-zA-Z0-9_]*`,
+	},
+	{
+		Mode: "doc",
+		Name: "specialvar",
+		Ptn:  `\$(?:[0-9]|[?#@$!-])`,
+	},
+	{
+		Mode:     "doc",
+		Name:     "dollarbkt",
+		Ptn:      `\$\(\s*`,
+		PushMode: "cmd",
+	},
+	{
+		Mode:     "doc",
+		Name:     "dollarbrace",
+		Ptn:      `\$\{`,
+		PushMode: "param",
+	},
+	{
+		Mode: "doc",
+		Name: "doclit",
+		Ptn:  `(?:[^\\$]|\\(?s:.))+|[\\$]`,
+	},
+}, commandTokenDefs...))
+
+// HereDocBody is the body of a here-document whose delimiter is not quoted.
+type HereDocBody struct {
+	grammar.Seq
+	Chunks []HereDocChunk
+	EOF    Token `tok:"EOF"`
+}
+
+type HereDocChunk struct {
+	grammar.OneOf
+	Lit   *Token `tok:"doclit"`
+	Chunk *StringChunk
+}
+
+func parseHereDoc(body string) (ValueDef, error) {
+	stream, err := tokeniseHereDoc(body)
+	if err != nil {
+		return nil, err
+	}
+	toks, _, err := (&wordPass{}).run(drainTokens(stream), lexState{}, nil)
+	if err != nil {
+		return nil, err
+	}
+	var doc HereDocBody
+	if parseErr := grammar.Parse(&doc, grammar.NewSimpleTokenStream(toks)); parseErr != nil {
+		return nil, parseErr
+	}
+	parts := make([]ValueDef, len(doc.Chunks))
+	for i, c := range doc.Chunks {
+		if c.Lit != nil {
+			parts[i] = LiteralValueDef{Val: hereDocEscapeSeqs.ReplaceAllStringFunc(c.Lit.Value(), replaceHereDocEscapeSeq)}
+			continue
+		}
+		parts[i], err = c.Chunk.Eval(true)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return CompositeValueDef{Parts: parts}, nil
+}
+
+// In a here-document, backslash only escapes $, `, \ and newline.
+var hereDocEscapeSeqs = regexp.MustCompile("\\\\[$`\\\\\n]")
+
+func replaceHereDocEscapeSeq(e string) string {
+	if e[1] == '\n' {
+		return ""
+	}
+	return e[1:]
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/arnodel/grammar"
+)
+
+// A SyntaxError is returned by parseInput when the input cannot be parsed.
+type SyntaxError struct {
+	Err error
+}
+
+func (e *SyntaxError) Error() string {
+	return fmt.Sprintf("syntax error: %s", e.Err)
+}
+
+func (e *SyntaxError) Unwrap() error {
+	return e.Err
+}
+
+// An IncompleteInputError is returned by parseInput when the input is the
+// beginning of a valid command and more lines are needed to complete it.
+type IncompleteInputError struct {
+	// The constructs that are still open, outermost first, using the same
+	// names as zsh (e.g. "if", "then", "dquote", "heredoc", "pipe").
+	Waiting []string
+}
+
+func (e *IncompleteInputError) Error() string {
+	return fmt.Sprintf("unexpected end of input (waiting for %s)", strings.Join(e.Waiting, " "))
+}
+
+// parseInput parses src.  If src is incomplete it returns an
+// *IncompleteInputError that says what it is waiting for, if it is invalid it
+// returns a *SyntaxError.
+func parseInput(sh *Shell, src string, debug bool, parseOpts []grammar.ParseOption) (*Line, error) {
+	_, _, pending := scanSource(src)
+	if pending != "" {
+		// An unterminated double quoted string can be tokenised as it
+		// is, which also tells what is open inside it, e.g. a command
+		// substitution.  Otherwise close what is pending to find out
+		// what else is open.
+		if tokenStream, err := tokenise(sh, src); err == nil {
+			if waiting := openConstructs(drainTokens(tokenStream)); containsString(waiting, pending) {
+				return nil, &IncompleteInputError{Waiting: waiting}
+			}
+		}
+		var waiting []string
+		if tokenStream, err := tokenise(sh, src+pendingClosers[pending]); err == nil {
+			waiting = openConstructs(drainTokens(tokenStream))
+		}
+		return nil, &IncompleteInputError{Waiting: append(waiting, pending)}
+	}
+	tokenStream, err := tokenise(sh, src)
+	if err != nil {
+		return nil, &SyntaxError{Err: err}
+	}
+	toks := drainTokens(tokenStream)
+	tokenStream = grammar.NewSimpleTokenStream(toks)
+	var line Line
+	parseErr := grammar.Parse(&line, tokenStream, parseOpts...)
+	if debug {
+		tokenStream.Dump(os.Stdout)
+	}
+	if parseErr != nil {
+		if parseErr.Token == grammar.EOF {
+			return nil, &IncompleteInputError{Waiting: openConstructs(toks)}
+		}
+		return nil, &SyntaxError{Err: parseErr}
+	}
+	return &line, nil
+}
+
+var pendingClosers = map[string]string{
+	"quote":   "'",
+	"dquote":  `"`,
+	"cont":    "\n",
+	"heredoc": "",
+}
+
+// openConstructs returns the constructs left open at the end of toks.
+func openConstructs(toks []grammar.Token) []string {
+	var open []string
+	pop := func() {
+		if n := len(open); n > 0 {
+			open = open[:n-1]
+		}
+	}
+	replace := func(name string) {
+		pop()
+		open = append(open, name)
+	}
+	for _, tok := range toks {
+		switch tok.Type() {
+		case "kw":
+			switch tok.Value() {
+			case "if", "while":
+				open = append(open, tok.Value())
+			case "then", "elif", "else", "do":
+				replace(tok.Value())
+			case "fi", "done":
+				pop()
+			}
+		case "openbrace":
+			open = append(open, "cursh")
+		case "openbkt":
+			open = append(open, "subsh")
+		case "dollarbkt":
+			open = append(open, "cmdsubst")
+		case "dollarbrace":
+			open = append(open, "braceparam")
+		case "startquote":
+			open = append(open, "dquote")
+		case "closebrace", "closebkt", "endquote":
+			pop()
+		}
+	}
+	if n := len(toks); n > 0 {
+		switch last := toks[n-1]; {
+		case last.Type() == "pipe":
+			open = append(open, "pipe")
+		case last.Type() == "logical" && strings.HasPrefix(last.Value(), "&&"):
+			open = append(open, "cmdand")
+		case last.Type() == "logical":
+			open = append(open, "cmdor")
+		}
+	}
+	return open
+}
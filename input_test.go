@@ -0,0 +1,73 @@
+package main
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+)
+
+func TestParseInputIncomplete(t *testing.T) {
+	tests := []struct {
+		src     string
+		waiting []string
+	}{
+		{"if true", []string{"if"}},
+		{"if true; then", []string{"then"}},
+		{"if x; then y; elif z", []string{"elif"}},
+		{"if true; then echo; else", []string{"else"}},
+		{"while true; do", []string{"do"}},
+		{"while true; do if x; then", []string{"do", "then"}},
+		{"{ echo", []string{"cursh"}},
+		{"( echo", []string{"subsh"}},
+		{"x=(1 2", []string{"subsh"}},
+		{"echo $(ls", []string{"cmdsubst"}},
+		{"echo ${a", []string{"braceparam"}},
+		{"echo 'abc", []string{"quote"}},
+		{"echo \"abc", []string{"dquote"}},
+		{"echo \"a\nb", []string{"dquote"}},
+		{"echo \"$(ls", []string{"dquote", "cmdsubst"}},
+		{"if true; then echo \"$(echo ${a", []string{"then", "dquote", "cmdsubst", "braceparam"}},
+		{"if true; then echo 'a", []string{"then", "quote"}},
+		{"echo a \\\n", []string{"cont"}},
+		{"cat <<EOF\nabc", []string{"heredoc"}},
+		{"echo a |", []string{"pipe"}},
+		{"echo a &&", []string{"cmdand"}},
+		{"echo a ||", []string{"cmdor"}},
+		{"{ echo a ||", []string{"cursh", "cmdor"}},
+	}
+	for _, test := range tests {
+		sh := NewShell("meshell", nil, t.TempDir())
+		_, err := parseInput(sh, test.src, false, nil)
+		var incomplete *IncompleteInputError
+		if !errors.As(err, &incomplete) {
+			t.Errorf("%q: got error %v, want incomplete input", test.src, err)
+		} else if !reflect.DeepEqual(incomplete.Waiting, test.waiting) {
+			t.Errorf("%q: waiting for %q, want %q", test.src, incomplete.Waiting, test.waiting)
+		}
+	}
+}
+
+func TestParseInputComplete(t *testing.T) {
+	for _, src := range []string{
+		"echo a",
+		"if true; then echo; fi",
+		"cat <<EOF\nabc\nEOF",
+		"echo \"$(ls)\" 'a\nb'",
+	} {
+		sh := NewShell("meshell", nil, t.TempDir())
+		if _, err := parseInput(sh, src, false, nil); err != nil {
+			t.Errorf("%q: unexpected error: %s", src, err)
+		}
+	}
+}
+
+func TestParseInputSyntaxError(t *testing.T) {
+	for _, src := range []string{"fi", "done", "echo )", "if true; fi"} {
+		sh := NewShell("meshell", nil, t.TempDir())
+		_, err := parseInput(sh, src, false, nil)
+		var syntaxErr *SyntaxError
+		if !errors.As(err, &syntaxErr) {
+			t.Errorf("%q: got error %v, want a syntax error", src, err)
+		}
+	}
+}
@@ -0,0 +1,224 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"os/signal"
+	"sync"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// The terminal used for job control is the shell's standard input.
+const ttyFd = 0
+
+// A processGroup is the process group of a job when job control is on.  The
+// processes of the job are started in it, and it can be stopped and continued
+// as a whole.
+//
+// Processes are put in the group as they are started, so a group with no
+// running process gets a new pgid with the next one.  That is how each command
+// of e.g. "sleep 1; sleep 2" gets its own group, like separate jobs in bash.
+type processGroup struct {
+	mutex      sync.Mutex
+	pgid       int
+	running    int  // Number of processes in the group still running
+	foreground bool // The group should own the terminal
+	tty        bool // There is a terminal to hand over
+	stopped    bool
+	stopCh     chan struct{} // Receives when a process in the group stops
+}
+
+// JobControl returns true if jobs should run in their own process groups.
+func (s *Shell) JobControl() bool {
+	return s.options["monitor"] && !s.subshell
+}
+
+func (s *Shell) newProcessGroup(foreground bool) *processGroup {
+	return &processGroup{
+		foreground: foreground,
+		tty:        isTerminal(ttyFd),
+		stopCh:     make(chan struct{}, 1),
+	}
+}
+
+// startProcess starts cmd, in the process group of the current job if job
+// control is on.  It returns that group.
+func (s *Shell) startProcess(cmd *exec.Cmd) (*processGroup, error) {
+	if err := s.prepareChild(cmd); err != nil {
+		return nil, err
+	}
+	g := s.group
+	if g == nil {
+		return nil, cmd.Start()
+	}
+	return g, g.start(cmd)
+}
+
+func (g *processGroup) start(cmd *exec.Cmd) error {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	attr := &syscall.SysProcAttr{Setpgid: true, Pgid: g.pgid}
+	if g.foreground && g.tty {
+		// The child takes the terminal itself, so that it does not get
+		// SIGTTIN if it reads from it before the shell could give it.
+		attr.Foreground = true
+		attr.Ctty = ttyFd
+	}
+	cmd.SysProcAttr = attr
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+	if g.pgid == 0 {
+		g.pgid = cmd.Process.Pid
+	}
+	g.running++
+	return nil
+}
+
+// exited is called when a process in the group has finished.
+func (g *processGroup) exited() {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	g.running--
+	if g.running > 0 {
+		return
+	}
+	g.pgid = 0
+	if g.foreground && g.tty {
+		claimTerminal()
+	}
+}
+
+func (g *processGroup) setStopped() {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	g.stopped = true
+	select {
+	case g.stopCh <- struct{}{}:
+	default:
+	}
+}
+
+// Stopped returns true if the processes in the group are stopped.
+func (g *processGroup) Stopped() bool {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	return g.stopped
+}
+
+// Signal sends sig to all the processes in the group.  It returns false if
+// there are none.
+func (g *processGroup) Signal(sig os.Signal) bool {
+	g.mutex.Lock()
+	pgid := g.pgid
+	g.mutex.Unlock()
+	if pgid == 0 {
+		return false
+	}
+	unix.Kill(-pgid, sig.(syscall.Signal))
+	return true
+}
+
+// Continue makes the group run again, in the foreground or in the
+// background.
+func (g *processGroup) Continue(foreground bool) {
+	g.mutex.Lock()
+	g.foreground = foreground
+	if foreground && g.tty && g.pgid != 0 {
+		setTerminalGroup(g.pgid)
+	}
+	g.stopped = false
+	select {
+	case <-g.stopCh:
+	default:
+	}
+	g.mutex.Unlock()
+	g.Signal(syscall.SIGCONT)
+}
+
+// moveToBackground is called when the shell stops waiting for a stopped
+// foreground job.
+func (g *processGroup) moveToBackground() {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	g.foreground = false
+}
+
+// waitStoppable waits for the process of an ExecJob started in a process
+// group.  Unlike exec.Cmd.Wait, it notices when the process is stopped.
+func (j *ExecJob) waitStoppable() JobOutcome {
+	defer j.group.exited()
+	pid := j.cmd.Process.Pid
+	var ws unix.WaitStatus
+	for {
+		_, err := unix.Wait4(pid, &ws, unix.WUNTRACED, nil)
+		if err == unix.EINTR {
+			continue
+		}
+		if err != nil {
+			return errorOutcome(err)
+		}
+		if !ws.Stopped() {
+			break
+		}
+		j.group.setStopped()
+	}
+	// The process has been reaped already so this fails, but it releases
+	// the resources of the command.
+	j.cmd.Wait()
+	if ws.Signaled() {
+		return JobOutcome{ExitCode: 128 + int(ws.Signal())}
+	}
+	return JobOutcome{ExitCode: ws.ExitStatus()}
+}
+
+// waitForeground waits for a job running in the foreground.  If the job is
+// stopped, it is added to the job table and the wait ends.
+func (s *Shell) waitForeground(job RunningJob, g *processGroup, std *StdStreams) JobOutcome {
+	if g == nil {
+		return job.Wait()
+	}
+	outcome := make(chan JobOutcome, 1)
+	go func() {
+		outcome <- job.Wait()
+	}()
+	select {
+	case res := <-outcome:
+		return res
+	case <-g.stopCh:
+		g.moveToBackground()
+		j := s.addJob(job, job.String(), g, outcome)
+		// Start a new line after the ^Z echoed by the terminal
+		fmt.Fprintln(std.Err)
+		s.printJob(std.Err, j, false)
+		return stoppedOutcome
+	}
+}
+
+// stoppedOutcome is the outcome of a foreground job when it is stopped, as in
+// bash.
+var stoppedOutcome = JobOutcome{ExitCode: 128 + int(syscall.SIGTSTP)}
+
+// claimTerminal makes the shell's process group the foreground one on the
+// terminal again.
+func claimTerminal() {
+	setTerminalGroup(unix.Getpgrp())
+}
+
+func setTerminalGroup(pgid int) {
+	// The shell gets SIGTTOU if it is not in the foreground group, which
+	// would stop it.
+	signal.Ignore(syscall.SIGTTOU)
+	defer signal.Reset(syscall.SIGTTOU)
+	unix.IoctlSetPointerInt(ttyFd, unix.TIOCSPGRP, pgid)
+}
+
+// ignoreStopSignals keeps an interactive shell from being stopped from the
+// terminal.  The signals are caught rather than ignored, so that commands
+// started by the shell still get the default behaviour.
+func ignoreStopSignals() {
+	signal.Notify(make(chan os.Signal, 1), syscall.SIGTSTP, syscall.SIGTTIN)
+}
@@ -0,0 +1,654 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// A Job is an entry in the shell's job table, i.e. a job running
+// asynchronously that the shell can wait for.
+type Job struct {
+	ID      int
+	Pid     int
+	Name    string
+	job     RunningJob
+	group   *processGroup // Set if the job was started with job control
+	done    chan struct{}
+	outcome JobOutcome
+}
+
+// Wait waits for the job to finish and returns its outcome.
+func (j *Job) Wait() JobOutcome {
+	<-j.done
+	return j.outcome
+}
+
+// Done returns true if the job has finished.
+func (j *Job) Done() bool {
+	select {
+	case <-j.done:
+		return true
+	default:
+		return false
+	}
+}
+
+// Signal sends sig to the job, i.e. to its process group if it has one.
+func (j *Job) Signal(sig os.Signal) {
+	if j.group == nil || !j.group.Signal(sig) {
+		j.job.Signal(sig)
+	} else if sj, ok := j.job.(*SubshellJob); ok {
+		// The subshell running the job is not in the process group
+		sj.subshell.signal(sig)
+	}
+}
+
+// Stopped returns true if the job has been stopped, e.g. with Ctrl-Z.
+func (j *Job) Stopped() bool {
+	return j.group != nil && !j.Done() && j.group.Stopped()
+}
+
+// State describes the state of the job as the jobs builtin reports it.
+func (j *Job) State() string {
+	if j.Stopped() {
+		return "Stopped"
+	}
+	if !j.Done() {
+		return "Running"
+	}
+	if code := j.outcome.ExitCode; code != 0 {
+		return fmt.Sprintf("Exit %d", code)
+	}
+	return "Done"
+}
+
+// Jobs that do not have a process of their own (e.g. shell functions) are
+// given a virtual pid.  Linux pids never go above 2^22, so these can never be
+// confused with real pids.
+const firstVirtualPid = 1<<22 + 1
+
+type jobTable struct {
+	mutex          sync.Mutex
+	jobs           []*Job // Most recent last, the last two are %+ and %-
+	nextVirtualPid int
+}
+
+// AddJob adds a running job to the job table.
+func (s *Shell) AddJob(job RunningJob, name string) *Job {
+	return s.addJob(job, name, nil, nil)
+}
+
+// addJob adds a job to the job table.  If outcome is not nil, the job is
+// already being waited for and its outcome will be sent to it.
+func (s *Shell) addJob(job RunningJob, name string, group *processGroup, outcome <-chan JobOutcome) *Job {
+	t := &s.jobs
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	pid, ok := jobPid(job)
+	if !ok {
+		if t.nextVirtualPid == 0 {
+			t.nextVirtualPid = firstVirtualPid
+		}
+		pid = t.nextVirtualPid
+		t.nextVirtualPid++
+	}
+	id := 1
+	for _, j := range t.jobs {
+		if j.ID >= id {
+			id = j.ID + 1
+		}
+	}
+	j := &Job{
+		ID:    id,
+		Pid:   pid,
+		Name:  name,
+		job:   job,
+		group: group,
+		done:  make(chan struct{}),
+	}
+	t.jobs = append(t.jobs, j)
+	go func() {
+		if outcome != nil {
+			j.outcome = <-outcome
+		} else {
+			j.outcome = job.Wait()
+		}
+		close(j.done)
+	}()
+	return j
+}
+
+// makeCurrent makes job the current job, %+.
+func (s *Shell) makeCurrent(job *Job) {
+	t := &s.jobs
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	for i, j := range t.jobs {
+		if j == job {
+			t.jobs = append(append(t.jobs[:i], t.jobs[i+1:]...), job)
+			return
+		}
+	}
+}
+
+// RemoveJob removes a job from the job table.
+func (s *Shell) RemoveJob(job *Job) {
+	t := &s.jobs
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	for i, j := range t.jobs {
+		if j == job {
+			t.jobs = append(t.jobs[:i], t.jobs[i+1:]...)
+			return
+		}
+	}
+}
+
+// JobByPid returns the job with the given pid, or nil if there is none.
+func (s *Shell) JobByPid(pid int) *Job {
+	t := &s.jobs
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	for _, j := range t.jobs {
+		if j.Pid == pid {
+			return j
+		}
+	}
+	return nil
+}
+
+// Jobs returns the jobs in the job table, in order of job id.
+func (s *Shell) Jobs() []*Job {
+	t := &s.jobs
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	jobs := make([]*Job, len(t.jobs))
+	copy(jobs, t.jobs)
+	sort.Slice(jobs, func(i, j int) bool {
+		return jobs[i].ID < jobs[j].ID
+	})
+	return jobs
+}
+
+// LastBackgroundPid returns the value of $!, the pid of the last job started
+// in the background.
+func (s *Shell) LastBackgroundPid() string {
+	if s.lastBackgroundPid == 0 {
+		return ""
+	}
+	return strconv.Itoa(s.lastBackgroundPid)
+}
+
+// jobMark returns '+' for the current job, '-' for the previous one and ' '
+// for the others.
+func (s *Shell) jobMark(job *Job) byte {
+	t := &s.jobs
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	n := len(t.jobs)
+	switch {
+	case n >= 1 && t.jobs[n-1] == job:
+		return '+'
+	case n >= 2 && t.jobs[n-2] == job:
+		return '-'
+	default:
+		return ' '
+	}
+}
+
+// FindJob returns the job for a job spec: %n for job number n, %+ or %% for
+// the current job, %- for the previous one, %str for the job whose command
+// starts with str and %?str for the one whose command contains str.
+func (s *Shell) FindJob(spec string) (*Job, error) {
+	if !strings.HasPrefix(spec, "%") {
+		return nil, fmt.Errorf("%s: no such job", spec)
+	}
+	t := &s.jobs
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	n := len(t.jobs)
+	arg := spec[1:]
+	switch arg {
+	case "", "%", "+":
+		if n >= 1 {
+			return t.jobs[n-1], nil
+		}
+		return nil, fmt.Errorf("%s: no current job", spec)
+	case "-":
+		if n >= 2 {
+			return t.jobs[n-2], nil
+		}
+		return nil, fmt.Errorf("%s: no previous job", spec)
+	}
+	if id, err := strconv.Atoi(arg); err == nil {
+		for _, j := range t.jobs {
+			if j.ID == id {
+				return j, nil
+			}
+		}
+		return nil, fmt.Errorf("%s: no such job", spec)
+	}
+	match := func(j *Job) bool { return strings.HasPrefix(j.Name, arg) }
+	if strings.HasPrefix(arg, "?") {
+		match = func(j *Job) bool { return strings.Contains(j.Name, arg[1:]) }
+	}
+	var found *Job
+	for _, j := range t.jobs {
+		if match(j) {
+			if found != nil {
+				return nil, fmt.Errorf("%s: ambiguous job spec", spec)
+			}
+			found = j
+		}
+	}
+	if found == nil {
+		return nil, fmt.Errorf("%s: no such job", spec)
+	}
+	return found, nil
+}
+
+// findJobOrPid returns the job for a job spec or pid.  For a pid that is not
+// in the job table, it returns a nil job and the pid.
+func (s *Shell) findJobOrPid(arg string) (*Job, int, error) {
+	if strings.HasPrefix(arg, "%") {
+		j, err := s.FindJob(arg)
+		return j, 0, err
+	}
+	pid, err := strconv.Atoi(arg)
+	if err != nil {
+		return nil, 0, fmt.Errorf("`%s': not a pid or valid job spec", arg)
+	}
+	return s.JobByPid(pid), pid, nil
+}
+
+// ReportDoneJobs prints the jobs that have finished and removes them from the
+// job table, as the REPL does before showing a prompt.
+func (s *Shell) ReportDoneJobs(w io.Writer) {
+	for _, j := range s.Jobs() {
+		if j.Done() {
+			s.printJob(w, j, false)
+			s.RemoveJob(j)
+		}
+	}
+}
+
+func (s *Shell) printJob(w io.Writer, j *Job, long bool) {
+	name := j.Name
+	if !j.Done() && !j.Stopped() {
+		name += " &"
+	}
+	if long {
+		fmt.Fprintf(w, "[%d]%c %d %-24s%s\n", j.ID, s.jobMark(j), j.Pid, j.State(), name)
+	} else {
+		fmt.Fprintf(w, "[%d]%c  %-24s%s\n", j.ID, s.jobMark(j), j.State(), name)
+	}
+}
+
+// jobPid returns the pid of the process that determines the outcome of job,
+// if there is one.
+func jobPid(job RunningJob) (int, bool) {
+	switch j := job.(type) {
+	case *ExecJob:
+		return j.cmd.Process.Pid, true
+	case *RedirectJob:
+		return jobPid(j.job)
+	case *SubshellJob:
+		return jobPid(j.job)
+	case *PipelineJob:
+		return jobPid(j.right)
+	default:
+		return 0, false
+	}
+}
+
+func builtinJobs(sh *Shell, std *StdStreams, args []string) (RunningJob, error) {
+	var long, pidsOnly bool
+	for len(args) > 0 && len(args[0]) > 1 && args[0][0] == '-' {
+		arg := args[0]
+		args = args[1:]
+		if arg == "--" {
+			break
+		}
+		for _, c := range arg[1:] {
+			switch c {
+			case 'l':
+				long = true
+			case 'p':
+				pidsOnly = true
+			default:
+				return nil, fmt.Errorf("jobs: -%c: invalid option", c)
+			}
+		}
+	}
+	jobs := sh.Jobs()
+	if len(args) > 0 {
+		jobs = nil
+		for _, arg := range args {
+			j, err := sh.FindJob(arg)
+			if err != nil {
+				return nil, fmt.Errorf("jobs: %w", err)
+			}
+			jobs = append(jobs, j)
+		}
+	}
+	for _, j := range jobs {
+		if pidsOnly {
+			fmt.Fprintln(std.Out, j.Pid)
+		} else {
+			sh.printJob(std.Out, j, long)
+		}
+	}
+	// Like in bash, finished jobs are forgotten once they have been reported
+	for _, j := range jobs {
+		if j.Done() && !pidsOnly {
+			sh.RemoveJob(j)
+		}
+	}
+	return &ImmediateRunningJob{name: "jobs"}, nil
+}
+
+// jobArg returns the job designated by the argument of fg, bg or disown,
+// which defaults to the current job.
+func jobArg(sh *Shell, cmd string, args []string) (*Job, error) {
+	spec := "%+"
+	switch len(args) {
+	case 0:
+	case 1:
+		spec = args[0]
+	default:
+		return nil, fmt.Errorf("%s: too many arguments", cmd)
+	}
+	j, err := sh.FindJob(spec)
+	if err != nil {
+		if len(args) == 0 {
+			err = errors.New("current: no such job")
+		}
+		return nil, fmt.Errorf("%s: %w", cmd, err)
+	}
+	return j, nil
+}
+
+func builtinFg(sh *Shell, std *StdStreams, args []string) (RunningJob, error) {
+	j, err := jobArg(sh, "fg", args)
+	if err != nil {
+		return nil, err
+	}
+	fmt.Fprintln(std.Out, j.Name)
+	if j.group != nil {
+		j.group.Continue(true)
+	}
+	return &ForegroundJob{sh: sh, job: j, std: std}, nil
+}
+
+// A ForegroundJob is a job from the job table brought back to the foreground
+// by fg.  It leaves the job table when it finishes, or becomes the current
+// job again if it is stopped.
+type ForegroundJob struct {
+	sh  *Shell
+	job *Job
+	std *StdStreams
+}
+
+var _ RunningJob = (*ForegroundJob)(nil)
+
+func (f *ForegroundJob) Wait() JobOutcome {
+	if g := f.job.group; g != nil {
+		select {
+		case <-f.job.done:
+		case <-g.stopCh:
+			g.moveToBackground()
+			f.sh.makeCurrent(f.job)
+			fmt.Fprintln(f.std.Err)
+			f.sh.printJob(f.std.Err, f.job, false)
+			return stoppedOutcome
+		}
+	}
+	res := f.job.Wait()
+	f.sh.RemoveJob(f.job)
+	return res
+}
+
+func (f *ForegroundJob) Signal(sig os.Signal) {
+	f.job.Signal(sig)
+}
+
+func (f *ForegroundJob) String() string {
+	return f.job.Name
+}
+
+func builtinBg(sh *Shell, std *StdStreams, args []string) (RunningJob, error) {
+	j, err := jobArg(sh, "bg", args)
+	if err != nil {
+		return nil, err
+	}
+	if j.Done() {
+		return nil, fmt.Errorf("bg: job %d has terminated", j.ID)
+	}
+	if !j.Stopped() {
+		fmt.Fprintf(std.Err, "meshell: bg: job %d already in background\n", j.ID)
+		return &ImmediateRunningJob{name: "bg"}, nil
+	}
+	j.group.Continue(false)
+	fmt.Fprintf(std.Out, "[%d]%c %s &\n", j.ID, sh.jobMark(j), j.Name)
+	return &ImmediateRunningJob{name: "bg"}, nil
+}
+
+func builtinDisown(sh *Shell, std *StdStreams, args []string) (RunningJob, error) {
+	var all, running bool
+	for len(args) > 0 && len(args[0]) > 1 && args[0][0] == '-' {
+		arg := args[0]
+		args = args[1:]
+		if arg == "--" {
+			break
+		}
+		for _, c := range arg[1:] {
+			switch c {
+			case 'a':
+				all = true
+			case 'r':
+				running = true
+			default:
+				return nil, fmt.Errorf("disown: -%c: invalid option", c)
+			}
+		}
+	}
+	var jobs []*Job
+	switch {
+	case len(args) > 0:
+		for _, arg := range args {
+			j, _, err := sh.findJobOrPid(arg)
+			if err == nil && j == nil {
+				err = fmt.Errorf("%s: no such job", arg)
+			}
+			if err != nil {
+				return nil, fmt.Errorf("disown: %w", err)
+			}
+			jobs = append(jobs, j)
+		}
+	case all || running:
+		jobs = sh.Jobs()
+	default:
+		j, err := jobArg(sh, "disown", nil)
+		if err != nil {
+			return nil, err
+		}
+		jobs = append(jobs, j)
+	}
+	for _, j := range jobs {
+		if !running || !j.Done() {
+			sh.RemoveJob(j)
+		}
+	}
+	return &ImmediateRunningJob{name: "disown"}, nil
+}
+
+func builtinWait(sh *Shell, std *StdStreams, args []string) (RunningJob, error) {
+	var any bool
+	for len(args) > 0 && len(args[0]) > 1 && args[0][0] == '-' {
+		arg := args[0]
+		args = args[1:]
+		if arg == "--" {
+			break
+		}
+		for _, c := range arg[1:] {
+			switch c {
+			case 'n':
+				any = true
+			default:
+				return nil, fmt.Errorf("wait: -%c: invalid option", c)
+			}
+		}
+	}
+	// jobs has a nil entry for each invalid argument
+	var jobs []*Job
+	if len(args) == 0 {
+		jobs = sh.Jobs()
+	}
+	for _, arg := range args {
+		j, pid, err := sh.findJobOrPid(arg)
+		switch {
+		case err != nil:
+			fmt.Fprintf(std.Err, "meshell: wait: %s\n", err)
+		case j == nil:
+			fmt.Fprintf(std.Err, "meshell: wait: pid %d is not a child of this shell\n", pid)
+		}
+		if j != nil || !any {
+			jobs = append(jobs, j)
+		}
+	}
+	resCh := make(chan JobOutcome)
+	go func() {
+		var res JobOutcome
+		switch {
+		case any:
+			res = waitAny(sh, jobs)
+		case len(args) == 0:
+			for _, j := range jobs {
+				j.Wait()
+				sh.RemoveJob(j)
+			}
+		default:
+			// The status is that of the last argument
+			for _, j := range jobs {
+				if j == nil {
+					res = JobOutcome{ExitCode: 127}
+					continue
+				}
+				res = j.Wait()
+				sh.RemoveJob(j)
+			}
+		}
+		resCh <- res
+	}()
+	return &JobSequence{resCh: resCh}, nil
+}
+
+// waitAny waits for the first of jobs to finish, removes it from the job table
+// and returns its outcome.  The status is 127 if there are no jobs to wait
+// for.
+func waitAny(sh *Shell, jobs []*Job) JobOutcome {
+	if len(jobs) == 0 {
+		return JobOutcome{ExitCode: 127}
+	}
+	doneCh := make(chan *Job, len(jobs))
+	for _, j := range jobs {
+		go func(j *Job) {
+			j.Wait()
+			doneCh <- j
+		}(j)
+	}
+	j := <-doneCh
+	sh.RemoveJob(j)
+	return j.outcome
+}
+
+func builtinKill(sh *Shell, std *StdStreams, args []string) (RunningJob, error) {
+	sig := syscall.SIGTERM
+	if len(args) > 0 && (args[0] == "-l" || args[0] == "-L") {
+		return listSignals(std, args[1:])
+	}
+	if len(args) > 0 && len(args[0]) > 1 && args[0][0] == '-' && args[0] != "--" {
+		spec := args[0][1:]
+		args = args[1:]
+		if spec == "s" || spec == "n" {
+			if len(args) == 0 {
+				return nil, fmt.Errorf("kill: -%s: option requires an argument", spec)
+			}
+			spec = args[0]
+			args = args[1:]
+		}
+		var ok bool
+		if sig, ok = parseSignal(spec); !ok {
+			return nil, fmt.Errorf("kill: %s: invalid signal specification", spec)
+		}
+	}
+	if len(args) > 0 && args[0] == "--" {
+		args = args[1:]
+	}
+	if len(args) == 0 {
+		return nil, errors.New("kill: usage: kill [-s sigspec | -n signum | -sigspec] pid | jobspec ...")
+	}
+	code := 0
+	for _, arg := range args {
+		j, pid, err := sh.findJobOrPid(arg)
+		if err != nil {
+			fmt.Fprintf(std.Err, "meshell: kill: %s\n", err)
+			code = 1
+			continue
+		}
+		if j != nil {
+			j.Signal(sig)
+			continue
+		}
+		if err := unix.Kill(pid, sig); err != nil {
+			fmt.Fprintf(std.Err, "meshell: kill: (%d) - %s\n", pid, err)
+			code = 1
+		}
+	}
+	return &ImmediateRunningJob{name: "kill", outcome: JobOutcome{ExitCode: code}}, nil
+}
+
+// parseSignal returns the signal for a name (with or without the SIG prefix)
+// or number.  Signal 0 is valid for kill, it checks that the process exists.
+func parseSignal(spec string) (syscall.Signal, bool) {
+	if spec == "0" {
+		return 0, true
+	}
+	name, ok := trapName(spec)
+	if !ok {
+		return 0, false
+	}
+	return trapSignal(name)
+}
+
+// listSignals implements kill -l, which lists all signals or converts between
+// signal names and numbers.
+func listSignals(std *StdStreams, args []string) (RunningJob, error) {
+	if len(args) == 0 {
+		printSignalList(std)
+		return &ImmediateRunningJob{name: "kill"}, nil
+	}
+	for _, arg := range args {
+		if n, err := strconv.Atoi(arg); err == nil {
+			// Exit statuses of processes killed by a signal are accepted
+			if name := signalName(syscall.Signal(n & 0x7f)); name != "" {
+				fmt.Fprintln(std.Out, name)
+				continue
+			}
+		} else if sig, ok := parseSignal(arg); ok {
+			fmt.Fprintln(std.Out, int(sig))
+			continue
+		}
+		return nil, fmt.Errorf("kill: %s: invalid signal specification", arg)
+	}
+	return &ImmediateRunningJob{name: "kill"}, nil
+}
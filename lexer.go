@@ -1,10 +1,21 @@
 package main
 
-import "github.com/arnodel/grammar"
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/arnodel/grammar"
+)
 
 type Token = grammar.SimpleToken
 
-var tokeniseCommand = grammar.SimpleTokeniser([]grammar.TokenDef{
+var tokeniseCommand = grammar.SimpleTokeniser(commandTokenDefs)
+
+// commandTokenDefs define the tokens of the shell language.  Reserved words
+// and assignments are context-sensitive so they are recognised after
+// tokenising, see tokenise.
+var commandTokenDefs = []grammar.TokenDef{
 	//
 	// Command
 	//
@@ -27,6 +38,16 @@ var tokeniseCommand = grammar.SimpleTokeniser([]grammar.TokenDef{
 		Ptn:  `\n\s*`,
 		Name: "nl",
 	},
+	{
+		Mode: "cmd",
+		Name: "redirect",
+		Ptn:  `(?:\d+|\{[a-zA-Z_][a-zA-Z0-9_]*(?:\[\d+\])?\})?(?:>>|>&|>\||>|<<-|<<|<&|<>|<)|&>>?`,
+	},
+	{
+		Mode: "cmd",
+		Name: "dsemi",
+		Ptn:  `;;\s*`,
+	},
 	{
 		Mode: "cmd",
 		Ptn:  `[;&]\s*`,
@@ -36,17 +57,17 @@ var tokeniseCommand = grammar.SimpleTokeniser([]grammar.TokenDef{
 	{
 		Mode: "cmd",
 		Name: "envvar",
-		Ptn:  `\$[a-zA-Z_][a-zA-Z0-9_-]*`,
+		Ptn:  `\$[a-zA-Z_][a-zA-Z0-9_]*`,
 	},
 	{
 		Mode: "cmd",
 		Name: "specialvar",
-		Ptn:  `\$(?:[0-9]+|[?#@$])`,
+		Ptn:  `\$(?:[0-9]|[?#@$!-])`,
 	},
 	{
 		Mode: "cmd",
 		Name: "assign",
-		Ptn:  `[a-zA-Z_][a-zA-Z0-9_-]*=`,
+		Ptn:  `[a-zA-Z_][a-zA-Z0-9_]*(?:\[(?:[^\]\s'"]|'[^']*'|"[^"]*")*\])?=`,
 	},
 	{
 		Mode:     "cmd",
@@ -63,7 +84,7 @@ var tokeniseCommand = grammar.SimpleTokeniser([]grammar.TokenDef{
 	{
 		Mode: "cmd",
 		Name: "pipe",
-		Ptn:  `\|\s*`,
+		Ptn:  `\|&?\s*`,
 	},
 	{
 		Mode:     "cmd",
@@ -77,21 +98,6 @@ var tokeniseCommand = grammar.SimpleTokeniser([]grammar.TokenDef{
 		Ptn:     `\)`,
 		PopMode: true,
 	},
-	{
-		Mode: "cmd",
-		Name: "redirect",
-		Ptn:  `\d?>>|\d?>&?|&>>?|<`,
-	},
-	{
-		Mode: "cmd",
-		Name: "openbrace",
-		Ptn:  `{\s*`,
-	},
-	{
-		Mode: "cmd",
-		Name: "closebrace",
-		Ptn:  `\}`,
-	},
 	{
 		Mode:     "cmd",
 		Name:     "startquote",
@@ -105,13 +111,24 @@ var tokeniseCommand = grammar.SimpleTokeniser([]grammar.TokenDef{
 	},
 	{
 		Mode: "cmd",
-		Name: "kw",
-		Ptn:  `(?:if|then|elif|else|fi|while|do|done|function)\b`,
+		Ptn:  `#[^\n]*`,
+	},
+	{
+		// The subscript of an element in a compound assignment, e.g. the
+		// [5]= in a=([5]=x)
+		Mode: "cmd",
+		Name: "subassign",
+		Ptn:  `\[(?:[^\]\s'"]|'[^']*'|"[^"]*")*\]=`,
+	},
+	{
+		Mode: "cmd",
+		Name: "globqual",
+		Ptn:  `(?:[^\\"'\s();&\$|<>]|\\.)*[*?[](?:[^\\"'\s();&\$|<>]|\\.)*\([^()\s]+\)`,
 	},
 	{
 		Mode: "cmd",
 		Name: "lit",
-		Ptn:  `(?:[^\\"\s();&\$|}]|\\.)+`,
+		Ptn:  `(?:[^\\"'\s();&\$|<>]|\\.)+`,
 	},
 	//
 	// String
@@ -125,12 +142,12 @@ var tokeniseCommand = grammar.SimpleTokeniser([]grammar.TokenDef{
 	{
 		Mode: "str",
 		Name: "envvar",
-		Ptn:  `\$[a-zA-Z_][a-zA-Z0-9_-]*`,
+		Ptn:  `\$[a-zA-Z_][a-zA-Z0-9_]*`,
 	},
 	{
 		Mode: "str",
 		Name: "specialvar",
-		Ptn:  `\$(?:[0-9]+|[?#@$])`,
+		Ptn:  `\$(?:[0-9]|[?#@$!-])`,
 	},
 	{
 		Mode:     "str",
@@ -161,7 +178,12 @@ var tokeniseCommand = grammar.SimpleTokeniser([]grammar.TokenDef{
 	{
 		Mode: "param",
 		Name: "name",
-		Ptn:  `[a-zA-Z_][a-zA-Z0-9_-]*`,
+		Ptn:  `[a-zA-Z_][a-zA-Z0-9_]*`,
+	},
+	{
+		Mode: "param",
+		Name: "subscript",
+		Ptn:  `\[[^\]]*\]`,
 	},
 	{
 		Mode: "param",
@@ -171,6 +193,259 @@ var tokeniseCommand = grammar.SimpleTokeniser([]grammar.TokenDef{
 	{
 		Mode: "param",
 		Name: "special",
-		Ptn:  `[?#@$]`,
+		Ptn:  `[?#@$!-]`,
 	},
-})
+}
+
+// reservedWords maps the reserved words to the type of token they are turned
+// into when they are recognised.
+var reservedWords = map[string]string{
+	"if":       "kw",
+	"then":     "kw",
+	"elif":     "kw",
+	"else":     "kw",
+	"fi":       "kw",
+	"while":    "kw",
+	"do":       "kw",
+	"done":     "kw",
+	"function": "kw",
+	"coproc":   "kw",
+	"{":        "openbrace",
+	"}":        "closebrace",
+}
+
+// tokenise splits src into tokens.  On top of what tokeniseCommand does, it
+// recognises reserved words and assignments only where a command can start,
+// expands aliases and attaches here-documents to their redirection.  It is
+// what the REPL and the script runner use to prepare input for the parser.
+func tokenise(sh *Shell, src string) (*grammar.SimpleTokenStream, error) {
+	src, docs, _ := scanSource(src)
+	stream, err := tokeniseCommand(src)
+	if err != nil {
+		return nil, err
+	}
+	p := &wordPass{aliases: sh.aliases, docs: docs}
+	toks, _, err := p.run(drainTokens(stream), lexState{cmdPos: true}, nil)
+	if err != nil {
+		return nil, err
+	}
+	return grammar.NewSimpleTokenStream(toks), nil
+}
+
+func drainTokens(stream *grammar.SimpleTokenStream) []grammar.Token {
+	var toks []grammar.Token
+	for {
+		tok := stream.Next()
+		if tok == grammar.EOF {
+			return toks
+		}
+		toks = append(toks, tok)
+	}
+}
+
+// lexState records how the next word should be interpreted.
+type lexState struct {
+	cmdPos      bool // A command can start, so reserved words, aliases and assignments are recognised
+	kwPos       bool // Only reserved words are recognised (e.g. `fi` after `done`)
+	eligible    bool // The previous alias ended with a blank, so aliases are recognised
+	afterCoproc bool // The next word may be the name of a coprocess
+}
+
+// wordPass turns the output of tokeniseCommand into the tokens the parser
+// expects.
+type wordPass struct {
+	aliases map[string]string
+	docs    []hereDoc // Here-document bodies, in the order of their redirections
+}
+
+// run processes toks starting in state st.  Aliases are expanded
+// recursively, but an alias is not expanded again while it is being expanded,
+// which is what makes `alias ls='ls -F'` work.  It returns the state after the
+// last token so that expansions of aliases whose value ends with a blank make
+// the following word eligible too.
+func (p *wordPass) run(toks []grammar.Token, st lexState, expanding []string) ([]grammar.Token, lexState, error) {
+	var (
+		out         []grammar.Token
+		wordStart   = true
+		redirTarget bool
+		hereDoc     bool
+		brackets    []string // The type of each open bracket: openbkt, dollarbkt or array
+		arrayNext   bool     // The next bracket starts the elements of a compound assignment
+	)
+	for i := 0; i < len(toks); i++ {
+		tok := toks[i]
+		switch tok.Type() {
+		case "spc":
+			wordStart = true
+		case "redirect":
+			if !wordStart {
+				// The parser expects redirections to be separate words
+				out = append(out, Token{TokType: "spc", TokValue: ""})
+			}
+			wordStart, redirTarget = true, true
+			_, _, op := splitRedirect(tok.Value())
+			hereDoc = op == "<<" || op == "<<-"
+		case "nl":
+			if inArray(brackets) {
+				// The elements of an array can span several lines
+				tok = Token{TokType: "spc", TokValue: " "}
+				wordStart = true
+				break
+			}
+			st = lexState{cmdPos: true}
+			wordStart, redirTarget = true, false
+		case "term", "logical", "pipe", "dsemi":
+			st = lexState{cmdPos: true}
+			wordStart, redirTarget = true, false
+		case "openbkt", "dollarbkt":
+			if arrayNext {
+				// The state is kept for after the assignment
+				brackets = append(brackets, "array")
+				arrayNext = false
+			} else {
+				brackets = append(brackets, tok.Type())
+				st = lexState{cmdPos: true}
+			}
+			wordStart = true
+		case "closebkt":
+			// After a subshell only reserved words can follow, after a
+			// command substitution or an array the current word carries on.
+			kind := "openbkt"
+			if n := len(brackets); n > 0 {
+				kind = brackets[n-1]
+				brackets = brackets[:n-1]
+			}
+			switch kind {
+			case "openbkt":
+				st = lexState{kwPos: true}
+			case "dollarbkt":
+				st = lexState{}
+			}
+			wordStart = false
+		default:
+			if !wordStart {
+				tok = notAssign(tok)
+				break
+			}
+			wordStart = false
+			if inArray(brackets) {
+				// Array elements are plain words, which may start with a
+				// subscript
+				if tok.Type() != "subassign" {
+					tok = notAssign(tok)
+				}
+				break
+			}
+			if hereDoc {
+				// The delimiter is replaced with the body of the document
+				for i+1 < len(toks) && !isWordBreak(toks[i+1]) {
+					i++
+				}
+				if len(p.docs) == 0 {
+					return nil, st, errors.New("missing here-document")
+				}
+				doc := p.docs[0]
+				p.docs = p.docs[1:]
+				tokType := "heredoc"
+				if doc.quoted {
+					tokType = "rawheredoc"
+				}
+				out = append(out, Token{TokType: tokType, TokValue: doc.body})
+				hereDoc, redirTarget = false, false
+				continue
+			}
+			if redirTarget {
+				redirTarget = false
+				tok = notAssign(tok)
+				break
+			}
+			whole := tok.Type() == "lit" && (i+1 == len(toks) || isWordBreak(toks[i+1]))
+			if tokType, ok := reservedWords[tok.Value()]; ok && whole && (st.cmdPos || st.kwPos) {
+				out = append(out, Token{TokType: tokType, TokValue: tok.Value()})
+				switch tok.Value() {
+				case "{":
+					// The parser does not expect blanks after an opening brace
+					for i+1 < len(toks) && (toks[i+1].Type() == "spc" || toks[i+1].Type() == "nl") {
+						i++
+					}
+					wordStart = true
+					st = lexState{cmdPos: true}
+				case "coproc":
+					st = lexState{cmdPos: true, afterCoproc: true}
+				case "fi", "done", "}":
+					st = lexState{kwPos: true}
+				case "function":
+					st = lexState{}
+				default:
+					st = lexState{cmdPos: true}
+				}
+				continue
+			}
+			if val, ok := p.aliases[tok.Value()]; ok && whole && (st.cmdPos || st.eligible) && !containsString(expanding, tok.Value()) {
+				stream, err := tokeniseCommand(val)
+				if err != nil {
+					return nil, st, fmt.Errorf("alias %s: %s", tok.Value(), err)
+				}
+				var exp []grammar.Token
+				exp, st, err = p.run(drainTokens(stream), st, append(expanding, tok.Value()))
+				if err != nil {
+					return nil, st, err
+				}
+				if strings.HasSuffix(val, " ") || strings.HasSuffix(val, "\t") {
+					st.eligible = true
+				}
+				// Avoid consecutive spaces, the parser does not expect them
+				for len(exp) > 0 && i+1 < len(toks) && toks[i+1].Type() == "spc" && exp[len(exp)-1].Type() == "spc" {
+					exp = exp[:len(exp)-1]
+				}
+				out = append(out, exp...)
+				wordStart = true
+				continue
+			}
+			if tok.Type() == "assign" && i+1 < len(toks) && toks[i+1].Type() == "openbkt" {
+				// A compound assignment, which declaration builtins such as
+				// declare also take as arguments
+				arrayNext = true
+				st.eligible = false
+				break
+			}
+			if tok.Type() == "assign" && st.cmdPos {
+				// Assignments can precede the command name
+				st.eligible = false
+				break
+			}
+			tok = notAssign(tok)
+			if st.afterCoproc {
+				st = lexState{kwPos: true}
+			} else {
+				st = lexState{}
+			}
+		}
+		out = append(out, tok)
+	}
+	return out, st, nil
+}
+
+// isWordBreak returns true if tok ends the word before it.
+func isWordBreak(tok grammar.Token) bool {
+	switch tok.Type() {
+	case "spc", "term", "nl", "logical", "pipe", "dsemi", "closebkt", "redirect":
+		return true
+	}
+	return false
+}
+
+// inArray returns true if the innermost open bracket contains the elements of
+// a compound assignment.
+func inArray(brackets []string) bool {
+	return len(brackets) > 0 && brackets[len(brackets)-1] == "array"
+}
+
+// notAssign turns an assign token which is not in a position where an
+// assignment can be into a plain literal.
+func notAssign(tok grammar.Token) grammar.Token {
+	if tok.Type() == "assign" || tok.Type() == "subassign" {
+		return Token{TokType: "lit", TokValue: tok.Value()}
+	}
+	return tok
+}
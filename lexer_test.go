@@ -0,0 +1,102 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+// runWordPass tokenises src and runs the word pass on it, returning the tokens
+// as type:value, with blanks as _.
+func runWordPass(t *testing.T, src string, aliases map[string]string) (string, error) {
+	t.Helper()
+	stream, err := tokeniseCommand(src)
+	if err != nil {
+		t.Fatalf("tokeniseCommand(%q): %s", src, err)
+	}
+	toks, _, err := (&wordPass{aliases: aliases}).run(drainTokens(stream), lexState{cmdPos: true}, nil)
+	parts := make([]string, len(toks))
+	for i, tok := range toks {
+		if tok.Type() == "spc" {
+			parts[i] = "_"
+		} else {
+			parts[i] = tok.Type() + ":" + strings.TrimSpace(tok.Value())
+		}
+	}
+	return strings.Join(parts, " "), err
+}
+
+func TestWordPassReservedWords(t *testing.T) {
+	tests := []struct {
+		src  string
+		want string
+	}{
+		// Reserved words are only recognised where a command can start
+		{"if true; then echo if; fi", "kw:if _ lit:true term:; kw:then _ lit:echo _ lit:if term:; kw:fi"},
+		{"echo done then", "lit:echo _ lit:done _ lit:then"},
+		{"cat > fi", "lit:cat _ redirect:> _ lit:fi"},
+		{"for i in do; do echo; done", "lit:for _ lit:i _ lit:in _ lit:do term:; kw:do _ lit:echo term:; kw:done"},
+		// Only reserved words can follow a subshell
+		{"( true ) fi", "openbkt:( lit:true _ closebkt:) _ kw:fi"},
+		// Blanks after an opening brace are dropped, a closing brace is
+		// only one where a command can start
+		{"{ echo; }", "openbrace:{ lit:echo term:; closebrace:}"},
+		{"echo }", "lit:echo _ lit:}"},
+		// Assignments only precede the command name
+		{"a=1 b=2 cmd c=3", "assign:a= lit:1 _ assign:b= lit:2 _ lit:cmd _ lit:c= lit:3"},
+		{"echo a=1", "lit:echo _ lit:a= lit:1"},
+		{"x=(1 2) cmd", "assign:x= openbkt:( lit:1 _ lit:2 closebkt:) _ lit:cmd"},
+		{"declare a=(x y)", "lit:declare _ assign:a= openbkt:( lit:x _ lit:y closebkt:)"},
+	}
+	for _, test := range tests {
+		got, err := runWordPass(t, test.src, nil)
+		if err != nil {
+			t.Errorf("%q: unexpected error: %s", test.src, err)
+		} else if got != test.want {
+			t.Errorf("%q:\n got %s\nwant %s", test.src, got, test.want)
+		}
+	}
+}
+
+func TestWordPassAliases(t *testing.T) {
+	aliases := map[string]string{
+		"ll":   "ls -l",
+		"ls":   "ls -F",
+		"sudo": "sudo ",
+		"e":    "echo",
+		"a":    "b",
+		"b":    "a",
+	}
+	tests := []struct {
+		src  string
+		want string
+	}{
+		// Aliases are expanded recursively, but not into themselves
+		{"ls x", "lit:ls _ lit:-F _ lit:x"},
+		{"ll x", "lit:ls _ lit:-F _ lit:-l _ lit:x"},
+		{"a", "lit:a"},
+		// Only the command name is expanded...
+		{"e ll", "lit:echo _ lit:ll"},
+		{"ll; ll && e | ll", "lit:ls _ lit:-F _ lit:-l term:; lit:ls _ lit:-F _ lit:-l _ logical:&& lit:echo _ pipe:| lit:ls _ lit:-F _ lit:-l"},
+		{"echo $(ll)", "lit:echo _ dollarbkt:$( lit:ls _ lit:-F _ lit:-l closebkt:)"},
+		{"coproc ll", "kw:coproc _ lit:ls _ lit:-F _ lit:-l"},
+		// ...unless the previous alias ends with a blank
+		{"sudo ll", "lit:sudo _ lit:ls _ lit:-F _ lit:-l"},
+		{"sudo e ll", "lit:sudo _ lit:echo _ lit:ll"},
+		// Quoted words are not expanded
+		{"'ll' x", "litstr:'ll' _ lit:x"},
+	}
+	for _, test := range tests {
+		got, err := runWordPass(t, test.src, aliases)
+		if err != nil {
+			t.Errorf("%q: unexpected error: %s", test.src, err)
+		} else if got != test.want {
+			t.Errorf("%q:\n got %s\nwant %s", test.src, got, test.want)
+		}
+	}
+}
+
+func TestWordPassMissingHereDoc(t *testing.T) {
+	if _, err := runWordPass(t, "cat <<EOF", nil); err == nil {
+		t.Error("want an error for a here-document without a body")
+	}
+}
@@ -0,0 +1,516 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+//
+// umask
+//
+
+// permClasses are the user classes of a symbolic mode, with the mask of the
+// permission bits for each.
+var permClasses = []struct {
+	class byte
+	mask  uint32
+}{
+	{'u', 0700},
+	{'g', 0070},
+	{'o', 0007},
+}
+
+// processUmask is the file-creation mask of the process, which is that of the
+// top-level shell.  Subshells run in the same process, so they apply their own
+// umask to the files and the commands they start instead (see createFile and
+// prepareChild).
+var processUmask = getUmask()
+
+// getUmask returns the file-creation mask of the process.  It is read from
+// /proc where possible, as the only other way is to set it, which would affect
+// files created meanwhile; it is only called at startup anyway.
+func getUmask() uint32 {
+	if data, err := os.ReadFile("/proc/self/status"); err == nil {
+		for _, line := range strings.Split(string(data), "\n") {
+			if !strings.HasPrefix(line, "Umask:") {
+				continue
+			}
+			if n, err := strconv.ParseUint(strings.TrimSpace(line[len("Umask:"):]), 8, 32); err == nil {
+				return uint32(n)
+			}
+		}
+	}
+	mask := syscall.Umask(0)
+	syscall.Umask(mask)
+	return uint32(mask)
+}
+
+// setUmask sets the file-creation mask of the shell.  Only the top-level shell
+// sets that of the process.
+func (s *Shell) setUmask(mask uint32) {
+	s.umask = mask
+	if !s.subshell {
+		syscall.Umask(int(mask))
+		atomic.StoreUint32(&processUmask, mask)
+	}
+}
+
+// createFile opens path with flag, which includes os.O_CREATE, giving a new
+// file the permissions allowed by the umask of sh.
+func createFile(sh *Shell, path string, flag int) (*os.File, error) {
+	if sh.umask == atomic.LoadUint32(&processUmask) {
+		return os.OpenFile(path, flag, 0666)
+	}
+	f, err := os.OpenFile(path, flag|os.O_EXCL, 0666)
+	if os.IsExist(err) {
+		return os.OpenFile(path, flag&^os.O_CREATE, 0666)
+	}
+	if err != nil {
+		return nil, err
+	}
+	// The umask of the process has already been applied, which may have
+	// removed permissions that the subshell's allows.
+	if err := f.Chmod(0666 &^ os.FileMode(sh.umask)); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return f, nil
+}
+
+func builtinUmask(sh *Shell, std *StdStreams, args []string) (RunningJob, error) {
+	var symbolic, reusable bool
+	for len(args) > 0 && len(args[0]) > 1 && args[0][0] == '-' {
+		arg := args[0]
+		args = args[1:]
+		if arg == "--" {
+			break
+		}
+		for _, c := range arg[1:] {
+			switch c {
+			case 'S':
+				symbolic = true
+			case 'p':
+				reusable = true
+			default:
+				fmt.Fprintf(std.Err, "meshell: umask: -%c: invalid option\n", c)
+				return &ImmediateRunningJob{name: "umask", outcome: JobOutcome{ExitCode: 2}}, nil
+			}
+		}
+	}
+	mask := sh.umask
+	if len(args) == 0 {
+		s := fmt.Sprintf("%04o", mask)
+		if symbolic {
+			s = symbolicMode(mask)
+		}
+		if reusable && symbolic {
+			s = "umask -S " + s
+		} else if reusable {
+			s = "umask " + s
+		}
+		fmt.Fprintln(std.Out, s)
+		return &ImmediateRunningJob{name: "umask"}, nil
+	}
+	mode := args[0]
+	if mode != "" && mode[0] >= '0' && mode[0] <= '9' {
+		n, err := strconv.ParseUint(mode, 8, 32)
+		if err != nil || n > 0777 {
+			return nil, fmt.Errorf("umask: %s: octal number out of range", mode)
+		}
+		mask = uint32(n)
+	} else {
+		// A symbolic mode gives the permissions to allow, which are the
+		// complement of the mask.
+		perm, err := applySymbolicMode(^mask&0777, mode)
+		if err != nil {
+			return nil, fmt.Errorf("umask: %s", err)
+		}
+		mask = ^perm & 0777
+	}
+	sh.setUmask(mask)
+	if symbolic {
+		fmt.Fprintln(std.Out, symbolicMode(mask))
+	}
+	return &ImmediateRunningJob{name: "umask"}, nil
+}
+
+// symbolicMode returns the permissions allowed by mask in the form
+// u=rwx,g=rx,o=rx.
+func symbolicMode(mask uint32) string {
+	perm := ^mask & 0777
+	parts := make([]string, len(permClasses))
+	for i, pc := range permClasses {
+		var b strings.Builder
+		b.WriteByte(pc.class)
+		b.WriteByte('=')
+		for j, c := range "rwx" {
+			if perm&pc.mask&(0444>>j) != 0 {
+				b.WriteRune(c)
+			}
+		}
+		parts[i] = b.String()
+	}
+	return strings.Join(parts, ",")
+}
+
+// applySymbolicMode applies a symbolic mode such as u=rwx,go-w or a+r to the
+// permission bits perm, as chmod does.
+func applySymbolicMode(perm uint32, mode string) (uint32, error) {
+	for _, clause := range strings.Split(mode, ",") {
+		i := strings.IndexAny(clause, "+-=")
+		if i == -1 {
+			return 0, fmt.Errorf("%s: invalid symbolic mode operator", mode)
+		}
+		var who uint32
+		for _, c := range clause[:i] {
+			switch c {
+			case 'u':
+				who |= 0700
+			case 'g':
+				who |= 0070
+			case 'o':
+				who |= 0007
+			case 'a':
+				who |= 0777
+			default:
+				return 0, fmt.Errorf("%s: invalid symbolic mode character", mode)
+			}
+		}
+		if who == 0 {
+			who = 0777
+		}
+		op := clause[i]
+		var bits uint32
+		for _, c := range clause[i+1:] {
+			switch c {
+			case 'r':
+				bits |= 0444
+			case 'w':
+				bits |= 0222
+			case 'x':
+				bits |= 0111
+			default:
+				return 0, fmt.Errorf("%s: invalid symbolic mode character", mode)
+			}
+		}
+		bits &= who
+		switch op {
+		case '+':
+			perm |= bits
+		case '-':
+			perm &^= bits
+		case '=':
+			perm = perm&^who | bits
+		}
+	}
+	return perm, nil
+}
+
+//
+// ulimit
+//
+
+// rlimitResource describes a resource limit that ulimit can show and change.
+type rlimitResource struct {
+	flag     byte
+	resource int
+	desc     string
+	unit     string
+	factor   uint64 // Size of a unit in the limit, e.g. 1024 for kbytes
+}
+
+var rlimitResources = []rlimitResource{
+	{'c', unix.RLIMIT_CORE, "core file size", "blocks", 1024},
+	{'d', unix.RLIMIT_DATA, "data seg size", "kbytes", 1024},
+	{'f', unix.RLIMIT_FSIZE, "file size", "blocks", 1024},
+	{'n', unix.RLIMIT_NOFILE, "open files", "", 1},
+	{'s', unix.RLIMIT_STACK, "stack size", "kbytes", 1024},
+	{'t', unix.RLIMIT_CPU, "cpu time", "seconds", 1},
+	{'v', unix.RLIMIT_AS, "virtual memory", "kbytes", 1024},
+}
+
+func findRlimitResource(flag byte) (rlimitResource, bool) {
+	for _, r := range rlimitResources {
+		if r.flag == flag {
+			return r, true
+		}
+	}
+	return rlimitResource{}, false
+}
+
+func builtinUlimit(sh *Shell, std *StdStreams, args []string) (RunningJob, error) {
+	var (
+		hard, soft, all bool
+		resources       []rlimitResource
+	)
+	for len(args) > 0 && len(args[0]) > 1 && args[0][0] == '-' {
+		arg := args[0]
+		args = args[1:]
+		if arg == "--" {
+			break
+		}
+		for i := 1; i < len(arg); i++ {
+			switch c := arg[i]; c {
+			case 'H':
+				hard = true
+			case 'S':
+				soft = true
+			case 'a':
+				all = true
+			default:
+				r, ok := findRlimitResource(c)
+				if !ok {
+					fmt.Fprintf(std.Err, "meshell: ulimit: -%c: invalid option\n", c)
+					return &ImmediateRunningJob{name: "ulimit", outcome: JobOutcome{ExitCode: 2}}, nil
+				}
+				resources = append(resources, r)
+			}
+		}
+	}
+	if len(args) > 1 {
+		return nil, errors.New("ulimit: too many arguments")
+	}
+	if all {
+		resources = rlimitResources
+	} else if len(resources) == 0 {
+		r, _ := findRlimitResource('f')
+		resources = []rlimitResource{r}
+	}
+	if len(args) == 0 {
+		for _, r := range resources {
+			lim, err := sh.getRlimit(r.resource)
+			if err != nil {
+				return nil, fmt.Errorf("ulimit: %s: cannot get limit: %w", r.desc, err)
+			}
+			val := lim.Cur
+			if hard && !soft {
+				val = lim.Max
+			}
+			if len(resources) == 1 {
+				fmt.Fprintln(std.Out, formatRlimit(val, r.factor))
+				continue
+			}
+			unit := "(-" + string(r.flag) + ")"
+			if r.unit != "" {
+				unit = "(" + r.unit + ", -" + string(r.flag) + ")"
+			}
+			fmt.Fprintf(std.Out, "%-20s %18s %s\n", r.desc, unit, formatRlimit(val, r.factor))
+		}
+		return &ImmediateRunningJob{name: "ulimit"}, nil
+	}
+	if all {
+		return nil, errors.New("ulimit: cannot set all the limits at once")
+	}
+	// Like in bash, both limits are set unless -H or -S is given.
+	if !hard && !soft {
+		hard, soft = true, true
+	}
+	for _, r := range resources {
+		lim, err := sh.getRlimit(r.resource)
+		if err != nil {
+			return nil, fmt.Errorf("ulimit: %s: cannot get limit: %w", r.desc, err)
+		}
+		val, err := parseRlimit(args[0], r.factor, lim)
+		if err != nil {
+			return nil, fmt.Errorf("ulimit: %s: %w", args[0], err)
+		}
+		if hard {
+			lim.Max = val
+		}
+		if soft {
+			lim.Cur = val
+		}
+		if err := sh.setRlimit(r.resource, lim); err != nil {
+			return nil, fmt.Errorf("ulimit: %s: cannot modify limit: %w", r.desc, err)
+		}
+	}
+	return &ImmediateRunningJob{name: "ulimit"}, nil
+}
+
+// getRlimit returns the limit of the shell for resource.
+func (s *Shell) getRlimit(resource int) (syscall.Rlimit, error) {
+	if lim, ok := s.rlimits[resource]; ok {
+		return lim, nil
+	}
+	var lim syscall.Rlimit
+	err := syscall.Getrlimit(resource, &lim)
+	return lim, err
+}
+
+// setRlimit sets the limit of the shell for resource.  Only the top-level
+// shell sets that of the process, a subshell checks it as setrlimit would and
+// applies it to the commands it starts.
+func (s *Shell) setRlimit(resource int, lim syscall.Rlimit) error {
+	if !s.subshell {
+		// syscall.Setrlimit rather than unix.Setrlimit so that the Go
+		// runtime knows not to restore its own open files limit in the
+		// children.
+		if err := syscall.Setrlimit(resource, &lim); err != nil {
+			return err
+		}
+	} else {
+		old, err := s.getRlimit(resource)
+		if err != nil {
+			return err
+		}
+		if lim.Cur > lim.Max {
+			return syscall.EINVAL
+		}
+		if lim.Max > old.Max && os.Geteuid() != 0 {
+			return syscall.EPERM
+		}
+	}
+	s.rlimits[resource] = lim
+	return nil
+}
+
+func formatRlimit(val, factor uint64) string {
+	if val == unix.RLIM_INFINITY {
+		return "unlimited"
+	}
+	return strconv.FormatUint(val/factor, 10)
+}
+
+// parseRlimit parses a limit given to ulimit, which is a number of units,
+// "unlimited" or the current "hard" or "soft" limit.
+func parseRlimit(s string, factor uint64, lim syscall.Rlimit) (uint64, error) {
+	switch s {
+	case "unlimited":
+		return unix.RLIM_INFINITY, nil
+	case "hard":
+		return lim.Max, nil
+	case "soft":
+		return lim.Cur, nil
+	}
+	n, err := strconv.ParseUint(s, 10, 64)
+	if err != nil {
+		return 0, errors.New("invalid number")
+	}
+	if n > unix.RLIM_INFINITY/factor {
+		return 0, errors.New("limit out of range")
+	}
+	return n * factor, nil
+}
+
+//
+// Child processes
+//
+
+// runChildArg is the first argument of meshell when it runs itself to start a
+// command (see runChild).
+const runChildArg = "--meshell-run-child"
+
+// prepareChild makes cmd start with the umask and resource limits of the shell
+// when they differ from those of the process, which happens in a subshell that
+// has changed them.  The settings cannot be applied between fork and exec, so
+// meshell runs itself to apply them before executing the command.
+func (s *Shell) prepareChild(cmd *exec.Cmd) error {
+	var settings []string
+	if s.umask != atomic.LoadUint32(&processUmask) {
+		settings = append(settings, fmt.Sprintf("umask=%o", s.umask))
+	}
+	for resource, lim := range s.rlimits {
+		var cur syscall.Rlimit
+		if err := syscall.Getrlimit(resource, &cur); err != nil || cur != lim {
+			settings = append(settings, fmt.Sprintf("%d=%d:%d", resource, lim.Cur, lim.Max))
+		}
+	}
+	if settings == nil {
+		return nil
+	}
+	self, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	args := []string{cmd.Args[0], runChildArg, strings.Join(settings, ","), cmd.Path}
+	cmd.Args = append(args, cmd.Args...)
+	cmd.Path = self
+	return nil
+}
+
+// childArgs returns the arguments of the command run by cmd, which may have
+// been changed by prepareChild.
+func childArgs(cmd *exec.Cmd) []string {
+	if len(cmd.Args) > 4 && cmd.Args[1] == runChildArg {
+		return cmd.Args[4:]
+	}
+	return cmd.Args
+}
+
+// runChild applies the settings given by prepareChild then replaces the
+// process with the command.  args are the settings, the path of the command
+// and its arguments.
+func runChild(args []string) int {
+	if len(args) < 3 {
+		fmt.Fprintln(os.Stderr, "meshell: missing command")
+		return 2
+	}
+	path, argv := args[1], args[2:]
+	for _, setting := range strings.Split(args[0], ",") {
+		i := strings.IndexByte(setting, '=')
+		if i == -1 {
+			continue
+		}
+		name, val := setting[:i], setting[i+1:]
+		var err error
+		if name == "umask" {
+			var mask uint64
+			mask, err = strconv.ParseUint(val, 8, 32)
+			if err == nil {
+				syscall.Umask(int(mask))
+			}
+		} else {
+			var (
+				resource int
+				lim      syscall.Rlimit
+			)
+			resource, err = strconv.Atoi(name)
+			if err == nil {
+				_, err = fmt.Sscanf(val, "%d:%d", &lim.Cur, &lim.Max)
+			}
+			if err == nil {
+				err = syscall.Setrlimit(resource, &lim)
+			}
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "meshell: %s: %s\n", setting, err)
+			return 1
+		}
+	}
+	err := syscall.Exec(path, argv, os.Environ())
+	fmt.Fprintf(os.Stderr, "meshell: %s: %s\n", argv[0], err)
+	return 126
+}
+
+//
+// times
+//
+
+func builtinTimes(sh *Shell, std *StdStreams, args []string) (RunningJob, error) {
+	// The children are only accounted for once they have been waited for.
+	for _, who := range []int{syscall.RUSAGE_SELF, syscall.RUSAGE_CHILDREN} {
+		var ru syscall.Rusage
+		if err := syscall.Getrusage(who, &ru); err != nil {
+			return nil, fmt.Errorf("times: %w", err)
+		}
+		fmt.Fprintf(std.Out, "%s %s\n", formatCPUTime(ru.Utime), formatCPUTime(ru.Stime))
+	}
+	return &ImmediateRunningJob{name: "times"}, nil
+}
+
+// formatCPUTime formats a CPU time like bash's times, e.g. 0m1.250s.
+func formatCPUTime(tv syscall.Timeval) string {
+	d := time.Duration(tv.Nano())
+	min := int(d / time.Minute)
+	sec := (d % time.Minute).Seconds()
+	return fmt.Sprintf("%dm%.3fs", min, sec)
+}
@@ -0,0 +1,516 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// defaultPath is the PATH used by command -p, which is guaranteed to find the
+// standard utilities.
+const defaultPath = "/usr/bin:/bin:/usr/sbin:/sbin"
+
+// hashTable remembers where commands were found in PATH, so that running the
+// same command again does not need to search for it.  Like jobTable, it is
+// shared with the jobs running in the background, hence the mutex.
+//
+// The entries are only valid for the value of PATH they were found with, so
+// the methods take the current PATH and empty the table if it has changed,
+// like bash does when PATH is assigned.
+type hashTable struct {
+	mutex   sync.Mutex
+	path    string // Value of PATH the entries were found with
+	entries map[string]*hashEntry
+}
+
+type hashEntry struct {
+	path string
+	hits int
+}
+
+// checkPath empties the table if path is not the one the entries were found
+// with.  The mutex must be held.
+func (t *hashTable) checkPath(path string) {
+	if path != t.path {
+		t.entries = nil
+		t.path = path
+	}
+}
+
+// Get returns the entry for the command name.
+func (t *hashTable) Get(path, name string) (hashEntry, bool) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	t.checkPath(path)
+	e, ok := t.entries[name]
+	if !ok {
+		return hashEntry{}, false
+	}
+	return *e, true
+}
+
+// Hit counts a use of the entry for the command name, if it is cmdPath.
+func (t *hashTable) Hit(path, name, cmdPath string) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	t.checkPath(path)
+	if e, ok := t.entries[name]; ok && e.path == cmdPath {
+		e.hits++
+	}
+}
+
+// Set makes cmdPath the entry for the command name.
+func (t *hashTable) Set(path, name, cmdPath string) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	t.checkPath(path)
+	if t.entries == nil {
+		t.entries = map[string]*hashEntry{}
+	}
+	t.entries[name] = &hashEntry{path: cmdPath}
+}
+
+// Delete removes the entry for the command name.  It returns false if there
+// was none.
+func (t *hashTable) Delete(path, name string) bool {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	t.checkPath(path)
+	_, ok := t.entries[name]
+	delete(t.entries, name)
+	return ok
+}
+
+// Clear removes all the entries.
+func (t *hashTable) Clear() {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	t.entries = nil
+}
+
+// Entries returns the command names in the table in sorted order, with their
+// entries.
+func (t *hashTable) Entries(path string) ([]string, map[string]hashEntry) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	t.checkPath(path)
+	names := make([]string, 0, len(t.entries))
+	entries := make(map[string]hashEntry, len(t.entries))
+	for name, e := range t.entries {
+		names = append(names, name)
+		entries[name] = *e
+	}
+	sort.Strings(names)
+	return names, entries
+}
+
+func (t *hashTable) clone() *hashTable {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	c := &hashTable{path: t.path}
+	if t.entries != nil {
+		c.entries = make(map[string]*hashEntry, len(t.entries))
+		for name, e := range t.entries {
+			e2 := *e
+			c.entries[name] = &e2
+		}
+	}
+	return c
+}
+
+// LookCommand returns the path of the executable that runs the command name.
+// Names without a slash are searched in PATH, and the result is remembered in
+// the shell's hash table.
+func (s *Shell) LookCommand(name string) (string, error) {
+	path := s.GetVar("PATH")
+	if strings.Contains(name, "/") {
+		return LookPath(path, s.GetCwd(), name)
+	}
+	t := s.hashed
+	if e, ok := t.Get(path, name); ok {
+		if findExecutable(e.path) == nil {
+			t.Hit(path, name, e.path)
+			return e.path, nil
+		}
+		t.Delete(path, name)
+	}
+	cmdPath, err := LookPath(path, s.GetCwd(), name)
+	if err != nil {
+		return "", err
+	}
+	t.Set(path, name, cmdPath)
+	t.Hit(path, name, cmdPath)
+	return cmdPath, nil
+}
+
+// startExternal starts the executable for the command name, with the
+// environment env.
+func startExternal(sh *Shell, std *StdStreams, name string, args []string, env []string) (RunningJob, error) {
+	cmdPath, err := sh.LookCommand(name)
+	if err != nil {
+		return nil, err
+	}
+	return startExecutable(sh, std, name, cmdPath, args, env)
+}
+
+func startExecutable(sh *Shell, std *StdStreams, name, cmdPath string, args []string, env []string) (RunningJob, error) {
+	cmd := newExecCmd(sh, std, cmdPath, args, env)
+	// Like other shells, pass the command name as typed in argv[0]
+	cmd.Args[0] = name
+	group, err := sh.startProcess(cmd)
+	if err != nil {
+		return nil, err
+	}
+	return &ExecJob{cmd: cmd, group: group}, nil
+}
+
+//
+// Command kinds, as reported by type and command -v
+//
+
+const (
+	kindAlias    = "alias"
+	kindKeyword  = "keyword"
+	kindFunction = "function"
+	kindBuiltin  = "builtin"
+	kindFile     = "file"
+)
+
+// commandKind describes one thing a command name can refer to.
+type commandKind struct {
+	kind   string
+	path   string // For files
+	alias  string // For aliases
+	hashed bool   // The file was found in the hash table
+}
+
+// lookupKinds returns what the command name refers to, in the order they are
+// tried when running it.  If all is false, only the first one is returned.
+// The files are found in path, or in PATH via the hash table if path is empty.
+func lookupKinds(sh *Shell, name string, all bool, path string) []commandKind {
+	var kinds []commandKind
+	add := func(k commandKind) bool {
+		kinds = append(kinds, k)
+		return !all
+	}
+	if alias, ok := sh.aliases[name]; ok {
+		if add(commandKind{kind: kindAlias, alias: alias}) {
+			return kinds
+		}
+	}
+	if _, ok := reservedWords[name]; ok {
+		if add(commandKind{kind: kindKeyword}) {
+			return kinds
+		}
+	}
+	if sh.GetFunction(name) != nil {
+		if add(commandKind{kind: kindFunction}) {
+			return kinds
+		}
+	}
+	if builtins[name] != nil {
+		if add(commandKind{kind: kindBuiltin}) {
+			return kinds
+		}
+	}
+	if !all {
+		if path == "" {
+			if e, ok := sh.hashed.Get(sh.GetVar("PATH"), name); ok {
+				return append(kinds, commandKind{kind: kindFile, path: e.path, hashed: true})
+			}
+			path = sh.GetVar("PATH")
+		}
+		if cmdPath, err := LookPath(path, sh.GetCwd(), name); err == nil {
+			kinds = append(kinds, commandKind{kind: kindFile, path: cmdPath})
+		}
+		return kinds
+	}
+	if path == "" {
+		path = sh.GetVar("PATH")
+	}
+	for _, cmdPath := range lookPathAll(path, sh.GetCwd(), name) {
+		kinds = append(kinds, commandKind{kind: kindFile, path: cmdPath})
+	}
+	return kinds
+}
+
+// lookPathAll returns all the executables called name in path.
+func lookPathAll(path, wd, name string) []string {
+	if strings.Contains(name, "/") {
+		if cmdPath, err := LookPath(path, wd, name); err == nil {
+			return []string{cmdPath}
+		}
+		return nil
+	}
+	var paths []string
+	for _, dir := range filepath.SplitList(path) {
+		if dir == "" {
+			dir = wd
+		}
+		cmdPath := filepath.Join(dir, name)
+		if findExecutable(cmdPath) == nil && !containsString(paths, cmdPath) {
+			paths = append(paths, cmdPath)
+		}
+	}
+	return paths
+}
+
+// describeKind prints what a command name refers to, as type does.
+func describeKind(std *StdStreams, name string, k commandKind) {
+	switch k.kind {
+	case kindAlias:
+		fmt.Fprintf(std.Out, "%s is aliased to `%s'\n", name, k.alias)
+	case kindKeyword:
+		fmt.Fprintf(std.Out, "%s is a shell keyword\n", name)
+	case kindFunction:
+		fmt.Fprintf(std.Out, "%s is a function\n", name)
+	case kindBuiltin:
+		fmt.Fprintf(std.Out, "%s is a shell builtin\n", name)
+	case kindFile:
+		if k.hashed {
+			fmt.Fprintf(std.Out, "%s is hashed (%s)\n", name, k.path)
+		} else {
+			fmt.Fprintf(std.Out, "%s is %s\n", name, k.path)
+		}
+	}
+}
+
+func builtinType(sh *Shell, std *StdStreams, args []string) (RunningJob, error) {
+	var all, kindOnly, pathOnly, forcePath bool
+	for len(args) > 0 && len(args[0]) > 1 && args[0][0] == '-' {
+		arg := args[0]
+		args = args[1:]
+		if arg == "--" {
+			break
+		}
+		for _, c := range arg[1:] {
+			switch c {
+			case 'a':
+				all = true
+			case 't':
+				kindOnly = true
+			case 'p':
+				pathOnly = true
+			case 'P':
+				forcePath = true
+			default:
+				fmt.Fprintf(std.Err, "meshell: type: -%c: invalid option\n", c)
+				return &ImmediateRunningJob{name: "type", outcome: JobOutcome{ExitCode: 2}}, nil
+			}
+		}
+	}
+	code := 0
+	for _, name := range args {
+		var kinds []commandKind
+		if forcePath {
+			// Only search PATH, whatever else the name refers to
+			for _, cmdPath := range lookPathAll(sh.GetVar("PATH"), sh.GetCwd(), name) {
+				kinds = append(kinds, commandKind{kind: kindFile, path: cmdPath})
+				if !all {
+					break
+				}
+			}
+		} else {
+			kinds = lookupKinds(sh, name, all, "")
+		}
+		if len(kinds) == 0 {
+			if !kindOnly && !pathOnly && !forcePath {
+				fmt.Fprintf(std.Err, "meshell: type: %s: not found\n", name)
+			}
+			code = 1
+			continue
+		}
+		for _, k := range kinds {
+			switch {
+			case kindOnly:
+				fmt.Fprintln(std.Out, k.kind)
+			case pathOnly || forcePath:
+				if k.kind == kindFile {
+					fmt.Fprintln(std.Out, k.path)
+				}
+			default:
+				describeKind(std, name, k)
+			}
+		}
+	}
+	return &ImmediateRunningJob{name: "type", outcome: JobOutcome{ExitCode: code}}, nil
+}
+
+func builtinCommand(sh *Shell, std *StdStreams, args []string) (RunningJob, error) {
+	var describe, verbose bool
+	path := ""
+	for len(args) > 0 && len(args[0]) > 1 && args[0][0] == '-' {
+		arg := args[0]
+		args = args[1:]
+		if arg == "--" {
+			break
+		}
+		for _, c := range arg[1:] {
+			switch c {
+			case 'p':
+				path = defaultPath
+			case 'v':
+				describe = true
+			case 'V':
+				verbose = true
+			default:
+				fmt.Fprintf(std.Err, "meshell: command: -%c: invalid option\n", c)
+				return &ImmediateRunningJob{name: "command", outcome: JobOutcome{ExitCode: 2}}, nil
+			}
+		}
+	}
+	if describe || verbose {
+		code := 0
+		for _, name := range args {
+			kinds := lookupKinds(sh, name, false, path)
+			if len(kinds) == 0 {
+				if verbose {
+					fmt.Fprintf(std.Err, "meshell: command: %s: not found\n", name)
+				}
+				code = 1
+				continue
+			}
+			k := kinds[0]
+			switch {
+			case verbose:
+				describeKind(std, name, k)
+			case k.kind == kindAlias:
+				fmt.Fprintf(std.Out, "alias %s=%s\n", name, shellQuote(k.alias))
+			case k.kind == kindFile:
+				fmt.Fprintln(std.Out, k.path)
+			default:
+				fmt.Fprintln(std.Out, name)
+			}
+		}
+		return &ImmediateRunningJob{name: "command", outcome: JobOutcome{ExitCode: code}}, nil
+	}
+	if len(args) == 0 {
+		return &ImmediateRunningJob{name: "command"}, nil
+	}
+	// Run the command, skipping functions
+	name := args[0]
+	if f := builtins[name]; f != nil {
+		return f(sh, std, args[1:])
+	}
+	if path == "" {
+		return startExternal(sh, std, name, args[1:], sh.Environ())
+	}
+	cmdPath, err := LookPath(path, sh.GetCwd(), name)
+	if err != nil {
+		return nil, err
+	}
+	return startExecutable(sh, std, name, cmdPath, args[1:], sh.Environ())
+}
+
+func builtinBuiltin(sh *Shell, std *StdStreams, args []string) (RunningJob, error) {
+	if len(args) > 0 && args[0] == "--" {
+		args = args[1:]
+	}
+	if len(args) == 0 {
+		return &ImmediateRunningJob{name: "builtin"}, nil
+	}
+	f := builtins[args[0]]
+	if f == nil {
+		return nil, fmt.Errorf("builtin: %s: not a shell builtin", args[0])
+	}
+	return f(sh, std, args[1:])
+}
+
+func builtinHash(sh *Shell, std *StdStreams, args []string) (RunningJob, error) {
+	var reset, del, print, list bool
+	setPath := ""
+	for len(args) > 0 && len(args[0]) > 1 && args[0][0] == '-' {
+		arg := args[0]
+		args = args[1:]
+		if arg == "--" {
+			break
+		}
+		for _, c := range arg[1:] {
+			switch c {
+			case 'r':
+				reset = true
+				sh.hashed.Clear()
+			case 'd':
+				del = true
+			case 't':
+				print = true
+			case 'l':
+				list = true
+			case 'p':
+				if len(args) == 0 {
+					return nil, errors.New("hash: -p: option requires an argument")
+				}
+				setPath = args[0]
+				args = args[1:]
+			default:
+				fmt.Fprintf(std.Err, "meshell: hash: -%c: invalid option\n", c)
+				return &ImmediateRunningJob{name: "hash", outcome: JobOutcome{ExitCode: 2}}, nil
+			}
+		}
+	}
+	if len(args) == 0 {
+		if !reset && !del && !print && setPath == "" {
+			printHashTable(sh, std, list)
+		}
+		return &ImmediateRunningJob{name: "hash"}, nil
+	}
+	t := sh.hashed
+	path := sh.GetVar("PATH")
+	code := 0
+	for _, name := range args {
+		e, ok := t.Get(path, name)
+		switch {
+		case setPath != "":
+			t.Set(path, name, setPath)
+		case del:
+			if !t.Delete(path, name) {
+				fmt.Fprintf(std.Err, "meshell: hash: %s: not found\n", name)
+				code = 1
+			}
+		case print:
+			if !ok {
+				fmt.Fprintf(std.Err, "meshell: hash: %s: not found\n", name)
+				code = 1
+			} else if len(args) > 1 {
+				fmt.Fprintf(std.Out, "%s\t%s\n", name, e.path)
+			} else {
+				fmt.Fprintln(std.Out, e.path)
+			}
+		case strings.Contains(name, "/") || builtins[name] != nil:
+			// Nothing to remember
+		default:
+			cmdPath, err := LookPath(path, sh.GetCwd(), name)
+			if err != nil {
+				fmt.Fprintf(std.Err, "meshell: hash: %s: not found\n", name)
+				code = 1
+				continue
+			}
+			t.Set(path, name, cmdPath)
+		}
+	}
+	return &ImmediateRunningJob{name: "hash", outcome: JobOutcome{ExitCode: code}}, nil
+}
+
+func printHashTable(sh *Shell, std *StdStreams, reusable bool) {
+	names, entries := sh.hashed.Entries(sh.GetVar("PATH"))
+	if len(names) == 0 {
+		if !reusable {
+			fmt.Fprintln(std.Err, "hash: hash table empty")
+		}
+		return
+	}
+	if !reusable {
+		fmt.Fprintln(std.Out, "hits\tcommand")
+	}
+	for _, name := range names {
+		e := entries[name]
+		if reusable {
+			fmt.Fprintf(std.Out, "builtin hash -p %s %s\n", e.path, name)
+		} else {
+			fmt.Fprintf(std.Out, "%4d\t%s\n", e.hits, e.path)
+		}
+	}
+}
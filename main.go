@@ -1,10 +1,10 @@
 package main
 
 import (
+	"errors"
 	"flag"
 	"fmt"
 	"io"
-	"io/ioutil"
 	"os"
 	"strings"
 
@@ -13,6 +13,9 @@ import (
 )
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == runChildArg {
+		os.Exit(runChild(os.Args[2:]))
+	}
 	os.Exit(run())
 }
 
@@ -25,8 +28,7 @@ func run() int {
 	flag.Parse()
 	var (
 		filename string
-		script   []byte
-		err      error
+		script   *scriptReader
 		args     []string
 	)
 	switch flag.NArg() {
@@ -36,54 +38,37 @@ func run() int {
 			return repl(debug, parseOpts)
 		}
 		args = []string{"meshell"}
-		script, err = ioutil.ReadAll(os.Stdin)
-		if err != nil {
-			fatal("Error reading <stdin>: %s", err)
-		}
+		// Commands in the script may read the rest of stdin
+		script = newScriptReader("", os.Stdin, false)
 	default:
 		filename = flag.Arg(0)
-		script, err = ioutil.ReadFile(filename)
+		f, err := os.Open(filename)
 		if err != nil {
 			return fatal("Error reading '%s': %s", filename, err)
 		}
+		defer f.Close()
+		script = newScriptReader(filename, f, true)
 		args = flag.Args()
 	}
-	tokenStream, err := tokeniseCommand(string(script))
-	if err != nil {
-		return fatal("error parsing %s: %s", filename, err)
-	}
-	var line Line
-	parseErr := grammar.Parse(&line, tokenStream, parseOpts...)
-	if debug {
-		tokenStream.Dump(os.Stdout)
-	}
-	if parseErr != nil {
-		return fatal("error parsing %s: %s", filename, parseErr)
-	}
-	if line.CmdList == nil {
-		return 0
-	}
-	cmdDef, err := line.CmdList.GetCommand()
-	if err != nil {
-		return fatal("error interpreting %s: %s", filename, err)
-	}
 	cwd, _ := os.Getwd()
 	shell := NewShell(args[0], args[1:], cwd)
-	job, err := cmdDef.StartJob(shell, StdStreams{
-		In:  os.Stdin,
-		Out: os.Stdout,
-		Err: os.Stderr,
-	})
-	if err == nil {
-		res := job.Wait()
-		if !res.Success() {
-			err = res
-		}
-	}
-	if err != nil {
-		return fatal("error running %s: %s", filename, err)
+	shell.ImportEnviron(os.Environ())
+	err := runScript(shell, script, shell.Streams(), debug, parseOpts)
+	var (
+		syntaxErr *SyntaxError
+		scriptErr *ScriptError
+	)
+	switch {
+	case errors.As(err, &syntaxErr) && errors.As(err, &scriptErr):
+		fatal("error parsing %s: line %d: %s\n", filename, scriptErr.Line, syntaxErr.Err)
+		shell.Exit(2)
+	case err != nil:
+		shell.Exit(fatal("error running %s: %s\n", filename, err))
+	default:
+		// Run the EXIT trap if the script did not call exit
+		shell.Exit(shell.LastExitCode())
 	}
-	return 0
+	return shell.ExitCode()
 }
 
 func isaTTY(f *os.File) bool {
@@ -98,66 +83,78 @@ func fatal(tpl string, args ...interface{}) int {
 
 func repl(debug bool, parseOpts []grammar.ParseOption) int {
 
+	// liner puts the terminal in raw mode, commands need the original one
+	origMode, _ := liner.TerminalMode()
 	linr := liner.NewLiner()
 	defer linr.Close()
 	linr.SetCtrlCAborts(true)
 	cwd, _ := os.Getwd()
 	shell := NewShell(os.Args[0], nil, cwd)
+	shell.ImportEnviron(os.Environ())
+	shell.interactive = true
+	// Job control is on by default in interactive shells
+	shell.SetOption("monitor", true)
+	ignoreStopSignals()
 outerLoop:
 	for {
+		shell.ReportDoneJobs(os.Stderr)
 		line, err := linr.Prompt(fmt.Sprintf("%s$ ", shell.GetCwd()))
 		if err == io.EOF {
 			fmt.Fprintln(os.Stdout, "\nBye!")
-			return 0
+			shell.Exit(0)
+			return shell.ExitCode()
 		} else if err != nil {
 			fmt.Println(err)
 			continue
 		}
 		for {
 			line = line + "\n"
-			tokenStream, err := tokeniseCommand(line)
-			if err != nil {
-				fmt.Println(err)
-				continue outerLoop
-			}
-			var parsedLine Line
-			parseErr := grammar.Parse(&parsedLine, tokenStream, parseOpts...)
-			if debug {
-				tokenStream.Dump(os.Stdout)
-			}
-			if parseErr == nil {
-				linr.AppendHistory(strings.TrimSpace(line))
-				if parsedLine.CmdList == nil {
-					continue outerLoop
-				}
-				cmdDef, err := parsedLine.CmdList.GetCommand()
-				if err == nil {
-					err = shell.RunCommand(cmdDef, StdStreams{
-						In:  os.Stdin,
-						Out: os.Stdout,
-						Err: os.Stderr,
-					})
-				}
-				if err != nil {
-					fmt.Println(err)
-				}
-				if shell.Exited() {
-					linr.Close()
-					os.Exit(shell.Wait())
-				}
-				continue outerLoop
-			} else if parseErr.Token == grammar.EOF {
-				more, err := linr.Prompt("> ")
+			parsedLine, err := parseInput(shell, line, debug, parseOpts)
+			var incomplete *IncompleteInputError
+			if errors.As(err, &incomplete) {
+				more, err := linr.Prompt(continuationPrompt(shell, incomplete.Waiting))
 				if err == io.EOF {
 					return 0
 				} else if err != nil {
 					panic(err)
 				}
 				line = line + more
-			} else {
-				fmt.Println(parseErr)
+				continue
+			}
+			linr.AppendHistory(strings.TrimSpace(line))
+			if err != nil {
+				fmt.Println(err)
+				continue outerLoop
+			}
+			if parsedLine.CmdList == nil {
 				continue outerLoop
 			}
+			cmdDef, err := parsedLine.CmdList.GetCommand()
+			if err == nil {
+				if origMode != nil {
+					origMode.ApplyMode()
+				}
+				err = shell.RunCommand(cmdDef, shell.Streams())
+			}
+			if err != nil {
+				fmt.Println(err)
+			}
+			if shell.Exited() {
+				linr.Close()
+				os.Exit(shell.Wait())
+			}
+			continue outerLoop
 		}
 	}
 }
+
+// continuationPrompt returns the prompt to show when more input is needed.
+// Like zsh, it says what the shell is waiting for.  It can be customised with
+// the PS2 variable, where %_ stands for the list of open constructs.
+func continuationPrompt(sh *Shell, waiting []string) string {
+	ps2 := sh.GetVar("PS2")
+	if ps2 == "" {
+		ps2 = "%_> "
+	}
+	return strings.ReplaceAll(ps2, "%_", strings.Join(waiting, " "))
+}
@@ -1,6 +1,8 @@
 package main
 
 import (
+	"fmt"
+	"strconv"
 	"strings"
 
 	"github.com/arnodel/grammar"
@@ -40,21 +42,21 @@ func (c *CmdList) GetCommand() (Command, error) {
 
 type CmdListItem struct {
 	grammar.Seq
-	Cmd CmdLogical
-	Op  Token `tok:"term|nl|closebrace*|closebkt*|EOF*"`
+	Cmd ListCmd
+	Op  Token `tok:"term|nl|closebrace*|closebkt*|kw*|EOF*"`
 }
 
 func (c *CmdListItem) GetCommand() (Command, error) {
-	cmd, err := c.Cmd.GetCommand()
+	cmd, err := c.Cmd.Cmd.GetCommand()
 	if err != nil {
 		return nil, err
 	}
-	if c.Op.Type() == "EOF" {
+	if c.Op.Type() == "EOF" || c.Op.Type() == "kw" {
 		return cmd, nil
 	}
 	switch c.Op.Value()[0] {
 	case '&':
-		return &BackgroundCommand{Cmd: cmd}, nil
+		return &BackgroundCommand{Cmd: cmd, Source: c.Cmd.Source}, nil
 	case '\n', ';', '}', ')':
 		return cmd, nil
 	default:
@@ -62,6 +64,21 @@ func (c *CmdListItem) GetCommand() (Command, error) {
 	}
 }
 
+// ListCmd is a command in a list.  Its source is kept so that the jobs builtin
+// can show it if it is run in the background.
+type ListCmd struct {
+	Cmd    CmdLogical
+	Source string
+}
+
+var _ grammar.Parser = (*ListCmd)(nil)
+
+func (c *ListCmd) Parse(_ interface{}, s *grammar.ParserState, opts grammar.TokenOptions) *grammar.ParseError {
+	src, err := parseWithSource(&c.Cmd, s, opts)
+	c.Source = src
+	return err
+}
+
 type CmdLogical struct {
 	grammar.Seq
 	First Pipeline
@@ -104,18 +121,53 @@ type NextPipeline struct {
 
 type PipelineItem struct {
 	grammar.OneOf
-	Simple       *SimpleCmd
+	Simple   *SimpleCmd
+	Compound *CompoundCmd
+}
+
+func (i *PipelineItem) GetCommand() (Command, error) {
+	switch {
+	case i.Simple != nil:
+		return i.Simple.GetCommand()
+	case i.Compound != nil:
+		return i.Compound.GetCommand()
+	default:
+		panic("bug!")
+	}
+}
+
+// CompoundCmd is a compound command optionally followed by redirections, which
+// apply to the whole command (e.g. `while read l; do ...; done <input.txt`).
+type CompoundCmd struct {
+	grammar.Seq `drop:"spc"`
+	Cmd         CompoundItem
+	Redirects   []Redirect `sep:"spc"`
+}
+
+func (c *CompoundCmd) GetCommand() (Command, error) {
+	cmd, err := c.Cmd.GetCommand()
+	if err != nil {
+		return nil, err
+	}
+	redirects := make([]*Redirect, len(c.Redirects))
+	for i := range c.Redirects {
+		redirects[i] = &c.Redirects[i]
+	}
+	return wrapRedirects(cmd, redirects)
+}
+
+type CompoundItem struct {
+	grammar.OneOf
 	Group        *CmdGroup
 	Subshell     *Subshell
 	IfStmt       *IfStmt
 	WhileStmt    *WhileStmt
 	FunctionStmt *FunctionStmt
+	CoprocStmt   *CoprocStmt
 }
 
-func (i *PipelineItem) GetCommand() (Command, error) {
+func (i *CompoundItem) GetCommand() (Command, error) {
 	switch {
-	case i.Simple != nil:
-		return i.Simple.GetCommand()
 	case i.Group != nil:
 		return i.Group.GetCommand()
 	case i.Subshell != nil:
@@ -126,6 +178,8 @@ func (i *PipelineItem) GetCommand() (Command, error) {
 		return i.WhileStmt.GetCommand()
 	case i.FunctionStmt != nil:
 		return i.FunctionStmt.GetCommand()
+	case i.CoprocStmt != nil:
+		return i.CoprocStmt.GetCommand()
 	default:
 		panic("bug!")
 	}
@@ -163,13 +217,13 @@ type SimpleCmd struct {
 	Parts       []CmdPart    `sep:"spc"`
 }
 
-func (c *SimpleCmd) sortParts() ([]*Value, []*Redirect) {
-	var vals []*Value
+func (c *SimpleCmd) sortParts() ([]*CmdPart, []*Redirect) {
+	var vals []*CmdPart
 	var redirects []*Redirect
-	for _, part := range c.Parts {
+	for i, part := range c.Parts {
 		switch {
-		case part.Value != nil:
-			vals = append(vals, part.Value)
+		case part.Value != nil || part.Compound != nil:
+			vals = append(vals, &c.Parts[i])
 		case part.Redirect != nil:
 			redirects = append(redirects, part.Redirect)
 		default:
@@ -183,12 +237,68 @@ type CmdPart struct {
 	grammar.OneOf
 	Value    *Value
 	Redirect *Redirect
+	Compound *CompoundArg
+}
+
+func (p *CmdPart) Eval() (ValueDef, error) {
+	if p.Compound != nil {
+		return p.Compound.Eval()
+	}
+	return p.Value.Eval()
+}
+
+// CompoundArg is a compound assignment passed as an argument to a
+// declaration builtin, e.g. declare -a arr=(a b c).  The builtin gets it as
+// name=(...) with the elements quoted.
+type CompoundArg struct {
+	grammar.Seq
+	Dest  Token `tok:"assign"`
+	Array ArrayLiteral
+}
+
+func (a *CompoundArg) Eval() (ValueDef, error) {
+	elems, err := a.Array.Eval()
+	if err != nil {
+		return nil, err
+	}
+	return CompositeValueDef{Parts: []ValueDef{
+		LiteralValueDef{Val: a.Dest.Value()},
+		elems,
+	}}, nil
+}
+
+// declarationBuiltins are the builtins which accept compound assignments as
+// arguments.
+var declarationBuiltins = map[string]bool{
+	"declare":  true,
+	"export":   true,
+	"local":    true,
+	"readonly": true,
+	"typeset":  true,
 }
 
 type Redirect struct {
 	grammar.Seq `drop:"spc"`
 	Op          Token `tok:"redirect"`
-	File        Value
+	Target      RedirectTarget
+}
+
+// RedirectTarget is a file name or fd, or the body of a here-document.
+type RedirectTarget struct {
+	grammar.OneOf
+	File    *Value
+	HereDoc *Token `tok:"heredoc|rawheredoc"`
+}
+
+func (t *RedirectTarget) Eval() (ValueDef, error) {
+	switch {
+	case t.File != nil:
+		return t.File.Eval()
+	case t.HereDoc.Type() == "rawheredoc":
+		return LiteralValueDef{Val: t.HereDoc.Value()}, nil
+	default:
+		return parseHereDoc(t.HereDoc.Value())
+	}
 }
 
 func (c *SimpleCmd) GetCommand() (Command, error) {
@@ -203,13 +313,21 @@ func (c *SimpleCmd) GetCommand() (Command, error) {
 	}
 	env := make([]AssignDef, len(c.Assignments))
 	for i, a := range c.Assignments {
-		val, err := a.Value.Eval()
+		def, err := a.Eval()
 		if err != nil {
 			return nil, err
 		}
-		env[i] = AssignDef{
-			Name: getAssignDest(a.Dest.Value()),
-			Val:  val,
+		if len(parts) > 0 && (def.Sub != nil || a.Array != nil) {
+			return nil, fmt.Errorf("%s: array assignments cannot precede a command", getAssignDest(a.Dest.Value()))
+		}
+		env[i] = def
+	}
+	for _, arg := range args {
+		if arg.Compound == nil {
+			continue
+		}
+		if name, ok := parts[0].(LiteralValueDef); !ok || !declarationBuiltins[name.Val] {
+			return nil, fmt.Errorf("%s: compound assignments are only allowed as arguments of declaration builtins", getAssignDest(arg.Compound.Dest.Value()))
 		}
 	}
 	var cmd Command
@@ -217,6 +335,20 @@ func (c *SimpleCmd) GetCommand() (Command, error) {
 		cmd = &SetVarsCommand{
 			Assigns: env,
 		}
+	} else if name, ok := parts[0].(LiteralValueDef); ok && name.Val == "exec" {
+		// exec is special as its redirections may outlive it
+		execCmd := &ExecCommand{
+			Args:    parts[1:],
+			Assigns: env,
+		}
+		for _, r := range redirects {
+			redirect, err := newRedirectCommand(r, nil)
+			if err != nil {
+				return nil, err
+			}
+			execCmd.Redirects = append(execCmd.Redirects, redirect)
+		}
+		return execCmd, nil
 	} else {
 		cmd = &SimpleCommand{
 			CmdName: parts[0],
@@ -224,47 +356,134 @@ func (c *SimpleCmd) GetCommand() (Command, error) {
 			Assigns: env,
 		}
 	}
+	return wrapRedirects(cmd, redirects)
+}
+
+// wrapRedirects returns cmd wrapped in RedirectCommands so that the
+// redirections are performed from left to right.
+func wrapRedirects(cmd Command, redirects []*Redirect) (Command, error) {
 	for i := len(redirects) - 1; i >= 0; i-- {
-		r := redirects[i]
-		repl, err := r.File.Eval()
+		redirect, err := newRedirectCommand(redirects[i], cmd)
 		if err != nil {
 			return nil, err
 		}
-		op, fd, ref := splitRedirect(r.Op.Value())
-		var mode int
-		switch op {
-		case ">":
-			if fd == -1 {
-				fd = 1
-			}
-			mode = RM_Truncate
-		case ">>":
-			if fd == -1 {
-				fd = 1
-			}
-			fd = 1
-			mode = RM_Append
-		case "<":
-			fd = 0
-			mode = RM_Read
-		default:
-			panic("bug!")
-		}
-		cmd = &RedirectCommand{
-			Cmd:         cmd,
-			Replacement: repl,
-			FD:          fd,
-			Mode:        mode,
-			Ref:         ref,
-		}
+		cmd = redirect
 	}
 	return cmd, nil
 }
 
+func newRedirectCommand(r *Redirect, cmd Command) (*RedirectCommand, error) {
+	repl, err := r.Target.Eval()
+	if err != nil {
+		return nil, err
+	}
+	fd, fdVar, op := splitRedirect(r.Op.Value())
+	redirect := &RedirectCommand{
+		Cmd:         cmd,
+		Replacement: repl,
+		FDVar:       fdVar,
+	}
+	switch op {
+	case ">", ">|", "&>":
+		redirect.FD = 1
+		redirect.Mode = RM_Truncate
+		if op == ">|" {
+			redirect.Mode = RM_Clobber
+		}
+		redirect.Both = op == "&>"
+	case ">>", "&>>":
+		redirect.FD = 1
+		redirect.Mode = RM_Append
+		redirect.Both = op == "&>>"
+	case "<":
+		redirect.FD = 0
+		redirect.Mode = RM_Read
+	case "<>":
+		redirect.FD = 0
+		redirect.Mode = RM_ReadWrite
+	case "<<", "<<-":
+		redirect.FD = 0
+		redirect.Mode = RM_HereDoc
+	case ">&":
+		redirect.FD = 1
+		redirect.Ref = true
+	case "<&":
+		redirect.FD = 0
+		redirect.Ref = true
+	default:
+		panic("bug!")
+	}
+	if fd != -1 {
+		redirect.FD = fd
+	}
+	return redirect, nil
+}
+
 type Assignment struct {
 	grammar.Seq
 	Dest  Token `tok:"assign"`
-	Value Value
+	Array *ArrayLiteral
+	Value *Value
+}
+
+func (a *Assignment) Eval() (AssignDef, error) {
+	name, sub, hasSub := splitSubscript(getAssignDest(a.Dest.Value()))
+	def := AssignDef{Name: name, Val: LiteralValueDef{}}
+	if hasSub {
+		subDef, err := parseWord(sub)
+		if err != nil {
+			return def, err
+		}
+		def.Sub = subDef
+	}
+	var err error
+	switch {
+	case a.Array != nil && (hasSub || a.Value != nil):
+		return def, fmt.Errorf("%s: bad compound assignment", getAssignDest(a.Dest.Value()))
+	case a.Array != nil:
+		def.Val, err = a.Array.Eval()
+	case a.Value != nil:
+		def.Val, err = a.Value.Eval()
+	}
+	return def, err
+}
+
+// ArrayLiteral is the value of a compound assignment, e.g. (a b [5]=c).
+type ArrayLiteral struct {
+	grammar.Seq `drop:"spc"`
+	Open        Token       `tok:"openbkt"`
+	Elems       []ArrayElem `sep:"spc"`
+	Close       Token       `tok:"closebkt"`
+}
+
+func (a *ArrayLiteral) Eval() (CompoundValueDef, error) {
+	var def CompoundValueDef
+	for _, e := range a.Elems {
+		var elem CompoundElemDef
+		var err error
+		if e.Sub != nil {
+			sub := e.Sub.Value()
+			if elem.Sub, err = parseWord(sub[1 : len(sub)-2]); err != nil {
+				return def, err
+			}
+			elem.Val = LiteralValueDef{}
+		}
+		if e.Value != nil {
+			if elem.Val, err = e.Value.Eval(); err != nil {
+				return def, err
+			}
+		}
+		def.Elems = append(def.Elems, elem)
+	}
+	return def, nil
+}
+
+// ArrayElem is an element of an array literal, optionally preceded by its
+// subscript as in [sub]=value.
+type ArrayElem struct {
+	grammar.Seq
+	Sub   *Token `tok:"subassign"`
+	Value *Value
 }
 
 type IfStmt struct {
@@ -363,7 +582,7 @@ type FunctionStmt struct {
 	OpenBkt     Token `tok:"openbkt"`
 	CloseBkt    Token `tok:"closebkt"`
 
-	Body PipelineItem
+	Body FunctionBody
 }
 
 func (s *FunctionStmt) GetCommand() (Command, error) {
@@ -371,16 +590,87 @@ func (s *FunctionStmt) GetCommand() (Command, error) {
 	if err != nil {
 		return nil, err
 	}
-	body, err := s.Body.GetCommand()
+	body, err := s.Body.Cmd.GetCommand()
 	if err != nil {
 		return nil, err
 	}
 	return &FunctionDefCommand{
-		Name: name,
-		Body: body,
+		Name:   name,
+		Body:   body,
+		Source: s.Body.Source,
 	}, nil
 }
 
+// FunctionBody is the body of a function definition.  Its source is kept so
+// that declare -f can print it.
+type FunctionBody struct {
+	Cmd    PipelineItem
+	Source string
+}
+
+var _ grammar.Parser = (*FunctionBody)(nil)
+
+func (b *FunctionBody) Parse(_ interface{}, s *grammar.ParserState, opts grammar.TokenOptions) *grammar.ParseError {
+	src, err := parseWithSource(&b.Cmd, s, opts)
+	b.Source = src
+	return err
+}
+
+// parseWithSource parses dest and returns the source of the tokens it was
+// parsed from.  That requires parsing by hand as the parser does not keep
+// track of where rules start and end.
+func parseWithSource(dest interface{}, s *grammar.ParserState, opts grammar.TokenOptions) (string, *grammar.ParseError) {
+	start := s.Save()
+	if err := grammar.ParseWithOptions(dest, s, opts); err != nil {
+		return "", err
+	}
+	end := s.Save()
+	s.Restore(start)
+	toks := make([]grammar.Token, 0, end-start)
+	for s.Save() < end {
+		toks = append(toks, s.Next())
+	}
+	return tokenSource(toks), nil
+}
+
+type CoprocStmt struct {
+	grammar.Seq `drop:"spc"`
+	Coproc      Token `tok:"kw,coproc"`
+	Body        CoprocBody
+}
+
+// CoprocBody is either a name followed by a compound command, or a command
+// (in which case the default name COPROC is used).
+type CoprocBody struct {
+	grammar.OneOf
+	Named *NamedCoprocBody
+	Cmd   *PipelineItem
+}
+
+type NamedCoprocBody struct {
+	grammar.Seq `drop:"spc"`
+	Name        Token `tok:"lit"`
+	Cmd         CompoundCmd
+}
+
+func (s *CoprocStmt) GetCommand() (Command, error) {
+	var (
+		name = "COPROC"
+		body Command
+		err  error
+	)
+	if s.Body.Named != nil {
+		name = s.Body.Named.Name.Value()
+		body, err = s.Body.Named.Cmd.GetCommand()
+	} else {
+		body, err = s.Body.Cmd.GetCommand()
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &CoprocCommand{Name: name, Body: body}, nil
+}
+
 type Pipeline struct {
 	grammar.Seq `drop:"spc"`
 	Start       *grammar.Empty
@@ -395,6 +685,14 @@ func (c *Pipeline) GetCommand() (Command, error) {
 		return nil, err
 	}
 	for _, pipe := range c.Pipes {
+		if strings.HasPrefix(pipe.Pipe.Value(), "|&") {
+			// |& also pipes stderr of the command on its left
+			if p, ok := cmd.(*PipelineCommand); ok {
+				p.Right = stderrToStdout(p.Right)
+			} else {
+				cmd = stderrToStdout(cmd)
+			}
+		}
 		right, err := pipe.Cmd.GetCommand()
 		if err != nil {
 			return nil, err
@@ -404,6 +702,15 @@ func (c *Pipeline) GetCommand() (Command, error) {
 	return cmd, nil
 }
 
+func stderrToStdout(cmd Command) Command {
+	return &RedirectCommand{
+		FD:          2,
+		Replacement: LiteralValueDef{Val: "1"},
+		Ref:         true,
+		Cmd:         cmd,
+	}
+}
+
 type PipedCmd struct {
 	grammar.Seq
 	Pipe Token `tok:"pipe"`
@@ -417,16 +724,28 @@ type Value struct {
 
 func (v *Value) Eval() (ValueDef, error) {
 	if len(v.Components) == 1 {
+		if d, ok := v.Components[0].evalTilde(true); ok {
+			return d, nil
+		}
 		return v.Components[0].Eval()
 	}
 	components := make([]ValueDef, len(v.Components))
 	for i, c := range v.Components {
+		if d, ok := c.evalTilde(false); ok && i == 0 {
+			components[i] = d
+			continue
+		}
 		v, err := c.Eval()
 		if err != nil {
 			return nil, err
 		}
 		components[i] = v
 	}
+	// Glob qualifiers apply to the whole word, e.g. $d/*(/)
+	if g, ok := components[len(components)-1].(GlobValueDef); ok {
+		g.Prefix = CompositeValueDef{Parts: components[:len(components)-1]}
+		return g, nil
+	}
 	return CompositeValueDef{Parts: components}, nil
 }
 
@@ -453,6 +772,34 @@ func (v *SingleValue) Eval() (ValueDef, error) {
 	}
 }
 
+// evalTilde returns a TildeValueDef if v is an unquoted literal starting with
+// a tilde prefix.  If v is not the whole word, the prefix must be followed by
+// a slash, otherwise the rest of the word would be part of it.
+func (v *SingleValue) evalTilde(whole bool) (ValueDef, bool) {
+	if v.StringChunk == nil || v.StringChunk.Lit == nil {
+		return nil, false
+	}
+	raw := v.StringChunk.Lit.Value()
+	if raw == "" || raw[0] != '~' {
+		return nil, false
+	}
+	end := strings.IndexByte(raw, '/')
+	if end == -1 {
+		if !whole {
+			return nil, false
+		}
+		end = len(raw)
+	}
+	prefix := raw[1:end]
+	if strings.ContainsAny(prefix, "\\*?[") {
+		return nil, false
+	}
+	return TildeValueDef{
+		Prefix: prefix,
+		Rest:   LiteralValueDef{Val: UnescapeLiteral(raw[end:], false), Expand: whole},
+	}, true
+}
+
 type DollarStmt struct {
 	grammar.Seq
 	Open  Token `tok:"dollarbkt"`
@@ -470,12 +817,20 @@ func (s *DollarStmt) Eval() (ValueDef, error) {
 
 type DollarBrace struct {
 	grammar.Seq
-	Open      Token `tok:"dollarbrace"`
-	ParamName Token `tok:"name|argnum|special"`
-	Close     Token `tok:"closebrace"`
+	Open      Token  `tok:"dollarbrace"`
+	ParamName Token  `tok:"name|argnum|special"`
+	Subscript *Token `tok:"subscript"`
+	Close     Token  `tok:"closebrace"`
 }
 
 func (s *DollarBrace) Eval() (ValueDef, error) {
+	if s.Subscript != nil {
+		sub := s.Subscript.Value()
+		return ArrayValueDef{
+			Name:  s.ParamName.Value(),
+			Index: sub[1 : len(sub)-1],
+		}, nil
+	}
 	return ParamValueDef(s.ParamName.Value())
 }
 
@@ -504,6 +859,7 @@ type StringChunk struct {
 	DollarStmt  *DollarStmt
 	DollarBrace *DollarBrace
 	Param       *Token `tok:"envvar|specialvar"`
+	GlobQual    *Token `tok:"globqual"`
 }
 
 func (c *StringChunk) Eval(inString bool) (ValueDef, error) {
@@ -516,6 +872,13 @@ func (c *StringChunk) Eval(inString bool) (ValueDef, error) {
 		return c.DollarBrace.Eval()
 	case c.Param != nil:
 		return ParamValueDef(c.Param.Value()[1:])
+	case c.GlobQual != nil:
+		word := c.GlobQual.Value()
+		i := strings.IndexByte(word, '(')
+		return GlobValueDef{
+			Pattern:    UnescapeLiteral(word[:i], false),
+			Qualifiers: word[i+1 : len(word)-1],
+		}, nil
 	default:
 		panic("bug!")
 	}
@@ -525,16 +888,88 @@ func getAssignDest(s string) string {
 	return s[:len(s)-1]
 }
 
-func splitRedirect(op string) (string, int, bool) {
-	origFd := -1
-	if op[0] >= '0' && op[0] <= '9' {
-		origFd = int(op[0] - '0')
-		op = op[1:]
+// parseWord parses src as a single word, e.g. the subscript in an assignment
+// to an array element.
+func parseWord(src string) (ValueDef, error) {
+	if src == "" {
+		return LiteralValueDef{}, nil
+	}
+	stream, err := tokeniseCommand(src)
+	if err != nil {
+		return nil, err
+	}
+	toks, _, err := (&wordPass{}).run(drainTokens(stream), lexState{}, nil)
+	if err != nil {
+		return nil, err
+	}
+	var word Value
+	if parseErr := grammar.Parse(&word, grammar.NewSimpleTokenStream(toks)); parseErr != nil {
+		return nil, parseErr
+	}
+	return word.Eval()
+}
+
+// tokenSource returns source code that tokenises to toks.  The blanks after
+// an opening brace have been removed and here-documents have been moved into
+// their redirections, so they are put back.
+func tokenSource(toks []grammar.Token) string {
+	var (
+		b    strings.Builder
+		docs []string // Here-documents to write after the current line
+	)
+	writeDocs := func() {
+		for _, doc := range docs {
+			b.WriteString("\n")
+			b.WriteString(doc)
+		}
+		docs = nil
+	}
+	for _, tok := range toks {
+		switch tok.Type() {
+		case "openbrace":
+			b.WriteString("{ ")
+		case "heredoc", "rawheredoc":
+			body := tok.Value()
+			if !strings.HasSuffix(body, "\n") {
+				body += "\n"
+			}
+			delim := "EOF"
+			for strings.Contains("\n"+body, "\n"+delim+"\n") {
+				delim += "_"
+			}
+			if tok.Type() == "rawheredoc" {
+				b.WriteString("'" + delim + "'")
+			} else {
+				b.WriteString(delim)
+			}
+			docs = append(docs, body+delim)
+		case "nl":
+			writeDocs()
+			b.WriteString(tok.Value())
+		default:
+			b.WriteString(tok.Value())
+		}
+	}
+	writeDocs()
+	return strings.TrimSpace(b.String())
+}
+
+// splitRedirect splits a redirection operator such as "2>>" or "{fd}<&" into
+// the file descriptor it applies to (-1 if not specified), the name of the
+// variable to store an allocated file descriptor in (empty if not specified)
+// and the operator itself.
+func splitRedirect(op string) (int, string, string) {
+	fd := -1
+	if op[0] == '{' {
+		end := strings.IndexByte(op, '}')
+		return fd, op[1:end], op[end+1:]
+	}
+	i := 0
+	for i < len(op) && op[i] >= '0' && op[i] <= '9' {
+		i++
 	}
-	l := len(op) - 1
-	ref := op[l] == '&'
-	if ref {
-		op = op[:l]
+	if i > 0 {
+		fd, _ = strconv.Atoi(op[:i])
 	}
-	return op, origFd, ref
+	return fd, "", op[i:]
 }
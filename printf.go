@@ -0,0 +1,518 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+func builtinEcho(sh *Shell, std *StdStreams, args []string) (RunningJob, error) {
+	var newline, escapes = true, false
+	for len(args) > 0 && isEchoOptions(args[0]) {
+		for _, c := range args[0][1:] {
+			switch c {
+			case 'n':
+				newline = false
+			case 'e':
+				escapes = true
+			case 'E':
+				escapes = false
+			}
+		}
+		args = args[1:]
+	}
+	out := strings.Join(args, " ")
+	if escapes {
+		var stop bool
+		out, stop = expandEscapes(out, true)
+		if stop {
+			newline = false
+		}
+	}
+	if newline {
+		out += "\n"
+	}
+	if _, err := std.Out.Write([]byte(out)); err != nil {
+		return nil, fmt.Errorf("echo: %w", err)
+	}
+	return &ImmediateRunningJob{name: "echo"}, nil
+}
+
+// isEchoOptions returns true if arg is a valid option argument for echo.
+// Anything else, including "-" and "--", is printed.
+func isEchoOptions(arg string) bool {
+	if len(arg) < 2 || arg[0] != '-' {
+		return false
+	}
+	return strings.Trim(arg[1:], "neE") == ""
+}
+
+func builtinPrintf(sh *Shell, std *StdStreams, args []string) (RunningJob, error) {
+	var varName string
+	if len(args) >= 2 && args[0] == "-v" {
+		varName = args[1]
+		if !isName(varName) {
+			return nil, fmt.Errorf("printf: `%s': not a valid identifier", varName)
+		}
+		args = args[2:]
+	}
+	if len(args) > 0 && args[0] == "--" {
+		args = args[1:]
+	}
+	if len(args) == 0 {
+		return nil, errors.New("printf: usage: printf [-v var] format [arguments]")
+	}
+	p := &printer{sh: sh, std: std, format: args[0], args: args[1:]}
+	for {
+		if err := p.printFormat(); err != nil {
+			fmt.Fprintf(std.Err, "meshell: printf: %s\n", err)
+			p.failed = true
+			break
+		}
+		// The format is reused as long as it consumes some arguments
+		if p.stop || p.used == 0 || len(p.args) == 0 {
+			break
+		}
+	}
+	code := 0
+	if p.failed {
+		code = 1
+	}
+	if varName != "" {
+		if err := sh.SetVar(varName, p.out.String()); err != nil {
+			return nil, fmt.Errorf("printf: %w", err)
+		}
+	} else if _, err := std.Out.Write([]byte(p.out.String())); err != nil {
+		return nil, fmt.Errorf("printf: %w", err)
+	}
+	return &ImmediateRunningJob{name: "printf", outcome: JobOutcome{ExitCode: code}}, nil
+}
+
+type printer struct {
+	sh     *Shell
+	std    *StdStreams
+	format string
+	args   []string
+	used   int  // Number of arguments consumed by the current pass
+	stop   bool // Set by \c in a %b argument
+	failed bool // Set if an argument could not be converted
+	out    strings.Builder
+}
+
+// printFormat makes one pass through the format, consuming arguments as
+// required by the conversion specifications.
+func (p *printer) printFormat() error {
+	p.used = 0
+	format := p.format
+	for format != "" && !p.stop {
+		i := strings.IndexAny(format, `%\`)
+		if i == -1 {
+			p.out.WriteString(format)
+			break
+		}
+		p.out.WriteString(format[:i])
+		format = format[i:]
+		if format[0] == '\\' {
+			n := escapeLen(format, false)
+			s, stop := expandEscapes(format[:n], false)
+			p.out.WriteString(s)
+			p.stop = stop
+			format = format[n:]
+			continue
+		}
+		rest, err := p.printConversion(format[1:])
+		if err != nil {
+			return err
+		}
+		format = rest
+	}
+	return nil
+}
+
+// printConversion prints one conversion specification, the text following
+// "%" in spec, and returns the remaining format.
+func (p *printer) printConversion(spec string) (string, error) {
+	if strings.HasPrefix(spec, "%") {
+		p.out.WriteByte('%')
+		return spec[1:], nil
+	}
+	var verb strings.Builder
+	verb.WriteByte('%')
+	i := 0
+	for i < len(spec) && strings.IndexByte("-+ #0", spec[i]) != -1 {
+		verb.WriteByte(spec[i])
+		i++
+	}
+	if i < len(spec) && spec[i] == '*' {
+		// A negative width means left-justified, which is also what Go's
+		// fmt makes of it.
+		verb.WriteString(strconv.Itoa(int(p.nextInt())))
+		i++
+	} else {
+		for i < len(spec) && spec[i] >= '0' && spec[i] <= '9' {
+			verb.WriteByte(spec[i])
+			i++
+		}
+	}
+	if i < len(spec) && spec[i] == '.' {
+		verb.WriteByte('.')
+		i++
+		if i < len(spec) && spec[i] == '*' {
+			prec := p.nextInt()
+			if prec < 0 {
+				prec = 0
+			}
+			verb.WriteString(strconv.Itoa(int(prec)))
+			i++
+		} else {
+			for i < len(spec) && spec[i] >= '0' && spec[i] <= '9' {
+				verb.WriteByte(spec[i])
+				i++
+			}
+		}
+	}
+	if i >= len(spec) {
+		return "", errors.New("missing format character")
+	}
+	flags := verb.String()
+	c := spec[i]
+	rest := spec[i+1:]
+	switch c {
+	case 'd', 'i':
+		fmt.Fprintf(&p.out, flags+"d", p.nextInt())
+	case 'o', 'u', 'x', 'X':
+		v := c
+		if c == 'u' {
+			v = 'd'
+		}
+		fmt.Fprintf(&p.out, flags+string(v), uint64(p.nextInt()))
+	case 'e', 'E', 'f', 'F', 'g', 'G':
+		fmt.Fprintf(&p.out, flags+string(c), p.nextFloat())
+	case 'a', 'A':
+		v := byte('x')
+		if c == 'A' {
+			v = 'X'
+		}
+		fmt.Fprintf(&p.out, flags+string(v), p.nextFloat())
+	case 'c':
+		arg := p.nextString()
+		if arg != "" {
+			_, n := utf8.DecodeRuneInString(arg)
+			arg = arg[:n]
+		}
+		fmt.Fprintf(&p.out, flags+"s", arg)
+	case 's':
+		fmt.Fprintf(&p.out, flags+"s", p.nextString())
+	case 'b':
+		s, stop := expandEscapes(p.nextString(), true)
+		fmt.Fprintf(&p.out, flags+"s", s)
+		p.stop = stop
+	case 'q':
+		fmt.Fprintf(&p.out, flags+"s", quoteIfNeeded(p.nextString()))
+	case '(':
+		j := strings.Index(rest, ")T")
+		if j == -1 {
+			return "", errors.New("`(': missing time format")
+		}
+		t := p.nextTime()
+		fmt.Fprintf(&p.out, flags+"s", strftime(rest[:j], t))
+		rest = rest[j+2:]
+	default:
+		return "", fmt.Errorf("`%c': invalid format character", c)
+	}
+	return rest, nil
+}
+
+func (p *printer) nextString() string {
+	if len(p.args) == 0 {
+		return ""
+	}
+	arg := p.args[0]
+	p.args = p.args[1:]
+	p.used++
+	return arg
+}
+
+// nextInt converts the next argument to an integer.  As in C, a leading quote
+// means the code of the following character.
+func (p *printer) nextInt() int64 {
+	arg := p.nextString()
+	if arg == "" {
+		return 0
+	}
+	if arg[0] == '\'' || arg[0] == '"' {
+		r, _ := utf8.DecodeRuneInString(arg[1:])
+		return int64(r)
+	}
+	n, err := strconv.ParseInt(strings.TrimSpace(arg), 0, 64)
+	if err != nil {
+		u, uerr := strconv.ParseUint(strings.TrimSpace(arg), 0, 64)
+		if uerr == nil {
+			return int64(u)
+		}
+		p.invalid(arg, "invalid number")
+	}
+	return n
+}
+
+func (p *printer) nextFloat() float64 {
+	arg := p.nextString()
+	if arg == "" {
+		return 0
+	}
+	if arg[0] == '\'' || arg[0] == '"' {
+		r, _ := utf8.DecodeRuneInString(arg[1:])
+		return float64(r)
+	}
+	f, err := strconv.ParseFloat(strings.TrimSpace(arg), 64)
+	if err != nil {
+		p.invalid(arg, "invalid number")
+	}
+	return f
+}
+
+// nextTime converts the next argument to a time for %(fmt)T.  The argument is
+// a number of seconds since the epoch, -1 for now or -2 for when the shell
+// started.  A missing argument means now.
+func (p *printer) nextTime() time.Time {
+	if len(p.args) == 0 {
+		return time.Now()
+	}
+	switch n := p.nextInt(); n {
+	case -1:
+		return time.Now()
+	case -2:
+		return p.sh.startTime
+	default:
+		return time.Unix(n, 0)
+	}
+}
+
+func (p *printer) invalid(arg, msg string) {
+	p.failed = true
+	fmt.Fprintf(p.std.Err, "meshell: printf: %s: %s\n", arg, msg)
+}
+
+// quoteIfNeeded quotes s for %q so that the shell would read it back as a
+// single word.
+func quoteIfNeeded(s string) string {
+	if s == "" {
+		return "''"
+	}
+	for i := 0; i < len(s); i++ {
+		if !isNameChar(s[i]) && strings.IndexByte("-+./,:=@%^", s[i]) == -1 {
+			return shellQuote(s)
+		}
+	}
+	return s
+}
+
+// escapeLen returns the length of the escape sequence at the start of s.
+func escapeLen(s string, echo bool) int {
+	if len(s) < 2 {
+		return len(s)
+	}
+	n := 2
+	maxDigits := 0
+	isDigit := func(c byte) bool { return c >= '0' && c <= '7' }
+	switch c := s[1]; {
+	case c == '0' && echo:
+		maxDigits = 3
+	case isDigit(c) && !echo:
+		maxDigits = 2
+	case c == 'x':
+		maxDigits = 2
+		isDigit = isHexDigit
+	case c == 'u':
+		maxDigits = 4
+		isDigit = isHexDigit
+	case c == 'U':
+		maxDigits = 8
+		isDigit = isHexDigit
+	}
+	for i := 0; i < maxDigits && n < len(s) && isDigit(s[n]); i++ {
+		n++
+	}
+	return n
+}
+
+func isHexDigit(c byte) bool {
+	return c >= '0' && c <= '9' || c >= 'a' && c <= 'f' || c >= 'A' && c <= 'F'
+}
+
+// expandEscapes replaces backslash escape sequences in s.  With echo set,
+// octal escapes are written \0nnn as for echo -e and %b, otherwise \nnn as in
+// printf formats.  The returned bool is true if s contained \c, in which case
+// the output stops there.
+func expandEscapes(s string, echo bool) (string, bool) {
+	var b strings.Builder
+	for s != "" {
+		i := strings.IndexByte(s, '\\')
+		if i == -1 {
+			b.WriteString(s)
+			break
+		}
+		b.WriteString(s[:i])
+		s = s[i:]
+		n := escapeLen(s, echo)
+		seq := s[:n]
+		s = s[n:]
+		if n < 2 {
+			b.WriteString(seq)
+			continue
+		}
+		switch c := seq[1]; c {
+		case 'a':
+			b.WriteByte('\a')
+		case 'b':
+			b.WriteByte('\b')
+		case 'c':
+			return b.String(), true
+		case 'e', 'E':
+			b.WriteByte(0x1b)
+		case 'f':
+			b.WriteByte('\f')
+		case 'n':
+			b.WriteByte('\n')
+		case 'r':
+			b.WriteByte('\r')
+		case 't':
+			b.WriteByte('\t')
+		case 'v':
+			b.WriteByte('\v')
+		case '\\':
+			b.WriteByte('\\')
+		case 'x', 'u', 'U':
+			if len(seq) == 2 {
+				b.WriteString(seq)
+				break
+			}
+			v, _ := strconv.ParseUint(seq[2:], 16, 32)
+			if c == 'x' {
+				b.WriteByte(byte(v))
+			} else {
+				b.WriteRune(rune(v))
+			}
+		default:
+			if c >= '0' && c <= '7' && (!echo || c == '0') {
+				digits := seq[1:]
+				if echo {
+					digits = seq[2:]
+				}
+				v, _ := strconv.ParseUint("0"+digits, 8, 16)
+				b.WriteByte(byte(v))
+			} else if !echo && (c == '"' || c == '\'') {
+				b.WriteByte(c)
+			} else {
+				b.WriteString(seq)
+			}
+		}
+	}
+	return b.String(), false
+}
+
+var (
+	shortDays   = []string{"Sun", "Mon", "Tue", "Wed", "Thu", "Fri", "Sat"}
+	shortMonths = []string{"Jan", "Feb", "Mar", "Apr", "May", "Jun", "Jul", "Aug", "Sep", "Oct", "Nov", "Dec"}
+)
+
+// strftime formats t like the C function of the same name.
+func strftime(format string, t time.Time) string {
+	var b strings.Builder
+	for i := 0; i < len(format); i++ {
+		c := format[i]
+		if c != '%' || i+1 == len(format) {
+			b.WriteByte(c)
+			continue
+		}
+		i++
+		switch format[i] {
+		case 'a':
+			b.WriteString(shortDays[t.Weekday()])
+		case 'A':
+			b.WriteString(t.Weekday().String())
+		case 'b', 'h':
+			b.WriteString(shortMonths[t.Month()-1])
+		case 'B':
+			b.WriteString(t.Month().String())
+		case 'c':
+			b.WriteString(t.Format("Mon Jan _2 15:04:05 2006"))
+		case 'C':
+			fmt.Fprintf(&b, "%02d", t.Year()/100)
+		case 'd':
+			fmt.Fprintf(&b, "%02d", t.Day())
+		case 'D', 'x':
+			b.WriteString(t.Format("01/02/06"))
+		case 'e':
+			fmt.Fprintf(&b, "%2d", t.Day())
+		case 'F':
+			b.WriteString(t.Format("2006-01-02"))
+		case 'g':
+			year, _ := t.ISOWeek()
+			fmt.Fprintf(&b, "%02d", year%100)
+		case 'G':
+			year, _ := t.ISOWeek()
+			fmt.Fprintf(&b, "%d", year)
+		case 'H':
+			fmt.Fprintf(&b, "%02d", t.Hour())
+		case 'I':
+			fmt.Fprintf(&b, "%02d", (t.Hour()+11)%12+1)
+		case 'j':
+			fmt.Fprintf(&b, "%03d", t.YearDay())
+		case 'k':
+			fmt.Fprintf(&b, "%2d", t.Hour())
+		case 'l':
+			fmt.Fprintf(&b, "%2d", (t.Hour()+11)%12+1)
+		case 'm':
+			fmt.Fprintf(&b, "%02d", t.Month())
+		case 'M':
+			fmt.Fprintf(&b, "%02d", t.Minute())
+		case 'n':
+			b.WriteByte('\n')
+		case 'p':
+			b.WriteString(t.Format("PM"))
+		case 'P':
+			b.WriteString(t.Format("pm"))
+		case 'r':
+			b.WriteString(t.Format("03:04:05 PM"))
+		case 'R':
+			b.WriteString(t.Format("15:04"))
+		case 's':
+			fmt.Fprintf(&b, "%d", t.Unix())
+		case 'S':
+			fmt.Fprintf(&b, "%02d", t.Second())
+		case 't':
+			b.WriteByte('\t')
+		case 'T', 'X':
+			b.WriteString(t.Format("15:04:05"))
+		case 'u':
+			fmt.Fprintf(&b, "%d", (int(t.Weekday())+6)%7+1)
+		case 'U':
+			fmt.Fprintf(&b, "%02d", (t.YearDay()+6-int(t.Weekday()))/7)
+		case 'V':
+			_, week := t.ISOWeek()
+			fmt.Fprintf(&b, "%02d", week)
+		case 'w':
+			fmt.Fprintf(&b, "%d", t.Weekday())
+		case 'W':
+			fmt.Fprintf(&b, "%02d", (t.YearDay()+6-(int(t.Weekday())+6)%7)/7)
+		case 'y':
+			fmt.Fprintf(&b, "%02d", t.Year()%100)
+		case 'Y':
+			fmt.Fprintf(&b, "%d", t.Year())
+		case 'z':
+			b.WriteString(t.Format("-0700"))
+		case 'Z':
+			b.WriteString(t.Format("MST"))
+		case '%':
+			b.WriteByte('%')
+		default:
+			b.WriteByte('%')
+			b.WriteByte(format[i])
+		}
+	}
+	return b.String()
+}
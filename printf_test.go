@@ -0,0 +1,87 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestPrintf(t *testing.T) {
+	tests := []struct {
+		args []string
+		out  string
+		code int
+	}{
+		{[]string{"%s-%d\\n", "a", "3"}, "a-3\n", 0},
+		// The format is reused until the arguments are used up
+		{[]string{"%s\\n", "a", "b"}, "a\nb\n", 0},
+		{[]string{"%s %s\\n", "a", "b", "c"}, "a b\nc \n", 0},
+		// Missing arguments are empty or zero
+		{[]string{"%s|%d|"}, "|0|", 0},
+		{[]string{"%%"}, "%", 0},
+		{[]string{"%-4s|", "ab"}, "ab  |", 0},
+		{[]string{"%.3s", "abcdef"}, "abc", 0},
+		{[]string{"%c", "hello"}, "h", 0},
+		{[]string{"%*d", "5", "42"}, "   42", 0},
+		{[]string{"%05d", "-42"}, "-0042", 0},
+		{[]string{"%+d", "5"}, "+5", 0},
+		{[]string{"%x", "255"}, "ff", 0},
+		{[]string{"%X|%o", "255", "8"}, "FF|10", 0},
+		{[]string{"%i", "0x10"}, "16", 0},
+		{[]string{"%d", "077"}, "63", 0},
+		{[]string{"%u", "-1"}, "18446744073709551615", 0},
+		// A leading quote gives the code of the next character
+		{[]string{"%d", "'A"}, "65", 0},
+		{[]string{"%5.2f", "3.14159"}, " 3.14", 0},
+		{[]string{"%e", "1500"}, "1.500000e+03", 0},
+		{[]string{"%q", "a b"}, "'a b'", 0},
+		{[]string{"%(%s)T", "12345"}, "12345", 0},
+		// Escapes are expanded in the format and in %b arguments
+		{[]string{"\\101\\x42"}, "AB", 0},
+		{[]string{"%b", "a\\tb"}, "a\tb", 0},
+		// \c stops the output, in the format as in %b arguments
+		{[]string{"a\\cb"}, "a", 0},
+		{[]string{"%b|%s", "x\\cy", "z"}, "x", 0},
+		// Invalid numbers are reported and printed as 0
+		{[]string{"%d", "abc"}, "0", 1},
+		{[]string{"%z"}, "", 1},
+	}
+	for _, test := range tests {
+		sh := NewShell("meshell", nil, t.TempDir())
+		out, _, code := runBuiltin(t, sh, builtinPrintf, test.args)
+		if out != test.out || code != test.code {
+			t.Errorf("printf %q: got %q with exit code %d, want %q with exit code %d", test.args, out, code, test.out, test.code)
+		}
+	}
+}
+
+func TestPrintfVar(t *testing.T) {
+	sh := NewShell("meshell", nil, t.TempDir())
+	out, _, code := runBuiltin(t, sh, builtinPrintf, []string{"-v", "v", "%s=%d", "x", "1"})
+	if out != "" || code != 0 {
+		t.Errorf("printf -v: got %q with exit code %d, want no output", out, code)
+	}
+	if got := sh.GetVar("v"); got != "x=1" {
+		t.Errorf("printf -v: v is %q, want %q", got, "x=1")
+	}
+}
+
+func TestStrftime(t *testing.T) {
+	tests := []struct {
+		time   time.Time
+		format string
+		want   string
+	}{
+		{
+			time.Date(2024, 3, 5, 19, 8, 9, 0, time.UTC),
+			"%Y-%m-%d %H:%M:%S|%a %b %e|%A %B|%j|%I %p|%l|%D|%F %T|%u %w|%U %V %W|%C %g %G|%s|%%",
+			"2024-03-05 19:08:09|Tue Mar  5|Tuesday March|065|07 PM| 7|03/05/24|2024-03-05 19:08:09|2 2|09 10 10|20 24 2024|1709665689|%",
+		},
+		{time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC), "%U %V %W %G %g", "00 01 01 2024 24"},
+		{time.Date(2021, 1, 3, 0, 0, 0, 0, time.UTC), "%U %V %W %G %g", "01 53 00 2020 20"},
+	}
+	for _, test := range tests {
+		if got := strftime(test.format, test.time); got != test.want {
+			t.Errorf("strftime(%q, %s) = %q, want %q", test.format, test.time, got, test.want)
+		}
+	}
+}
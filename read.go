@@ -0,0 +1,312 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"golang.org/x/sys/unix"
+)
+
+// readTimeoutExitCode is the exit code of read when it times out, as in bash.
+const readTimeoutExitCode = 142
+
+type readOptions struct {
+	raw     bool
+	prompt  string
+	array   string
+	delim   byte
+	nchars  int // Stop after this many characters if > 0
+	timeout time.Duration
+	poll    bool // -t 0: only check whether there is input
+	silent  bool
+	fd      int
+}
+
+func builtinRead(sh *Shell, std *StdStreams, args []string) (RunningJob, error) {
+	opts, names, err := parseReadOptions(args)
+	if err != nil {
+		return nil, err
+	}
+	for _, name := range names {
+		if !isName(name) {
+			return nil, fmt.Errorf("read: `%s': not a valid identifier", name)
+		}
+	}
+	r, ok := std.Get(opts.fd).(io.Reader)
+	if !ok {
+		return nil, fmt.Errorf("read: %d: invalid file descriptor", opts.fd)
+	}
+	f, _ := r.(*os.File)
+	tty := f != nil && isTerminal(f.Fd())
+	if opts.poll {
+		code := 0
+		if f != nil && !inputReady(f, 0) {
+			code = 1
+		}
+		return &ImmediateRunningJob{name: "read", outcome: JobOutcome{ExitCode: code}}, nil
+	}
+	if tty && opts.prompt != "" {
+		fmt.Fprint(std.Err, opts.prompt)
+	}
+	if tty && (opts.silent || opts.nchars > 0) {
+		restore, err := setTermMode(f.Fd(), !opts.silent, opts.nchars == 0)
+		if err == nil {
+			defer restore()
+		}
+	}
+	lr := &lineReader{r: r, f: f}
+	if opts.timeout > 0 {
+		lr.deadline = time.Now().Add(opts.timeout)
+	}
+	line, escaped, readErr := lr.readLine(opts)
+	code := 0
+	switch {
+	case readErr == errReadTimeout:
+		code = readTimeoutExitCode
+	case readErr == io.EOF:
+		code = 1
+	case readErr != nil:
+		return nil, fmt.Errorf("read: %w", readErr)
+	}
+	if err := assignReadFields(sh, opts, names, line, escaped); err != nil {
+		return nil, fmt.Errorf("read: %w", err)
+	}
+	return &ImmediateRunningJob{name: "read", outcome: JobOutcome{ExitCode: code}}, nil
+}
+
+func parseReadOptions(args []string) (opts readOptions, names []string, err error) {
+	opts.delim = '\n'
+	for len(args) > 0 && len(args[0]) > 1 && args[0][0] == '-' {
+		arg := args[0]
+		args = args[1:]
+		if arg == "--" {
+			break
+		}
+		for i := 1; i < len(arg); i++ {
+			c := arg[i]
+			switch c {
+			case 'r':
+				opts.raw = true
+				continue
+			case 's':
+				opts.silent = true
+				continue
+			case 'p', 'a', 'd', 'n', 't', 'u':
+			default:
+				return opts, nil, fmt.Errorf("read: -%c: invalid option", c)
+			}
+			// The option takes a value, either the rest of arg or the
+			// next argument.
+			val := arg[i+1:]
+			if val == "" {
+				if len(args) == 0 {
+					return opts, nil, fmt.Errorf("read: -%c: option requires an argument", c)
+				}
+				val = args[0]
+				args = args[1:]
+			}
+			switch c {
+			case 'p':
+				opts.prompt = val
+			case 'a':
+				opts.array = val
+			case 'd':
+				opts.delim = 0
+				if val != "" {
+					opts.delim = val[0]
+				}
+			case 'n':
+				opts.nchars, err = strconv.Atoi(val)
+				if err != nil || opts.nchars < 0 {
+					return opts, nil, fmt.Errorf("read: %s: invalid number", val)
+				}
+			case 't':
+				secs, err := strconv.ParseFloat(val, 64)
+				if err != nil || secs < 0 {
+					return opts, nil, fmt.Errorf("read: %s: invalid timeout specification", val)
+				}
+				opts.timeout = time.Duration(secs * float64(time.Second))
+				opts.poll = secs == 0
+			case 'u':
+				opts.fd, err = strconv.Atoi(val)
+				if err != nil || opts.fd < 0 {
+					return opts, nil, fmt.Errorf("read: %s: invalid file descriptor specification", val)
+				}
+			}
+			break
+		}
+	}
+	return opts, args, nil
+}
+
+var errReadTimeout = errors.New("timeout")
+
+// A lineReader reads one byte at a time so that it never consumes input past
+// the delimiter, as the rest of the stream belongs to the commands that
+// follow.
+type lineReader struct {
+	r        io.Reader
+	f        *os.File // Set if r is a file, so that it can be polled
+	deadline time.Time
+}
+
+func (r *lineReader) readByte() (byte, error) {
+	if r.f != nil && !r.deadline.IsZero() {
+		wait := time.Until(r.deadline)
+		if wait <= 0 || !inputReady(r.f, wait) {
+			return 0, errReadTimeout
+		}
+	}
+	var b [1]byte
+	for {
+		n, err := r.r.Read(b[:])
+		if n == 1 {
+			return b[0], nil
+		}
+		if err != nil {
+			return 0, err
+		}
+	}
+}
+
+// readLine reads up to the delimiter, or the number of characters in
+// opts.nchars.  Unless opts.raw is set, a backslash quotes the following
+// character and a backslash-newline pair is removed.  The second return value
+// tells which bytes of the line were quoted.
+func (r *lineReader) readLine(opts readOptions) ([]byte, []bool, error) {
+	var (
+		line    []byte
+		escaped []bool
+		nchars  int
+		pending int // Bytes of an incomplete UTF-8 sequence
+		quote   bool
+	)
+	for opts.nchars == 0 || nchars < opts.nchars {
+		b, err := r.readByte()
+		if err != nil {
+			return line, escaped, err
+		}
+		switch {
+		case quote:
+			quote = false
+			if b == '\n' {
+				continue
+			}
+			line = append(line, b)
+			escaped = append(escaped, true)
+		case b == opts.delim:
+			return line, escaped, nil
+		case b == '\\' && !opts.raw:
+			quote = true
+			continue
+		default:
+			line = append(line, b)
+			escaped = append(escaped, false)
+		}
+		pending++
+		if utf8.FullRune(line[len(line)-pending:]) {
+			pending = 0
+			nchars++
+		}
+	}
+	return line, escaped, nil
+}
+
+// inputReady waits up to timeout for f to have input available.
+func inputReady(f *os.File, timeout time.Duration) bool {
+	fds := []unix.PollFd{{Fd: int32(f.Fd()), Events: unix.POLLIN}}
+	for {
+		n, err := unix.Poll(fds, int(timeout/time.Millisecond))
+		if err == unix.EINTR {
+			continue
+		}
+		// If f cannot be polled, just read from it
+		return err != nil || n > 0
+	}
+}
+
+func assignReadFields(sh *Shell, opts readOptions, names []string, line []byte, escaped []bool) error {
+	ifs := " \t\n"
+	if v := sh.lookupVar("IFS"); v != nil {
+		ifs = v.Value
+	}
+	if opts.array != "" {
+		sh.SetArray(opts.array, splitReadFields(line, escaped, ifs, 0))
+		return nil
+	}
+	if len(names) == 0 {
+		return sh.SetVar("REPLY", string(line))
+	}
+	fields := splitReadFields(line, escaped, ifs, len(names))
+	for i, name := range names {
+		val := ""
+		if i < len(fields) {
+			val = fields[i]
+		}
+		if err := sh.SetVar(name, val); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// splitReadFields splits line into fields separated by the characters in ifs
+// that are not quoted.  Whitespace in ifs is trimmed from the fields and
+// sequences of it count as one separator.  If max > 0, the last field is the
+// remainder of the line once max-1 fields have been split off.
+func splitReadFields(line []byte, escaped []bool, ifs string, max int) []string {
+	isSep := func(i int) bool {
+		return !escaped[i] && strings.IndexByte(ifs, line[i]) != -1
+	}
+	isSpace := func(i int) bool {
+		return isSep(i) && strings.IndexByte(" \t\n", line[i]) != -1
+	}
+	// skipSep returns the position after the separator starting at i
+	skipSep := func(i int) int {
+		for i < len(line) && isSpace(i) {
+			i++
+		}
+		if i < len(line) && isSep(i) {
+			i++
+			for i < len(line) && isSpace(i) {
+				i++
+			}
+		}
+		return i
+	}
+	fieldEnd := func(i int) int {
+		for i < len(line) && !isSep(i) {
+			i++
+		}
+		return i
+	}
+	var fields []string
+	i := 0
+	for i < len(line) && isSpace(i) {
+		i++
+	}
+	for i < len(line) {
+		if max > 0 && len(fields) == max-1 {
+			end := len(line)
+			for end > i && isSpace(end-1) {
+				end--
+			}
+			// A single field followed by a separator loses the separator
+			if j := fieldEnd(i); j < end && skipSep(j) >= end {
+				end = j
+			}
+			fields = append(fields, string(line[i:end]))
+			break
+		}
+		j := fieldEnd(i)
+		fields = append(fields, string(line[i:j]))
+		i = skipSep(j)
+	}
+	return fields
+}
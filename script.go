@@ -0,0 +1,219 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/arnodel/grammar"
+)
+
+// A scriptReader reads a script one line at a time.  When unbuffered, it reads
+// one byte at a time so that it never consumes input beyond the current line.
+// This is needed when the script is read from the shell's standard input,
+// because commands in the script may read the rest of it.
+type scriptReader struct {
+	name string // Used in error messages if not empty
+	line int    // Number of lines read so far
+	r    io.Reader
+	buf  *bufio.Reader
+}
+
+func newScriptReader(name string, r io.Reader, buffered bool) *scriptReader {
+	sr := &scriptReader{name: name, r: r}
+	if buffered {
+		sr.buf = bufio.NewReader(r)
+	}
+	return sr
+}
+
+// ReadLine returns the next line including its terminating newline.  At the
+// end of the input it returns what is left and io.EOF.
+func (r *scriptReader) ReadLine() (string, error) {
+	r.line++
+	if r.buf != nil {
+		return r.buf.ReadString('\n')
+	}
+	var (
+		line []byte
+		b    [1]byte
+	)
+	for {
+		n, err := r.r.Read(b[:])
+		if n == 1 {
+			line = append(line, b[0])
+			if b[0] == '\n' {
+				return string(line), nil
+			}
+		}
+		if err != nil {
+			return string(line), err
+		}
+	}
+}
+
+// A ScriptError is an error in a script, with the line where the command
+// causing it starts.
+type ScriptError struct {
+	Name string
+	Line int
+	Err  error
+}
+
+func (e *ScriptError) Error() string {
+	return fmt.Sprintf("%s: %s", e.Pos(), e.Err)
+}
+
+// Pos returns the position of the error, e.g. "foo.sh: line 3".
+func (e *ScriptError) Pos() string {
+	if e.Name == "" {
+		return fmt.Sprintf("line %d", e.Line)
+	}
+	return fmt.Sprintf("%s: line %d", e.Name, e.Line)
+}
+
+func (e *ScriptError) Unwrap() error {
+	return e.Err
+}
+
+// runScript reads commands from r and runs each one before reading the next,
+// so that running a command can affect how the following ones are parsed (e.g.
+// by defining aliases).  Commands already run are not undone if a syntax error
+// is found later in the script.  It stops early if the script calls exit, or
+// return when it is sourced.
+func runScript(sh *Shell, r *scriptReader, std *StdStreams, debug bool, parseOpts []grammar.ParseOption) error {
+	var (
+		src       string
+		startLine int
+	)
+	savedPos := sh.scriptPos
+	defer func() { sh.scriptPos = savedPos }()
+	for !sh.ShouldStop() {
+		line, readErr := r.ReadLine()
+		if readErr != nil && readErr != io.EOF {
+			return readErr
+		}
+		atEOF := readErr == io.EOF
+		if sh.Option("verbose") {
+			fmt.Fprint(std.Err, line)
+		}
+		if src == "" {
+			startLine = r.line
+		}
+		src += line
+		if src == "" {
+			return nil
+		}
+		parsedLine, err := parseInput(sh, src, debug, parseOpts)
+		if err != nil {
+			var incomplete *IncompleteInputError
+			if errors.As(err, &incomplete) {
+				if !atEOF {
+					continue
+				}
+				err = &SyntaxError{Err: err}
+			}
+			return &ScriptError{Name: r.name, Line: startLine, Err: err}
+		}
+		src = ""
+		if parsedLine.CmdList != nil && !sh.Option("noexec") {
+			cmd, err := parsedLine.CmdList.GetCommand()
+			if err != nil {
+				return &ScriptError{Name: r.name, Line: startLine, Err: err}
+			}
+			pos := &ScriptError{Name: r.name, Line: startLine}
+			sh.scriptPos = pos.Pos()
+			if err := sh.RunCommand(cmd, std); err != nil {
+				pos.Err = err
+				fmt.Fprintf(std.Err, "meshell: %s\n", pos)
+			}
+		}
+		if atEOF {
+			return nil
+		}
+	}
+	return nil
+}
+
+func builtinSource(sh *Shell, std *StdStreams, args []string) (RunningJob, error) {
+	if len(args) == 0 {
+		return nil, errors.New("source: filename argument required")
+	}
+	path, err := findSourceFile(sh, args[0])
+	if err != nil {
+		return nil, fmt.Errorf("source: %w", err)
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("source: %w", err)
+	}
+	defer f.Close()
+	// Extra arguments replace the positional parameters while the script runs
+	if len(args) > 1 {
+		savedArgs := sh.GetArgs()
+		sh.SetArgs(args[1:])
+		defer sh.SetArgs(savedArgs)
+	}
+	sh.PushSource()
+	err = runScript(sh, newScriptReader(args[0], f, true), std, false, nil)
+	code, returned := sh.PopSource()
+	var syntaxErr *SyntaxError
+	switch {
+	case errors.As(err, &syntaxErr):
+		fmt.Fprintf(std.Err, "meshell: %s\n", err)
+		code = 2
+	case err != nil:
+		return nil, err
+	case !returned:
+		code = sh.LastExitCode()
+	}
+	return &ImmediateRunningJob{name: "source", outcome: JobOutcome{ExitCode: code}}, nil
+}
+
+// findSourceFile finds the script to source.  A name without a slash is
+// searched for in PATH, then in the current directory.
+func findSourceFile(sh *Shell, name string) (string, error) {
+	if !strings.ContainsRune(name, '/') {
+		for _, dir := range filepath.SplitList(sh.GetVar("PATH")) {
+			path := filepath.Join(sh.AbsPath(dir), name)
+			if fi, err := os.Stat(path); err == nil && fi.Mode().IsRegular() {
+				return path, nil
+			}
+		}
+	}
+	path := sh.AbsPath(name)
+	if _, err := os.Stat(path); err != nil {
+		return "", fmt.Errorf("%s: file not found", name)
+	}
+	return path, nil
+}
+
+func builtinEval(sh *Shell, std *StdStreams, args []string) (RunningJob, error) {
+	src := strings.Join(args, " ")
+	if strings.TrimSpace(src) == "" {
+		return &ImmediateRunningJob{name: "eval"}, nil
+	}
+	line, err := parseInput(sh, src+"\n", false, nil)
+	if err != nil {
+		var incomplete *IncompleteInputError
+		if errors.As(err, &incomplete) {
+			err = &SyntaxError{Err: err}
+		}
+		fmt.Fprintf(std.Err, "meshell: eval: %s\n", err)
+		return &ImmediateRunningJob{name: "eval", outcome: JobOutcome{ExitCode: 2}}, nil
+	}
+	if line.CmdList == nil {
+		return &ImmediateRunningJob{name: "eval"}, nil
+	}
+	cmd, err := line.CmdList.GetCommand()
+	if err != nil {
+		return nil, fmt.Errorf("eval: %w", err)
+	}
+	// The command runs in the current shell, so that e.g. return in the
+	// evaluated code returns from the calling function.
+	return cmd.StartJob(sh, std)
+}
@@ -5,38 +5,81 @@ import (
 	"fmt"
 	"os"
 	"os/signal"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
 )
 
 type Shell struct {
 	name                string
 	args                []string
 	cwd                 string
-	globals             map[string]string
-	functions           map[string]Command
+	globals             map[string]*Variable
+	functions           map[string]*Function
 	done                chan struct{}
+	stopOnce            sync.Once
 	exited              bool
 	exitCode            int
-	exported            []string
 	frames              []Frame
 	lastCommandExitCode int
+	shopts              map[string]bool
+	options             map[string]bool
+	fds                 *StdStreams
+	ownedFiles          map[*os.File]bool // Files opened by exec or coproc
+	privateFiles        map[*os.File]bool // Files not inherited by child processes
+	subshell            bool
+	jobs                jobTable
+	aliases             map[string]string
+	sources             []*sourceCtx // Scripts being run by source, innermost last
+	scriptPos           string       // Position of the script command being run, for error messages
+	interactive         bool
+	traps               map[string]string // Commands set by trap, by signal name
+	caughtSignals       chan os.Signal    // Trapped signals waiting for their trap to run
+	inTrap              int               // Number of traps being run
+	lastBackgroundPid   int               // Value of $!, 0 if no job was started
+	group               *processGroup     // Process group for the job being run, if job control is on
+	dirStack            []string          // Directory stack of pushd and popd, without the current directory
+	hashed              *hashTable        // Paths of the commands found in PATH
+	getopts             getoptsState
+	startTime           time.Time
+	umask               uint32                 // File-creation mask (see setUmask)
+	rlimits             map[int]syscall.Rlimit // Resource limits set by ulimit, by resource
 }
 
 type Frame struct {
-	name       string
-	args       []string
-	locals     map[string]string
-	returned   bool
-	returnCode int
+	name         string
+	args         []string
+	locals       map[string]*Variable
+	savedOptions map[string]bool // Set by "local -", restored on return
+	returned     bool
+	returnCode   int
 }
 
 func NewShell(name string, args []string, cwd string) *Shell {
 	return &Shell{
-		name:      name,
-		args:      args,
-		cwd:       cwd,
-		globals:   map[string]string{},
-		done:      make(chan struct{}),
-		functions: map[string]Command{},
+		name:          name,
+		args:          args,
+		cwd:           cwd,
+		globals:       map[string]*Variable{"OPTIND": {Value: "1"}},
+		done:          make(chan struct{}),
+		functions:     map[string]*Function{},
+		shopts:        map[string]bool{},
+		options:       map[string]bool{},
+		ownedFiles:    map[*os.File]bool{},
+		privateFiles:  map[*os.File]bool{},
+		aliases:       map[string]string{},
+		traps:         map[string]string{},
+		hashed:        &hashTable{},
+		caughtSignals: make(chan os.Signal, 32),
+		startTime:     time.Now(),
+		fds:           NewStdStreams(os.Stdin, os.Stdout, os.Stderr),
+		umask:         atomic.LoadUint32(&processUmask),
+		rlimits:       map[int]syscall.Rlimit{},
 	}
 }
 
@@ -58,10 +101,63 @@ func (s *Shell) PopFrame() (int, bool) {
 		panic("no frame to pop")
 	}
 	s.frames = s.frames[:len(s.frames)-1]
+	if f.savedOptions != nil {
+		s.options = f.savedOptions
+	}
+	s.RunTrap(trapReturn)
 	return f.returnCode, f.returned
 }
 
+// SaveOptions arranges for the shell options to be restored when the current
+// function returns.
+func (s *Shell) SaveOptions() {
+	f := s.currentFrame()
+	if f == nil || f.savedOptions != nil {
+		return
+	}
+	f.savedOptions = make(map[string]bool, len(s.options))
+	for k, v := range s.options {
+		f.savedOptions[k] = v
+	}
+}
+
+// A sourceCtx records a script being run by source, which return can stop
+// like a function.
+type sourceCtx struct {
+	depth      int // Number of frames when the script was sourced
+	returned   bool
+	returnCode int
+}
+
+// PushSource starts running a sourced script.
+func (s *Shell) PushSource() {
+	s.sources = append(s.sources, &sourceCtx{depth: len(s.frames)})
+}
+
+// PopSource finishes running a sourced script.  It returns the code passed
+// to return and whether it was called.
+func (s *Shell) PopSource() (int, bool) {
+	src := s.sources[len(s.sources)-1]
+	s.sources = s.sources[:len(s.sources)-1]
+	s.RunTrap(trapReturn)
+	return src.returnCode, src.returned
+}
+
+// currentSource returns the sourced script return applies to, i.e. the
+// innermost one if no function has been called since it was sourced.
+func (s *Shell) currentSource() *sourceCtx {
+	if n := len(s.sources); n > 0 && s.sources[n-1].depth == len(s.frames) {
+		return s.sources[n-1]
+	}
+	return nil
+}
+
 func (s *Shell) Return(code int) error {
+	if src := s.currentSource(); src != nil {
+		src.returnCode = code
+		src.returned = true
+		return nil
+	}
 	f := s.currentFrame()
 	if f == nil {
 		return errors.New("no function to return from")
@@ -72,6 +168,9 @@ func (s *Shell) Return(code int) error {
 }
 
 func (s *Shell) Returned() bool {
+	if src := s.currentSource(); src != nil {
+		return src.returned
+	}
 	f := s.currentFrame()
 	return f != nil && f.returned
 }
@@ -117,6 +216,15 @@ func (s *Shell) GetArgs() []string {
 	return s.args
 }
 
+// SetArgs replaces the positional parameters.
+func (s *Shell) SetArgs(args []string) {
+	if f := s.currentFrame(); f != nil {
+		f.args = args
+	} else {
+		s.args = args
+	}
+}
+
 func (s *Shell) ShiftArgs(n int) {
 	f := s.currentFrame()
 	if f != nil {
@@ -126,67 +234,635 @@ func (s *Shell) ShiftArgs(n int) {
 	}
 }
 
+// A Variable is a shell variable with its attributes.  Arrays are variables
+// too, so that they can be local to a function.
+type Variable struct {
+	Value string
+	Attrs VarAttrs
+	Array indexedArray      // Elements of an indexed array, nil otherwise
+	Assoc map[string]string // Elements of an associative array, nil otherwise
+}
+
+// isArray returns true if v is an indexed or associative array.
+func (v *Variable) isArray() bool {
+	return v.Array != nil || v.Assoc != nil
+}
+
+// clone returns a copy of v which does not share its elements.
+func (v *Variable) clone() *Variable {
+	c := *v
+	if v.Array != nil {
+		c.Array = make(indexedArray, len(v.Array))
+		for i, val := range v.Array {
+			c.Array[i] = val
+		}
+	}
+	if v.Assoc != nil {
+		c.Assoc = copyAssoc(v.Assoc)
+	}
+	return &c
+}
+
+// VarAttrs are the attributes of a variable, set with declare.
+type VarAttrs uint
+
+const (
+	VarInteger  VarAttrs = 1 << iota // Assignments are evaluated arithmetically
+	VarExport                        // Passed to child processes
+	VarReadonly                      // Cannot be assigned or unset
+	VarLower                         // Assignments are converted to lower case
+	VarUpper                         // Assignments are converted to upper case
+)
+
+// lookupVar returns the variable called name in the current scope, or nil if
+// there is none.  Scoping is dynamic: the locals of the calling functions are
+// visible, starting with the innermost.
+func (s *Shell) lookupVar(name string) *Variable {
+	for i := len(s.frames) - 1; i >= 0; i-- {
+		if v, ok := s.frames[i].locals[name]; ok {
+			return v
+		}
+	}
+	return s.globals[name]
+}
+
+// variable returns the variable called name in the current scope, creating a
+// global one if there is none.
+func (s *Shell) variable(name string) *Variable {
+	v := s.lookupVar(name)
+	if v == nil {
+		v = &Variable{}
+		s.globals[name] = v
+	}
+	return v
+}
+
 func (s *Shell) GetVar(name string) string {
-	var (
-		val string
-		ok  bool
-		f   = s.currentFrame()
-	)
-	if f != nil {
-		val, ok = f.locals[name]
+	v := s.lookupVar(name)
+	switch {
+	case v == nil:
+		return ""
+	case v.Array != nil:
+		return v.Array[0]
+	case v.Assoc != nil:
+		return v.Assoc["0"]
 	}
-	if !ok {
-		val, ok = s.globals[name]
+	return v.Value
+}
+
+// GetArray returns the elements of the array variable name, or nil if it is
+// not an array.  The elements of an associative array are sorted by key.
+func (s *Shell) GetArray(name string) []string {
+	v := s.lookupVar(name)
+	switch {
+	case v == nil:
+		return nil
+	case v.Assoc != nil:
+		keys := sortedKeys(v.Assoc)
+		vals := make([]string, len(keys))
+		for i, k := range keys {
+			vals[i] = v.Assoc[k]
+		}
+		return vals
+	case v.Array != nil:
+		return v.Array.values()
+	}
+	return nil
+}
+
+// getIndexedArray returns the indexed array called name, or nil if there is
+// none.
+func (s *Shell) getIndexedArray(name string) indexedArray {
+	if v := s.lookupVar(name); v != nil {
+		return v.Array
 	}
+	return nil
+}
+
+// GetAssoc returns the associative array called name, or nil if there is none.
+func (s *Shell) GetAssoc(name string) map[string]string {
+	if v := s.lookupVar(name); v != nil {
+		return v.Assoc
+	}
+	return nil
+}
+
+// SetAssoc makes name an associative array with the given elements.  A
+// variable with that name keeps its scope and attributes.
+func (s *Shell) SetAssoc(name string, vals map[string]string) {
+	v := s.variable(name)
+	v.Value, v.Array, v.Assoc = "", nil, vals
+}
+
+// getVarRef returns the value of a variable reference, which can be a name or
+// an array element (e.g. "COPROC[1]").
+func getVarRef(sh *Shell, ref string) string {
+	if i := strings.IndexByte(ref, '['); i > 0 && strings.HasSuffix(ref, "]") {
+		v, _ := ArrayValueDef{Name: ref[:i], Index: ref[i+1 : len(ref)-1]}.Value(sh, nil)
+		return v
+	}
+	return sh.GetVar(ref)
+}
+
+// SetArray makes name an array variable with the given elements.
+func (s *Shell) SetArray(name string, vals []string) {
+	arr := make(indexedArray, len(vals))
+	for i, val := range vals {
+		arr[int64(i)] = val
+	}
+	s.setIndexedArray(name, arr)
+}
+
+func (s *Shell) setIndexedArray(name string, arr indexedArray) {
+	v := s.variable(name)
+	v.Value, v.Array, v.Assoc = "", arr, nil
+}
+
+// An indexedArray holds the elements of an indexed array by index.  Indexed
+// arrays are sparse, e.g. after a=(x y); a[5]=z there are three elements.
+type indexedArray map[int64]string
+
+// indexes returns the indexes of the elements of arr in increasing order.
+func (arr indexedArray) indexes() []int64 {
+	idxs := make([]int64, 0, len(arr))
+	for i := range arr {
+		idxs = append(idxs, i)
+	}
+	sort.Slice(idxs, func(i, j int) bool { return idxs[i] < idxs[j] })
+	return idxs
+}
+
+// values returns the elements of arr in index order.
+func (arr indexedArray) values() []string {
+	idxs := arr.indexes()
+	vals := make([]string, len(idxs))
+	for i, idx := range idxs {
+		vals[i] = arr[idx]
+	}
+	return vals
+}
+
+// index returns the index of arr given by idx, which counts back from the end
+// of the array if it is negative.  It returns false if there is no such index.
+func (arr indexedArray) index(idx int64) (int64, bool) {
+	if idx >= 0 {
+		return idx, true
+	}
+	var end int64
+	for i := range arr {
+		if i >= end {
+			end = i + 1
+		}
+	}
+	return idx + end, idx+end >= 0
+}
+
+// varAttrs returns the attributes of the variable or array called name.
+func (s *Shell) varAttrs(name string) VarAttrs {
+	if v := s.lookupVar(name); v != nil {
+		return v.Attrs
+	}
+	return 0
+}
+
+// An arrayElem is an element of a compound assignment name=(...).
+type arrayElem struct {
+	sub    string
+	hasSub bool // The element was given as [sub]=val
+	val    string
+}
+
+// SetArrayElement assigns val to the element sub of the array called name,
+// which is made an indexed array if it is not an array yet.  The subscript of
+// an indexed array is evaluated arithmetically.
+func (s *Shell) SetArrayElement(name, sub, val string) error {
+	attrs := s.varAttrs(name)
+	if attrs&VarReadonly != 0 {
+		return fmt.Errorf("%s: readonly variable", name)
+	}
+	val, err := s.convertValue(attrs, val)
+	if err != nil {
+		return err
+	}
+	if assoc := s.GetAssoc(name); assoc != nil {
+		assoc[sub] = val
+		return nil
+	}
+	arr := s.getIndexedArray(name)
+	if arr == nil {
+		arr = indexedArray{}
+		if v := s.lookupVar(name); v != nil {
+			arr[0] = v.Value
+		}
+	}
+	idx, err := evalArith(s, sub)
+	if err != nil {
+		return err
+	}
+	idx, ok := arr.index(idx)
 	if !ok {
-		val = os.Getenv(name)
+		return fmt.Errorf("%s[%s]: bad array subscript", name, sub)
+	}
+	arr[idx] = val
+	s.setIndexedArray(name, arr)
+	return nil
+}
+
+// AssignArray replaces the elements of the array called name with elems.  It
+// is an indexed array unless it is already an associative one.  The elements
+// of an associative array without a subscript are taken as key-value pairs.
+func (s *Shell) AssignArray(name string, elems []arrayElem) error {
+	attrs := s.varAttrs(name)
+	if attrs&VarReadonly != 0 {
+		return fmt.Errorf("%s: readonly variable", name)
+	}
+	if s.GetAssoc(name) != nil {
+		assoc := make(map[string]string, len(elems))
+		for i := 0; i < len(elems); i++ {
+			key, val := elems[i].sub, elems[i].val
+			if !elems[i].hasSub {
+				key, val = elems[i].val, ""
+				if i+1 < len(elems) {
+					i++
+					val = elems[i].val
+				}
+			}
+			val, err := s.convertValue(attrs, val)
+			if err != nil {
+				return err
+			}
+			assoc[key] = val
+		}
+		s.SetAssoc(name, assoc)
+		return nil
 	}
-	return val
+	arr := indexedArray{}
+	var idx int64
+	for _, e := range elems {
+		if e.hasSub {
+			var err error
+			if idx, err = evalArith(s, e.sub); err != nil {
+				return err
+			}
+			if idx < 0 {
+				return fmt.Errorf("%s[%s]: bad array subscript", name, e.sub)
+			}
+		}
+		val, err := s.convertValue(attrs, e.val)
+		if err != nil {
+			return err
+		}
+		arr[idx] = val
+		idx++
+	}
+	s.setIndexedArray(name, arr)
+	return nil
 }
 
-func (s *Shell) GetFunction(name string) Command {
+// A Function is a shell function, with its source for declare -f.
+type Function struct {
+	Body   Command
+	Source string
+}
+
+func (s *Shell) GetFunction(name string) *Function {
 	return s.functions[name]
 }
 
-func (s *Shell) Export(name string) {
-	for _, gname := range s.exported {
-		if name == gname {
-			return
+// ImportEnviron creates exported variables from an environment in the form
+// returned by os.Environ.
+func (s *Shell) ImportEnviron(env []string) {
+	for _, kv := range env {
+		i := strings.IndexByte(kv, '=')
+		if i == -1 || !isName(kv[:i]) {
+			continue
 		}
+		s.globals[kv[:i]] = &Variable{Value: kv[i+1:], Attrs: VarExport}
 	}
-	s.exported = append(s.exported, name)
+	s.initPwd()
 }
 
-func (s *Shell) SetVar(name, val string) {
-	f := s.currentFrame()
-	if f != nil {
-		_, ok := f.locals[name]
-		if ok {
-			f.locals[name] = val
-			return
+// Environ returns the environment to give to child processes, made of the
+// exported variables.
+func (s *Shell) Environ() []string {
+	env := []string{}
+	for _, name := range s.varNames() {
+		if v := s.lookupVar(name); v.Attrs&VarExport != 0 {
+			env = append(env, name+"="+v.Value)
 		}
 	}
-	s.globals[name] = val
+	return env
+}
+
+// varNames returns the sorted names of the variables in the current scope,
+// not including arrays.
+func (s *Shell) varNames() []string {
+	return s.scopeNames(func(v *Variable) bool { return !v.isArray() })
 }
 
-func (s *Shell) SetFunction(name string, body Command) {
-	fmt.Println("Setting function:", name)
-	s.functions[name] = body
+// arrayNames returns the sorted names of the arrays in the current scope.
+func (s *Shell) arrayNames() []string {
+	return s.scopeNames((*Variable).isArray)
 }
 
-func (s *Shell) SetCwd(dir string) error {
-	cwd, err := LookDir(s.cwd, dir)
+// scopeNames returns the sorted names of the variables in the current scope
+// for which keep returns true.
+func (s *Shell) scopeNames(keep func(*Variable) bool) []string {
+	seen := make(map[string]bool, len(s.globals))
+	for name := range s.globals {
+		seen[name] = true
+	}
+	for _, f := range s.frames {
+		for name := range f.locals {
+			seen[name] = true
+		}
+	}
+	names := make([]string, 0, len(seen))
+	for name := range seen {
+		if keep(s.lookupVar(name)) {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// SetVar assigns val to the variable called name, creating it if needed.  The
+// value is transformed according to the variable's attributes, e.g. evaluated
+// arithmetically if it has the integer attribute.
+func (s *Shell) SetVar(name, val string) error {
+	v := s.variable(name)
+	if v.isArray() {
+		// Like in bash, this sets the first element
+		return s.SetArrayElement(name, "0", val)
+	}
+	if v.Attrs&VarReadonly != 0 {
+		return fmt.Errorf("%s: readonly variable", name)
+	}
+	val, err := s.convertValue(v.Attrs, val)
 	if err != nil {
 		return err
 	}
-	s.cwd = cwd
+	v.Value = val
 	return nil
 }
 
+// convertValue transforms a value assigned to a variable or array element
+// with the attributes attrs.
+func (s *Shell) convertValue(attrs VarAttrs, val string) (string, error) {
+	if attrs&VarInteger != 0 {
+		n, err := evalArith(s, val)
+		if err != nil {
+			return "", err
+		}
+		val = strconv.FormatInt(n, 10)
+	}
+	switch {
+	case attrs&VarLower != 0:
+		val = strings.ToLower(val)
+	case attrs&VarUpper != 0:
+		val = strings.ToUpper(val)
+	}
+	return val, nil
+}
+
+// SetTempVars assigns values to variables until the returned function is
+// called, which restores their previous values.  It is used for assignments
+// preceding a builtin.  The variables are exported meanwhile, so that commands
+// started by the builtin (e.g. "X=1 command env") get them.
+func (s *Shell) SetTempVars(vars map[string]string) (func(), error) {
+	var restores []func()
+	restore := func() {
+		for i := len(restores) - 1; i >= 0; i-- {
+			restores[i]()
+		}
+	}
+	for name, val := range vars {
+		name := name
+		if v := s.lookupVar(name); v != nil {
+			old, oldAttrs := v.Value, v.Attrs
+			restores = append(restores, func() { v.Value, v.Attrs = old, oldAttrs })
+		} else {
+			restores = append(restores, func() { delete(s.globals, name) })
+		}
+		if err := s.SetVar(name, val); err != nil {
+			restore()
+			return nil, err
+		}
+		s.SetVarAttrs(name, VarExport)
+	}
+	return restore, nil
+}
+
+// SetLocalVar creates a variable called name local to the current function,
+// hiding any variable with the same name in the calling scopes.
+func (s *Shell) SetLocalVar(name, val string) {
+	f := s.currentFrame()
+	if f.locals == nil {
+		f.locals = map[string]*Variable{}
+	}
+	f.locals[name] = &Variable{Value: val}
+}
+
+// IsLocalVar returns true if name is a local variable of the current function.
+func (s *Shell) IsLocalVar(name string) bool {
+	f := s.currentFrame()
+	if f == nil {
+		return false
+	}
+	_, ok := f.locals[name]
+	return ok
+}
+
+// SetVarAttrs gives the variable or array called name the attributes attrs,
+// creating a variable if needed.  The lower and upper case attributes exclude
+// each other.
+func (s *Shell) SetVarAttrs(name string, attrs VarAttrs) {
+	v := s.variable(name)
+	v.Attrs = addAttrs(v.Attrs, attrs)
+}
+
+func addAttrs(attrs, added VarAttrs) VarAttrs {
+	switch {
+	case added&VarLower != 0:
+		attrs &^= VarUpper
+	case added&VarUpper != 0:
+		attrs &^= VarLower
+	}
+	return attrs | added
+}
+
+// ClearVarAttrs removes the attributes attrs from the variable or array called
+// name.  The readonly attribute cannot be removed.
+func (s *Shell) ClearVarAttrs(name string, attrs VarAttrs) error {
+	if attrs&VarReadonly != 0 && s.varAttrs(name)&VarReadonly != 0 {
+		return fmt.Errorf("%s: readonly variable", name)
+	}
+	if v := s.lookupVar(name); v != nil {
+		v.Attrs &^= attrs
+	}
+	return nil
+}
+
+// UnsetVar removes the variable called name from the current scope.  A local
+// variable of the current function still hides the variables of the calling
+// scopes until the function returns, as in bash.
+func (s *Shell) UnsetVar(name string) error {
+	if s.varAttrs(name)&VarReadonly != 0 {
+		return fmt.Errorf("%s: cannot unset: readonly variable", name)
+	}
+	for i := len(s.frames) - 1; i >= 0; i-- {
+		if _, ok := s.frames[i].locals[name]; ok {
+			if i == len(s.frames)-1 {
+				s.frames[i].locals[name] = &Variable{}
+			} else {
+				delete(s.frames[i].locals, name)
+			}
+			return nil
+		}
+	}
+	delete(s.globals, name)
+	return nil
+}
+
+// UnsetFunction removes the function called name.
+func (s *Shell) UnsetFunction(name string) {
+	delete(s.functions, name)
+}
+
+func (s *Shell) SetFunction(name string, f *Function) {
+	s.functions[name] = f
+}
+
+// shoptNames lists the options that can be set with the shopt builtin.
+var shoptNames = []string{
+	"bareglobqual", // Interpret zsh-style glob qualifiers, e.g. *(.om[1,5])
+}
+
+func (s *Shell) Shopt(name string) bool {
+	return s.shopts[name]
+}
+
+func (s *Shell) SetShopt(name string, on bool) error {
+	if !isShoptName(name) {
+		return fmt.Errorf("%s: invalid shell option name", name)
+	}
+	s.shopts[name] = on
+	return nil
+}
+
+func isShoptName(name string) bool {
+	return containsString(shoptNames, name)
+}
+
+// optionNames lists the options that can be set with set -o or shopt -o.
+var optionNames = []string{
+	"errexit",   // Exit when a command fails
+	"monitor",   // Run jobs in their own process groups (job control)
+	"noclobber", // Do not let > overwrite existing files
+	"noexec",    // Read commands without running them
+	"noglob",    // Do not expand glob patterns
+	"nounset",   // Expanding an unset variable is an error
+	"physical",  // Resolve symbolic links when changing directory
+	"pipefail",  // A pipeline fails if any of its commands fails
+	"verbose",   // Print input lines as they are read
+	"xtrace",    // Print commands before running them
+}
+
+// optionLetters maps the single letter options of set to option names, in the
+// order they appear in $-.
+var optionLetters = []struct {
+	letter byte
+	name   string
+}{
+	{'e', "errexit"},
+	{'f', "noglob"},
+	{'m', "monitor"},
+	{'n', "noexec"},
+	{'u', "nounset"},
+	{'v', "verbose"},
+	{'x', "xtrace"},
+	{'C', "noclobber"},
+	{'P', "physical"},
+}
+
+func optionLetterName(c byte) (string, bool) {
+	for _, o := range optionLetters {
+		if o.letter == c {
+			return o.name, true
+		}
+	}
+	return "", false
+}
+
+// OptionFlags returns the value of $-, the letters of the options that are
+// set.
+func (s *Shell) OptionFlags() string {
+	var flags []byte
+	for _, o := range optionLetters {
+		if s.options[o.name] {
+			flags = append(flags, o.letter)
+		}
+	}
+	if s.interactive {
+		flags = append(flags, 'i')
+	}
+	return string(flags)
+}
+
+// CheckErrexit runs the ERR trap and makes the shell exit if cmd, which ran
+// with the streams std, failed and the errexit option applies.  Compound
+// commands are not checked because the commands they run are.
+func (s *Shell) CheckErrexit(std *StdStreams, cmd Command, res JobOutcome) {
+	if res.Success() || std.errexitIgnored {
+		return
+	}
+	for {
+		r, ok := cmd.(*RedirectCommand)
+		if !ok {
+			break
+		}
+		cmd = r.Cmd
+	}
+	switch cmd.(type) {
+	case *CommandSequence, *IfCommand, *WhileCommand:
+		return
+	}
+	s.RunTrap(trapErr)
+	if s.options["errexit"] {
+		s.Exit(res.ExitCode)
+	}
+}
+
+func (s *Shell) Option(name string) bool {
+	return s.options[name]
+}
+
+func (s *Shell) SetOption(name string, on bool) error {
+	if !isOptionName(name) {
+		return fmt.Errorf("%s: invalid option name", name)
+	}
+	s.options[name] = on
+	return nil
+}
+
+func isOptionName(name string) bool {
+	return containsString(optionNames, name)
+}
+
 func (s *Shell) GetCwd() string {
 	return s.cwd
 }
 
+// AbsPath returns path made absolute relative to the shell's current
+// directory.
+func (s *Shell) AbsPath(path string) string {
+	if filepath.IsAbs(path) {
+		return path
+	}
+	return filepath.Join(s.cwd, path)
+}
+
 func (s *Shell) Exited() bool {
 	return s.exited
 }
@@ -195,12 +871,24 @@ func (s *Shell) ShouldStop() bool {
 	return s.Exited() || s.Returned()
 }
 
+// Exit stops the shell, after running the EXIT trap.  The trap can call exit
+// itself to change the exit code.
 func (s *Shell) Exit(code int) {
-	if !s.exited {
+	if action, ok := s.traps[trapExit]; ok && !s.exited {
+		delete(s.traps, trapExit)
+		s.lastCommandExitCode = code
+		s.runTrapAction(action)
+	}
+	s.stop(code)
+}
+
+// stop ends the shell with the exit code code, unless it has ended already.
+func (s *Shell) stop(code int) {
+	s.stopOnce.Do(func() {
 		s.exited = true
 		s.exitCode = code
 		close(s.done)
-	}
+	})
 }
 
 func (s *Shell) ExitCode() int {
@@ -216,28 +904,92 @@ func (s *Shell) Subshell() *Shell {
 	args := make([]string, len(s.args))
 	copy(args, s.args)
 	sub := NewShell(s.name, args, s.cwd)
+	sub.fds = s.fds.Clone()
+	sub.subshell = true
+	sub.lastBackgroundPid = s.lastBackgroundPid
+	sub.dirStack = append([]string(nil), s.dirStack...)
+	sub.hashed = s.hashed.clone()
+	sub.getopts = s.getopts
+	// Processes started by the subshell belong to the same job
+	sub.group = s.group
+	for _, f := range s.frames {
+		locals := make(map[string]*Variable, len(f.locals))
+		for k, v := range f.locals {
+			locals[k] = v.clone()
+		}
+		f.locals = locals
+		f.args = append([]string(nil), f.args...)
+		sub.frames = append(sub.frames, f)
+	}
+	sub.startTime = s.startTime
+	sub.scriptPos = s.scriptPos
+	sub.umask = s.umask
+	for k, v := range s.rlimits {
+		sub.rlimits[k] = v
+	}
 	for k, v := range s.globals {
-		sub.SetVar(k, v)
+		sub.globals[k] = v.clone()
+	}
+	for k, v := range s.shopts {
+		sub.shopts[k] = v
+	}
+	for k, v := range s.options {
+		sub.options[k] = v
+	}
+	for k, v := range s.aliases {
+		sub.aliases[k] = v
+	}
+	for k, v := range s.functions {
+		sub.functions[k] = v
+	}
+	// Only ignored signals stay so in a subshell, other traps are reset.
+	for k, v := range s.traps {
+		if _, ok := trapSignal(k); ok && v == "" {
+			sub.traps[k] = v
+		}
 	}
 	return sub
 }
 
-func (s *Shell) RunCommand(cmd Command, std StdStreams) error {
-	job, err := cmd.StartJob(s, std)
-	if err != nil {
-		return err
+// Streams returns the shell's own file descriptor table.  Commands run at the
+// top level should use it so that they see the effect of exec.
+func (s *Shell) Streams() *StdStreams {
+	return s.fds
+}
+
+func (s *Shell) RunCommand(cmd Command, std *StdStreams) error {
+	s.runSignalTraps()
+	_, intTrapped := s.traps["SIGINT"]
+	if s.JobControl() {
+		// Commands run by source are run while the command calling it
+		// is, which gets its group back afterwards.
+		prevGroup := s.group
+		s.group = s.newProcessGroup(true)
+		restoreTerm := saveTermMode(ttyFd)
+		defer func() {
+			s.group = prevGroup
+			if isTerminal(ttyFd) {
+				claimTerminal()
+				restoreTerm()
+			}
+		}()
 	}
+	job := startJobOrReport(cmd, s, std)
 	c := make(chan os.Signal, 10)
 	signal.Notify(c, os.Interrupt)
 	defer signal.Stop(c)
 	defer close(c)
 	go func() {
 		sig := <-c
-		if sig != nil {
+		// A trapped interrupt is not passed on to the job, the trap runs
+		// once it is finished.
+		if sig != nil && !intTrapped {
 			job.Signal(sig)
 		}
 	}()
-	res := job.Wait()
+	res := s.waitForeground(job, s.group, std)
 	s.lastCommandExitCode = res.ExitCode
+	s.CheckErrexit(std, cmd, res)
+	s.runSignalTraps()
 	return res.Err
 }
@@ -0,0 +1,24 @@
+package main
+
+import (
+	"os"
+	"syscall"
+	"time"
+)
+
+// fileTime returns the modification ('m'), access ('a') or inode change ('c')
+// time of a file.
+func fileTime(fi os.FileInfo, which byte) time.Time {
+	st, ok := fi.Sys().(*syscall.Stat_t)
+	if !ok {
+		return fi.ModTime()
+	}
+	switch which {
+	case 'a':
+		return time.Unix(st.Atimespec.Unix())
+	case 'c':
+		return time.Unix(st.Ctimespec.Unix())
+	default:
+		return fi.ModTime()
+	}
+}
@@ -0,0 +1,47 @@
+package main
+
+import "golang.org/x/sys/unix"
+
+// isTerminal reports whether fd is open on a terminal.
+func isTerminal(fd uintptr) bool {
+	_, err := unix.IoctlGetTermios(int(fd), ioctlGetTermios)
+	return err == nil
+}
+
+// saveTermMode returns a function that restores the current settings of the
+// terminal open at fd, e.g. after running a command that changed them.  It does
+// nothing if fd is not a terminal.
+func saveTermMode(fd uintptr) func() {
+	saved, err := unix.IoctlGetTermios(int(fd), ioctlGetTermios)
+	if err != nil {
+		return func() {}
+	}
+	return func() {
+		unix.IoctlSetTermios(int(fd), ioctlSetTermios, saved)
+	}
+}
+
+// setTermMode turns off echoing of input and / or line buffering on the
+// terminal open at fd.  It returns a function that restores the previous
+// settings.
+func setTermMode(fd uintptr, echo, canon bool) (func(), error) {
+	saved, err := unix.IoctlGetTermios(int(fd), ioctlGetTermios)
+	if err != nil {
+		return nil, err
+	}
+	t := *saved
+	if !echo {
+		t.Lflag &^= unix.ECHO
+	}
+	if !canon {
+		t.Lflag &^= unix.ICANON
+		t.Cc[unix.VMIN] = 1
+		t.Cc[unix.VTIME] = 0
+	}
+	if err := unix.IoctlSetTermios(int(fd), ioctlSetTermios, &t); err != nil {
+		return nil, err
+	}
+	return func() {
+		unix.IoctlSetTermios(int(fd), ioctlSetTermios, saved)
+	}, nil
+}
@@ -0,0 +1,326 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+func builtinTest(sh *Shell, std *StdStreams, args []string) (RunningJob, error) {
+	return runTest(sh, std, "test", args), nil
+}
+
+func builtinBracket(sh *Shell, std *StdStreams, args []string) (RunningJob, error) {
+	if len(args) == 0 || args[len(args)-1] != "]" {
+		fmt.Fprintln(std.Err, "meshell: [: missing `]'")
+		return &ImmediateRunningJob{name: "[", outcome: JobOutcome{ExitCode: 2}}, nil
+	}
+	return runTest(sh, std, "[", args[:len(args)-1]), nil
+}
+
+// runTest evaluates a test expression.  The exit code is 0 if it is true, 1
+// if it is false and 2 if it is invalid.
+func runTest(sh *Shell, std *StdStreams, name string, args []string) RunningJob {
+	t := &testEvaluator{sh: sh, std: std, args: args}
+	res, err := t.eval()
+	code := 1
+	switch {
+	case err != nil:
+		fmt.Fprintf(std.Err, "meshell: %s: %s\n", name, err)
+		code = 2
+	case res:
+		code = 0
+	}
+	return &ImmediateRunningJob{name: name, outcome: JobOutcome{ExitCode: code}}
+}
+
+type testEvaluator struct {
+	sh   *Shell
+	std  *StdStreams
+	args []string
+	pos  int
+}
+
+// eval applies the POSIX rules, which decide how to interpret the arguments
+// according to how many there are, and falls back to parsing an expression
+// with -a, -o, ! and parentheses when there are more than 4.
+func (t *testEvaluator) eval() (bool, error) {
+	args := t.args
+	switch len(args) {
+	case 0:
+		return false, nil
+	case 1:
+		return args[0] != "", nil
+	case 2:
+		if args[0] == "!" {
+			return args[1] == "", nil
+		}
+		if isTestUnaryOp(args[0]) {
+			return t.unary(args[0], args[1])
+		}
+		return false, fmt.Errorf("%s: unary operator expected", args[0])
+	case 3:
+		// A binary operator takes precedence over a leading "!", so that
+		// e.g. [ ! -a b ] is true like in bash.
+		if isTestBinaryOp(args[1]) {
+			return t.binary(args[0], args[1], args[2])
+		}
+		switch args[1] {
+		case "-a":
+			return args[0] != "" && args[2] != "", nil
+		case "-o":
+			return args[0] != "" || args[2] != "", nil
+		}
+		if args[0] == "!" {
+			res, err := t.sub(args[1:]).eval()
+			return !res, err
+		}
+		if args[0] == "(" && args[2] == ")" {
+			return args[1] != "", nil
+		}
+		return false, fmt.Errorf("%s: binary operator expected", args[1])
+	case 4:
+		if args[0] == "!" {
+			res, err := t.sub(args[1:]).eval()
+			return !res, err
+		}
+		if args[0] == "(" && args[3] == ")" {
+			return t.sub(args[1:3]).eval()
+		}
+	}
+	res, err := t.parseOr()
+	if err == nil && t.pos < len(t.args) {
+		err = fmt.Errorf("%s: syntax error", t.args[t.pos])
+	}
+	return res, err
+}
+
+func (t *testEvaluator) sub(args []string) *testEvaluator {
+	return &testEvaluator{sh: t.sh, std: t.std, args: args}
+}
+
+func (t *testEvaluator) peek() (string, bool) {
+	if t.pos >= len(t.args) {
+		return "", false
+	}
+	return t.args[t.pos], true
+}
+
+func (t *testEvaluator) parseOr() (bool, error) {
+	res, err := t.parseAnd()
+	for err == nil {
+		if arg, ok := t.peek(); !ok || arg != "-o" {
+			break
+		}
+		t.pos++
+		var rhs bool
+		rhs, err = t.parseAnd()
+		res = res || rhs
+	}
+	return res, err
+}
+
+func (t *testEvaluator) parseAnd() (bool, error) {
+	res, err := t.parseNot()
+	for err == nil {
+		if arg, ok := t.peek(); !ok || arg != "-a" {
+			break
+		}
+		t.pos++
+		var rhs bool
+		rhs, err = t.parseNot()
+		res = res && rhs
+	}
+	return res, err
+}
+
+func (t *testEvaluator) parseNot() (bool, error) {
+	if arg, ok := t.peek(); ok && arg == "!" {
+		t.pos++
+		res, err := t.parseNot()
+		return !res, err
+	}
+	return t.parsePrimary()
+}
+
+func (t *testEvaluator) parsePrimary() (bool, error) {
+	arg, ok := t.peek()
+	if !ok {
+		return false, errors.New("argument expected")
+	}
+	rest := len(t.args) - t.pos
+	switch {
+	case arg == "(":
+		t.pos++
+		res, err := t.parseOr()
+		if err != nil {
+			return false, err
+		}
+		if next, ok := t.peek(); !ok || next != ")" {
+			return false, errors.New("`)' expected")
+		}
+		t.pos++
+		return res, nil
+	case rest >= 3 && isTestBinaryOp(t.args[t.pos+1]):
+		t.pos += 3
+		return t.binary(arg, t.args[t.pos-2], t.args[t.pos-1])
+	case rest >= 2 && isTestUnaryOp(arg):
+		t.pos += 2
+		return t.unary(arg, t.args[t.pos-1])
+	default:
+		t.pos++
+		return arg != "", nil
+	}
+}
+
+func isTestUnaryOp(op string) bool {
+	return len(op) == 2 && op[0] == '-' && strings.IndexByte("bcdefghknprstuvwxzGLNOS", op[1]) != -1
+}
+
+func isTestBinaryOp(op string) bool {
+	switch op {
+	case "=", "==", "!=", "<", ">", "-eq", "-ne", "-gt", "-ge", "-lt", "-le", "-nt", "-ot", "-ef":
+		return true
+	}
+	return false
+}
+
+func (t *testEvaluator) unary(op, arg string) (bool, error) {
+	switch op {
+	case "-n":
+		return arg != "", nil
+	case "-z":
+		return arg == "", nil
+	case "-v":
+		return t.sh.lookupVar(arg) != nil, nil
+	case "-t":
+		fd, err := testInt(arg)
+		if err != nil {
+			return false, err
+		}
+		f, ok := t.std.Get(int(fd)).(*os.File)
+		return ok && isTerminal(f.Fd()), nil
+	}
+	if arg == "" {
+		return false, nil
+	}
+	path := t.sh.AbsPath(arg)
+	switch op {
+	case "-h", "-L":
+		fi, err := os.Lstat(path)
+		return err == nil && fi.Mode()&os.ModeSymlink != 0, nil
+	case "-r":
+		return unix.Access(path, unix.R_OK) == nil, nil
+	case "-w":
+		return unix.Access(path, unix.W_OK) == nil, nil
+	case "-x":
+		return unix.Access(path, unix.X_OK) == nil, nil
+	}
+	fi, err := os.Stat(path)
+	if err != nil {
+		return false, nil
+	}
+	mode := fi.Mode()
+	switch op {
+	case "-e":
+		return true, nil
+	case "-f":
+		return mode.IsRegular(), nil
+	case "-d":
+		return mode.IsDir(), nil
+	case "-b":
+		return mode&os.ModeDevice != 0 && mode&os.ModeCharDevice == 0, nil
+	case "-c":
+		return mode&os.ModeCharDevice != 0, nil
+	case "-p":
+		return mode&os.ModeNamedPipe != 0, nil
+	case "-S":
+		return mode&os.ModeSocket != 0, nil
+	case "-s":
+		return fi.Size() > 0, nil
+	case "-g":
+		return mode&os.ModeSetgid != 0, nil
+	case "-u":
+		return mode&os.ModeSetuid != 0, nil
+	case "-k":
+		return mode&os.ModeSticky != 0, nil
+	case "-N":
+		return fi.ModTime().After(fileTime(fi, 'a')), nil
+	case "-O", "-G":
+		st, ok := fi.Sys().(*syscall.Stat_t)
+		if !ok {
+			return false, nil
+		}
+		if op == "-O" {
+			return int(st.Uid) == os.Geteuid(), nil
+		}
+		return int(st.Gid) == os.Getegid(), nil
+	default:
+		panic("bug!")
+	}
+}
+
+func (t *testEvaluator) binary(lhs, op, rhs string) (bool, error) {
+	switch op {
+	case "=", "==":
+		return lhs == rhs, nil
+	case "!=":
+		return lhs != rhs, nil
+	case "<":
+		return lhs < rhs, nil
+	case ">":
+		return lhs > rhs, nil
+	case "-nt", "-ot", "-ef":
+		return t.compareFiles(lhs, op, rhs), nil
+	}
+	x, err := testInt(lhs)
+	if err != nil {
+		return false, err
+	}
+	y, err := testInt(rhs)
+	if err != nil {
+		return false, err
+	}
+	switch op {
+	case "-eq":
+		return x == y, nil
+	case "-ne":
+		return x != y, nil
+	case "-gt":
+		return x > y, nil
+	case "-ge":
+		return x >= y, nil
+	case "-lt":
+		return x < y, nil
+	case "-le":
+		return x <= y, nil
+	default:
+		panic("bug!")
+	}
+}
+
+func (t *testEvaluator) compareFiles(lhs, op, rhs string) bool {
+	fi1, err1 := os.Stat(t.sh.AbsPath(lhs))
+	fi2, err2 := os.Stat(t.sh.AbsPath(rhs))
+	switch op {
+	case "-nt":
+		return err1 == nil && (err2 != nil || fi1.ModTime().After(fi2.ModTime()))
+	case "-ot":
+		return err2 == nil && (err1 != nil || fi1.ModTime().Before(fi2.ModTime()))
+	default:
+		return err1 == nil && err2 == nil && os.SameFile(fi1, fi2)
+	}
+}
+
+func testInt(s string) (int64, error) {
+	n, err := strconv.ParseInt(strings.TrimSpace(s), 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("%s: integer expression expected", s)
+	}
+	return n, nil
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+// runBuiltin runs the builtin f with args in sh and returns what it printed
+// to its standard output and error, and its exit code.
+func runBuiltin(t *testing.T, sh *Shell, f func(*Shell, *StdStreams, []string) (RunningJob, error), args []string) (string, string, int) {
+	t.Helper()
+	var out, errOut bytes.Buffer
+	job, err := f(sh, NewStdStreams(strings.NewReader(""), &out, &errOut), args)
+	if err != nil {
+		t.Fatalf("%q: unexpected error: %s", args, err)
+	}
+	return out.String(), errOut.String(), job.Wait().ExitCode
+}
+
+func TestTestArgumentCount(t *testing.T) {
+	tests := []struct {
+		args []string
+		code int
+	}{
+		// 0 arguments: false
+		{[]string{}, 1},
+		// 1 argument: true if not empty
+		{[]string{""}, 1},
+		{[]string{"x"}, 0},
+		{[]string{"-n"}, 0},
+		{[]string{"!"}, 0},
+		// 2 arguments: negation or unary operator
+		{[]string{"!", ""}, 0},
+		{[]string{"!", "x"}, 1},
+		{[]string{"-z", ""}, 0},
+		{[]string{"-z", "x"}, 1},
+		{[]string{"a", "b"}, 2},
+		{[]string{"-q", "x"}, 2},
+		{[]string{"(", "x"}, 2},
+		// 3 arguments: binary operators come first
+		{[]string{"a", "=", "a"}, 0},
+		{[]string{"a", "=", "b"}, 1},
+		{[]string{"!", "-a", "b"}, 0},
+		{[]string{"a", "-a", ""}, 1},
+		{[]string{"", "-o", "b"}, 0},
+		{[]string{"!", "!", "x"}, 0},
+		{[]string{"(", "x", ")"}, 0},
+		{[]string{"(", "", ")"}, 1},
+		{[]string{"a", "b", "c"}, 2},
+		{[]string{"1", "-lt", "2"}, 0},
+		{[]string{"a", "-lt", "2"}, 2},
+		// 4 arguments: negation or parentheses around 2 arguments
+		{[]string{"!", "a", "=", "b"}, 0},
+		{[]string{"!", "(", "x", ")"}, 1},
+		{[]string{"(", "-n", "", ")"}, 1},
+		// More: an expression
+		{[]string{"a", "=", "a", "-a", "b"}, 0},
+		{[]string{"", "-o", "", "-o", "x"}, 0},
+		{[]string{"(", "a", "=", "b", ")", "-o", "x"}, 0},
+		{[]string{"(", "a", "=", "b", ")", "-a", "x"}, 1},
+	}
+	for _, test := range tests {
+		sh := NewShell("meshell", nil, t.TempDir())
+		_, errOut, code := runBuiltin(t, sh, builtinTest, test.args)
+		if code != test.code {
+			t.Errorf("test %q: exit code %d, want %d", test.args, code, test.code)
+		}
+		if (code == 2) != (errOut != "") {
+			t.Errorf("test %q: unexpected error output %q", test.args, errOut)
+		}
+	}
+}
+
+func TestBracketMissingClose(t *testing.T) {
+	sh := NewShell("meshell", nil, t.TempDir())
+	_, errOut, code := runBuiltin(t, sh, builtinBracket, []string{"a", "=", "a"})
+	if code != 2 || !strings.Contains(errOut, "missing `]'") {
+		t.Errorf("[ a = a: exit code %d with %q, want 2 with a missing ] error", code, errOut)
+	}
+	_, _, code = runBuiltin(t, sh, builtinBracket, []string{"a", "=", "a", "]"})
+	if code != 0 {
+		t.Errorf("[ a = a ]: exit code %d, want 0", code)
+	}
+}
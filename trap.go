@@ -0,0 +1,338 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"os/signal"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// Pseudo-signals that trap accepts besides real signals.
+const (
+	trapExit   = "EXIT"
+	trapErr    = "ERR"
+	trapDebug  = "DEBUG"
+	trapReturn = "RETURN"
+)
+
+// trapSignals are the signals that can be trapped, by their name without the
+// SIG prefix.
+var trapSignals = map[string]syscall.Signal{
+	"HUP":    syscall.SIGHUP,
+	"INT":    syscall.SIGINT,
+	"QUIT":   syscall.SIGQUIT,
+	"ILL":    syscall.SIGILL,
+	"TRAP":   syscall.SIGTRAP,
+	"ABRT":   syscall.SIGABRT,
+	"BUS":    syscall.SIGBUS,
+	"FPE":    syscall.SIGFPE,
+	"KILL":   syscall.SIGKILL,
+	"USR1":   syscall.SIGUSR1,
+	"SEGV":   syscall.SIGSEGV,
+	"USR2":   syscall.SIGUSR2,
+	"PIPE":   syscall.SIGPIPE,
+	"ALRM":   syscall.SIGALRM,
+	"TERM":   syscall.SIGTERM,
+	"CHLD":   syscall.SIGCHLD,
+	"CONT":   syscall.SIGCONT,
+	"STOP":   syscall.SIGSTOP,
+	"TSTP":   syscall.SIGTSTP,
+	"TTIN":   syscall.SIGTTIN,
+	"TTOU":   syscall.SIGTTOU,
+	"URG":    syscall.SIGURG,
+	"XCPU":   syscall.SIGXCPU,
+	"XFSZ":   syscall.SIGXFSZ,
+	"VTALRM": syscall.SIGVTALRM,
+	"PROF":   syscall.SIGPROF,
+	"WINCH":  syscall.SIGWINCH,
+	"IO":     syscall.SIGIO,
+	"SYS":    syscall.SIGSYS,
+}
+
+// trapName returns the name a trap is stored under for spec, which can be a
+// signal name with or without the SIG prefix, a signal number or one of the
+// pseudo-signals.
+func trapName(spec string) (string, bool) {
+	if n, err := strconv.Atoi(spec); err == nil {
+		if n == 0 {
+			return trapExit, true
+		}
+		if name := signalName(syscall.Signal(n)); name != "" {
+			return "SIG" + name, true
+		}
+		return "", false
+	}
+	name := strings.ToUpper(spec)
+	switch name {
+	case trapExit, trapErr, trapDebug, trapReturn:
+		return name, true
+	}
+	name = strings.TrimPrefix(name, "SIG")
+	if _, ok := trapSignals[name]; ok {
+		return "SIG" + name, true
+	}
+	return "", false
+}
+
+// trapSignal returns the signal a trap name refers to, if it is not a
+// pseudo-signal.
+func trapSignal(name string) (syscall.Signal, bool) {
+	if !strings.HasPrefix(name, "SIG") {
+		return 0, false
+	}
+	sig, ok := trapSignals[name[3:]]
+	return sig, ok
+}
+
+// trapOrder sorts trap names like bash lists them: EXIT, then signals by
+// number, then the other pseudo-signals.
+func trapOrder(name string) int {
+	if name == trapExit {
+		return 0
+	}
+	if sig, ok := trapSignal(name); ok {
+		return int(sig)
+	}
+	return 1000 + strings.Index(trapDebug+trapErr+trapReturn, name)
+}
+
+func sortTrapNames(names []string) {
+	sort.Slice(names, func(i, j int) bool {
+		return trapOrder(names[i]) < trapOrder(names[j])
+	})
+}
+
+func builtinTrap(sh *Shell, std *StdStreams, args []string) (RunningJob, error) {
+	var print, list bool
+	for len(args) > 0 && len(args[0]) > 1 && args[0][0] == '-' {
+		arg := args[0]
+		args = args[1:]
+		if arg == "--" {
+			break
+		}
+		for _, c := range arg[1:] {
+			switch c {
+			case 'p':
+				print = true
+			case 'l':
+				list = true
+			default:
+				fmt.Fprintf(std.Err, "meshell: trap: -%c: invalid option\n", c)
+				return &ImmediateRunningJob{name: "trap", outcome: JobOutcome{ExitCode: 2}}, nil
+			}
+		}
+	}
+	if list {
+		printSignalList(std)
+		return &ImmediateRunningJob{name: "trap"}, nil
+	}
+	if print || len(args) == 0 {
+		return printTraps(sh, std, args), nil
+	}
+	action := args[0]
+	specs := args[1:]
+	// With a single operand, or if the first one is a number, all operands
+	// are conditions to reset (POSIX).
+	if _, err := strconv.Atoi(action); err == nil || len(specs) == 0 {
+		action = "-"
+		specs = args
+	}
+	code := 0
+	for _, spec := range specs {
+		name, ok := trapName(spec)
+		if !ok {
+			fmt.Fprintf(std.Err, "meshell: trap: %s: invalid signal specification\n", spec)
+			code = 1
+			continue
+		}
+		if action == "-" {
+			sh.ResetTrap(name)
+		} else if err := sh.SetTrap(name, action); err != nil {
+			fmt.Fprintf(std.Err, "meshell: trap: %s\n", err)
+			code = 1
+		}
+	}
+	return &ImmediateRunningJob{name: "trap", outcome: JobOutcome{ExitCode: code}}, nil
+}
+
+// printTraps prints the traps for the given conditions, or all the traps set,
+// in a form that can be reused as shell input.
+func printTraps(sh *Shell, std *StdStreams, specs []string) RunningJob {
+	var names []string
+	code := 0
+	for _, spec := range specs {
+		name, ok := trapName(spec)
+		if !ok {
+			fmt.Fprintf(std.Err, "meshell: trap: %s: invalid signal specification\n", spec)
+			code = 1
+			continue
+		}
+		names = append(names, name)
+	}
+	if len(specs) == 0 {
+		names = sortedKeys(sh.traps)
+		sortTrapNames(names)
+	}
+	for _, name := range names {
+		if action, ok := sh.traps[name]; ok {
+			fmt.Fprintf(std.Out, "trap -- %s %s\n", shellQuote(action), name)
+		}
+	}
+	return &ImmediateRunningJob{name: "trap", outcome: JobOutcome{ExitCode: code}}
+}
+
+func printSignalList(std *StdStreams) {
+	names := make([]string, 0, len(trapSignals))
+	for name := range trapSignals {
+		names = append(names, "SIG"+name)
+	}
+	sortTrapNames(names)
+	for _, name := range names {
+		sig, _ := trapSignal(name)
+		fmt.Fprintf(std.Out, "%2d) %s\n", int(sig), name)
+	}
+}
+
+// SetTrap sets the command to run for the trap name.  An empty command means
+// the signal is ignored.
+func (s *Shell) SetTrap(name, action string) error {
+	sig, isSignal := trapSignal(name)
+	if isSignal && (sig == syscall.SIGKILL || sig == syscall.SIGSTOP) {
+		return fmt.Errorf("%s: cannot be trapped", name)
+	}
+	s.traps[name] = action
+	if isSignal {
+		s.updateSignals(sig)
+	}
+	return nil
+}
+
+// ResetTrap restores the default action for the trap name.
+func (s *Shell) ResetTrap(name string) {
+	if _, ok := s.traps[name]; !ok {
+		return
+	}
+	delete(s.traps, name)
+	if sig, isSignal := trapSignal(name); isSignal {
+		s.updateSignals(sig)
+	}
+}
+
+// updateSignals makes the signal handling for sig match its trap.  Trapped
+// signals are sent to s.caughtSignals, which is checked between commands.
+func (s *Shell) updateSignals(sig syscall.Signal) {
+	// Stop undoes all the previous calls to Notify, so the other trapped
+	// signals must be set again.
+	signal.Stop(s.caughtSignals)
+	var trapped []os.Signal
+	for name, action := range s.traps {
+		if sig, ok := trapSignal(name); ok && action != "" {
+			trapped = append(trapped, sig)
+		}
+	}
+	if len(trapped) > 0 {
+		signal.Notify(s.caughtSignals, trapped...)
+	}
+	switch action, ok := s.traps["SIG"+signalName(sig)]; {
+	case ok && action == "":
+		signal.Ignore(sig)
+	case !ok && signal.Ignored(sig):
+		signal.Reset(sig)
+	}
+}
+
+func signalName(sig syscall.Signal) string {
+	for name, s := range trapSignals {
+		if s == sig {
+			return name
+		}
+	}
+	return ""
+}
+
+// runSignalTraps runs the traps for the signals caught since it was last
+// called.
+func (s *Shell) runSignalTraps() {
+	for {
+		select {
+		case caught := <-s.caughtSignals:
+			sig := caught.(syscall.Signal)
+			name := "SIG" + signalName(sig)
+			if _, ok := s.traps[name]; !ok && terminates(sig) {
+				// Only signals sent by kill to a subshell can be untrapped
+				s.stop(128 + int(sig))
+				return
+			}
+			s.RunTrap(name)
+		default:
+			return
+		}
+	}
+}
+
+// signal makes the shell act on sig before it runs its next command, as a
+// shell process does: its trap is run, or without one the shell is
+// terminated if that is what sig does by default.  It is used for subshells,
+// which have no process of their own to receive signals.
+func (s *Shell) signal(sig os.Signal) {
+	select {
+	case s.caughtSignals <- sig:
+	default:
+	}
+}
+
+// terminates returns true if the default action for sig is to terminate the
+// process.
+func terminates(sig syscall.Signal) bool {
+	switch sig {
+	case 0, syscall.SIGCHLD, syscall.SIGCONT, syscall.SIGURG, syscall.SIGWINCH,
+		syscall.SIGSTOP, syscall.SIGTSTP, syscall.SIGTTIN, syscall.SIGTTOU:
+		return false
+	}
+	return true
+}
+
+// RunTrap runs the command set for the trap name, if any.  Traps do not
+// trigger other traps, and preserve $?.
+//
+// Like in bash, the ERR and DEBUG traps are not inherited by functions.
+func (s *Shell) RunTrap(name string) {
+	action, ok := s.traps[name]
+	if !ok || action == "" || s.inTrap > 0 {
+		return
+	}
+	if (name == trapErr || name == trapDebug) && len(s.frames) > 0 {
+		return
+	}
+	code := s.lastCommandExitCode
+	s.runTrapAction(action)
+	s.lastCommandExitCode = code
+}
+
+func (s *Shell) runTrapAction(action string) {
+	s.inTrap++
+	defer func() { s.inTrap-- }()
+	std := s.Streams()
+	line, err := parseInput(s, action+"\n", false, nil)
+	if err != nil {
+		var incomplete *IncompleteInputError
+		if errors.As(err, &incomplete) {
+			err = &SyntaxError{Err: err}
+		}
+		fmt.Fprintf(std.Err, "meshell: trap: %s\n", err)
+		return
+	}
+	if line.CmdList == nil {
+		return
+	}
+	cmd, err := line.CmdList.GetCommand()
+	if err != nil {
+		fmt.Fprintf(std.Err, "meshell: trap: %s\n", err)
+		return
+	}
+	s.lastCommandExitCode = startJobOrReport(cmd, s, std).Wait().ExitCode
+}
@@ -7,6 +7,7 @@ import (
 	"os/exec"
 	"path/filepath"
 	"regexp"
+	"sort"
 	"strconv"
 	"strings"
 )
@@ -146,18 +147,91 @@ func findDirectory(file string) error {
 	return ErrNotADirectory
 }
 
-func LookDir(wd, file string) (string, error) {
-	if strings.HasPrefix(file, "/") {
-		err := findDirectory(file)
-		if err == nil {
-			return file, nil
+// LookDir returns the path of the directory file relative to wd.  The path is
+// made physical by resolving symbolic links if physical is true.  Otherwise it
+// is logical: ".." removes the previous component, unless the resulting path
+// does not exist, in which case the physical path is used.
+func LookDir(wd, file string, physical bool) (string, error) {
+	path := file
+	if !filepath.IsAbs(file) {
+		path = wd + "/" + file
+	}
+	if err := findDirectory(path); err != nil {
+		return "", &exec.Error{Name: file, Err: err}
+	}
+	if !physical {
+		if clean := filepath.Clean(path); findDirectory(clean) == nil {
+			return clean, nil
 		}
+	}
+	path, err := filepath.EvalSymlinks(path)
+	if err != nil {
 		return "", &exec.Error{Name: file, Err: err}
 	}
-	path := filepath.Join(wd, file)
-	err := findDirectory(path)
-	if err == nil {
-		return path, nil
+	return path, nil
+}
+
+func containsString(items []string, s string) bool {
+	for _, item := range items {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
+
+// dedupEnv removes duplicate entries from an environment, the last one
+// winning (which os/exec does for us but syscall.Exec doesn't).
+func dedupEnv(env []string) []string {
+	index := map[string]int{}
+	res := make([]string, 0, len(env))
+	for _, kv := range env {
+		name := kv
+		if i := strings.IndexByte(kv, '='); i >= 0 {
+			name = kv[:i]
+		}
+		if j, ok := index[name]; ok {
+			res[j] = kv
+			continue
+		}
+		index[name] = len(res)
+		res = append(res, kv)
+	}
+	return res
+}
+
+// shellQuote quotes s so that the shell reads it back as a single word.
+func shellQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
+
+// isName returns true if s is a valid variable name.
+func isName(s string) bool {
+	if s == "" || s[0] >= '0' && s[0] <= '9' {
+		return false
+	}
+	for i := 0; i < len(s); i++ {
+		if !isNameChar(s[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+// sortedKeys returns the keys of an associative array in sorted order.
+func sortedKeys(m map[string]string) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func copyAssoc(m map[string]string) map[string]string {
+	c := make(map[string]string, len(m))
+	for k, v := range m {
+		c[k] = v
 	}
-	return "", &exec.Error{Name: file, Err: err}
+	return c
 }
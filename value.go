@@ -3,15 +3,15 @@ package main
 import (
 	"bytes"
 	"errors"
+	"fmt"
 	"os"
-	"path/filepath"
 	"strconv"
 	"strings"
 )
 
 type ValueDef interface {
-	Values(*Shell, StdStreams) ([]string, error)
-	Value(*Shell, StdStreams) (string, error)
+	Values(*Shell, *StdStreams) ([]string, error)
+	Value(*Shell, *StdStreams) (string, error)
 }
 
 type LiteralValueDef struct {
@@ -21,9 +21,9 @@ type LiteralValueDef struct {
 
 var _ ValueDef = LiteralValueDef{}
 
-func (d LiteralValueDef) Values(sh *Shell, std StdStreams) ([]string, error) {
-	if d.Expand {
-		exp, err := filepath.Glob(d.Val)
+func (d LiteralValueDef) Values(sh *Shell, std *StdStreams) ([]string, error) {
+	if d.Expand && !sh.Option("noglob") {
+		exp, err := globInDir(sh.GetCwd(), d.Val)
 		if err != nil {
 			return nil, err
 		}
@@ -34,10 +34,39 @@ func (d LiteralValueDef) Values(sh *Shell, std StdStreams) ([]string, error) {
 	return []string{d.Val}, nil
 }
 
-func (d LiteralValueDef) Value(sh *Shell, std StdStreams) (string, error) {
+func (d LiteralValueDef) Value(sh *Shell, std *StdStreams) (string, error) {
 	return d.Val, nil
 }
 
+// TildeValueDef is a word starting with a tilde prefix, e.g. ~/bin or ~+1.
+// The prefix is replaced with the directory it refers to, or left as it is if
+// there is none.
+type TildeValueDef struct {
+	Prefix string
+	Rest   LiteralValueDef
+}
+
+var _ ValueDef = TildeValueDef{}
+
+func (d TildeValueDef) Values(sh *Shell, std *StdStreams) ([]string, error) {
+	val, err := d.Value(sh, std)
+	if err != nil {
+		return nil, err
+	}
+	return LiteralValueDef{Val: val, Expand: d.Rest.Expand}.Values(sh, std)
+}
+
+func (d TildeValueDef) Value(sh *Shell, std *StdStreams) (string, error) {
+	dir, ok := sh.ExpandTilde(d.Prefix)
+	if !ok {
+		return "~" + d.Prefix + d.Rest.Val, nil
+	}
+	if d.Rest.Val == "" {
+		return dir, nil
+	}
+	return strings.TrimSuffix(dir, "/") + d.Rest.Val, nil
+}
+
 func ParamValueDef(param string) (ValueDef, error) {
 	if len(param) == 0 {
 		return nil, errors.New("invalid empty param")
@@ -49,34 +78,160 @@ func ParamValueDef(param string) (ValueDef, error) {
 			return nil, err
 		}
 		return ArgValueDef{Number: int(argnum)}, nil
-	case strings.IndexByte("?#@$", p0) != -1:
+	case strings.IndexByte("?#@$-!", p0) != -1:
 		return SpecialVarValueDef{Name: p0}, nil
 	default:
 		return VarValueDef{Name: param}, nil
 	}
 }
 
+// UnboundVarError is returned when expanding a variable that is not set while
+// the nounset option is on.
+type UnboundVarError struct {
+	Name string
+}
+
+func (e *UnboundVarError) Error() string {
+	return e.Name + ": unbound variable"
+}
+
 type VarValueDef struct {
 	Name string
 }
 
-func (d VarValueDef) Values(sh *Shell, std StdStreams) ([]string, error) {
-	return []string{sh.GetVar(d.Name)}, nil
+func (d VarValueDef) Values(sh *Shell, std *StdStreams) ([]string, error) {
+	v, err := d.Value(sh, std)
+	if err != nil {
+		return nil, err
+	}
+	return []string{v}, nil
 }
 
-func (d VarValueDef) Value(sh *Shell, std StdStreams) (string, error) {
+func (d VarValueDef) Value(sh *Shell, std *StdStreams) (string, error) {
+	if sh.Option("nounset") && !isVarSet(sh, d.Name) {
+		return "", &UnboundVarError{Name: d.Name}
+	}
 	return sh.GetVar(d.Name), nil
 }
 
+// ArrayValueDef is an element of an array variable (${name[i]}), or all its
+// elements if the index is @ or *.
+type ArrayValueDef struct {
+	Name  string
+	Index string
+}
+
+func (d ArrayValueDef) Values(sh *Shell, std *StdStreams) ([]string, error) {
+	if d.Index == "@" || d.Index == "*" {
+		arr := sh.GetArray(d.Name)
+		if arr == nil {
+			return []string{sh.GetVar(d.Name)}, nil
+		}
+		return arr, nil
+	}
+	v, err := d.Value(sh, std)
+	if err != nil {
+		return nil, err
+	}
+	return []string{v}, nil
+}
+
+func (d ArrayValueDef) Value(sh *Shell, std *StdStreams) (string, error) {
+	if d.Index == "@" || d.Index == "*" {
+		vals, err := d.Values(sh, std)
+		return strings.Join(vals, " "), err
+	}
+	if assoc := sh.GetAssoc(d.Name); assoc != nil {
+		return assoc[d.Index], nil
+	}
+	i, err := strconv.ParseInt(d.Index, 10, 64)
+	if err != nil {
+		return "", fmt.Errorf("%s: bad array subscript", d.Index)
+	}
+	arr := sh.getIndexedArray(d.Name)
+	if arr == nil {
+		if i == 0 {
+			return sh.GetVar(d.Name), nil
+		}
+		return "", nil
+	}
+	i, _ = arr.index(i)
+	return arr[i], nil
+}
+
+// CompoundValueDef is the value of a compound assignment name=(...).  Its
+// elements can be given a subscript as in [sub]=value.
+type CompoundValueDef struct {
+	Elems []CompoundElemDef
+}
+
+type CompoundElemDef struct {
+	Sub ValueDef // nil if the element has no subscript
+	Val ValueDef
+}
+
+// elems returns the elements of the array.  Those without a subscript are
+// expanded to as many elements as words.
+func (d CompoundValueDef) elems(sh *Shell, std *StdStreams) ([]arrayElem, error) {
+	var elems []arrayElem
+	for _, e := range d.Elems {
+		if e.Sub == nil {
+			vals, err := e.Val.Values(sh, std)
+			if err != nil {
+				return nil, err
+			}
+			for _, val := range vals {
+				elems = append(elems, arrayElem{val: val})
+			}
+			continue
+		}
+		sub, err := e.Sub.Value(sh, std)
+		if err != nil {
+			return nil, err
+		}
+		val, err := e.Val.Value(sh, std)
+		if err != nil {
+			return nil, err
+		}
+		elems = append(elems, arrayElem{sub: sub, hasSub: true, val: val})
+	}
+	return elems, nil
+}
+
+func (d CompoundValueDef) Values(sh *Shell, std *StdStreams) ([]string, error) {
+	v, err := d.Value(sh, std)
+	if err != nil {
+		return nil, err
+	}
+	return []string{v}, nil
+}
+
+// Value returns the elements in parentheses, quoted so that declare can read
+// them back.
+func (d CompoundValueDef) Value(sh *Shell, std *StdStreams) (string, error) {
+	elems, err := d.elems(sh, std)
+	if err != nil {
+		return "", err
+	}
+	return formatArrayElems(elems), nil
+}
+
 type ArgValueDef struct {
 	Number int
 }
 
-func (d ArgValueDef) Values(sh *Shell, std StdStreams) ([]string, error) {
-	return []string{sh.GetArg(d.Number)}, nil
+func (d ArgValueDef) Values(sh *Shell, std *StdStreams) ([]string, error) {
+	v, err := d.Value(sh, std)
+	if err != nil {
+		return nil, err
+	}
+	return []string{v}, nil
 }
 
-func (d ArgValueDef) Value(sh *Shell, std StdStreams) (string, error) {
+func (d ArgValueDef) Value(sh *Shell, std *StdStreams) (string, error) {
+	if d.Number > sh.ArgCount() && sh.Option("nounset") {
+		return "", &UnboundVarError{Name: strconv.Itoa(d.Number)}
+	}
 	return sh.GetArg(d.Number), nil
 }
 
@@ -84,7 +239,7 @@ type SpecialVarValueDef struct {
 	Name byte
 }
 
-func (d SpecialVarValueDef) Values(sh *Shell, std StdStreams) ([]string, error) {
+func (d SpecialVarValueDef) Values(sh *Shell, std *StdStreams) ([]string, error) {
 	switch d.Name {
 	case '?':
 		return []string{strconv.Itoa(sh.LastExitCode())}, nil
@@ -94,12 +249,16 @@ func (d SpecialVarValueDef) Values(sh *Shell, std StdStreams) ([]string, error)
 		return sh.GetArgs(), nil
 	case '$':
 		return []string{strconv.Itoa(os.Getpid())}, nil
+	case '-':
+		return []string{sh.OptionFlags()}, nil
+	case '!':
+		return []string{sh.LastBackgroundPid()}, nil
 	default:
 		panic("bug!")
 	}
 }
 
-func (d SpecialVarValueDef) Value(sh *Shell, std StdStreams) (string, error) {
+func (d SpecialVarValueDef) Value(sh *Shell, std *StdStreams) (string, error) {
 	switch d.Name {
 	case '?':
 		return strconv.Itoa(sh.LastExitCode()), nil
@@ -109,6 +268,10 @@ func (d SpecialVarValueDef) Value(sh *Shell, std StdStreams) (string, error) {
 		return strings.Join(sh.GetArgs(), " "), nil
 	case '$':
 		return strconv.Itoa(os.Getpid()), nil
+	case '-':
+		return sh.OptionFlags(), nil
+	case '!':
+		return sh.LastBackgroundPid(), nil
 	default:
 		panic("bug!")
 	}
@@ -118,7 +281,7 @@ type CommandValueDef struct {
 	Cmd Command
 }
 
-func (d CommandValueDef) Values(sh *Shell, std StdStreams) ([]string, error) {
+func (d CommandValueDef) Values(sh *Shell, std *StdStreams) ([]string, error) {
 	v, err := d.Value(sh, std)
 	if err != nil {
 		return nil, err
@@ -126,8 +289,9 @@ func (d CommandValueDef) Values(sh *Shell, std StdStreams) ([]string, error) {
 	return []string{v}, nil
 }
 
-func (d CommandValueDef) Value(sh *Shell, std StdStreams) (string, error) {
+func (d CommandValueDef) Value(sh *Shell, std *StdStreams) (string, error) {
 	var buf bytes.Buffer
+	std = std.Clone()
 	std.Out = &buf
 	job, err := d.Cmd.StartJob(sh, std)
 	if err != nil {
@@ -144,7 +308,7 @@ type CompositeValueDef struct {
 	Parts []ValueDef
 }
 
-func (d CompositeValueDef) Values(sh *Shell, std StdStreams) ([]string, error) {
+func (d CompositeValueDef) Values(sh *Shell, std *StdStreams) ([]string, error) {
 	v, err := d.Value(sh, std)
 	if err != nil {
 		return nil, err
@@ -152,7 +316,7 @@ func (d CompositeValueDef) Values(sh *Shell, std StdStreams) ([]string, error) {
 	return []string{v}, nil
 }
 
-func (d CompositeValueDef) Value(sh *Shell, std StdStreams) (string, error) {
+func (d CompositeValueDef) Value(sh *Shell, std *StdStreams) (string, error) {
 	var b strings.Builder
 	for _, part := range d.Parts {
 		s, err := part.Value(sh, std)
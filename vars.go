@@ -0,0 +1,530 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// varAttrFlags maps declare options to variable attributes, in the order
+// they are printed.
+var varAttrFlags = []struct {
+	flag rune
+	attr VarAttrs
+}{
+	{'i', VarInteger},
+	{'l', VarLower},
+	{'r', VarReadonly},
+	{'u', VarUpper},
+	{'x', VarExport},
+}
+
+func varAttrFlag(c rune) (VarAttrs, bool) {
+	for _, f := range varAttrFlags {
+		if f.flag == c {
+			return f.attr, true
+		}
+	}
+	return 0, false
+}
+
+// declareOpts are the options common to declare, local, export and readonly.
+type declareOpts struct {
+	set, unset VarAttrs
+	array      bool // -a: indexed arrays
+	assoc      bool // -A: associative arrays
+	print      bool // -p: print declarations
+	funcs      bool // -f: functions
+	funcNames  bool // -F: function names only
+	global     bool // -g: do not create local variables in functions
+	local      bool // Create variables local to the current function
+}
+
+func builtinDeclare(sh *Shell, std *StdStreams, args []string) (RunningJob, error) {
+	opts, args, err := parseDeclareOptions("declare", args)
+	if err != nil {
+		return nil, err
+	}
+	// In a function, declare creates local variables like local does
+	opts.local = sh.currentFrame() != nil && !opts.global
+	return declareVars(sh, std, "declare", opts, args)
+}
+
+func builtinLocal(sh *Shell, std *StdStreams, args []string) (RunningJob, error) {
+	if sh.currentFrame() == nil {
+		return nil, errors.New("local: can only be used in a function")
+	}
+	opts, args, err := parseDeclareOptions("local", args)
+	if err != nil {
+		return nil, err
+	}
+	opts.local = true
+	// "local -" makes the shell options local to the function
+	names := args[:0:0]
+	for _, arg := range args {
+		if arg == "-" {
+			sh.SaveOptions()
+		} else {
+			names = append(names, arg)
+		}
+	}
+	if len(names) == 0 && len(args) > 0 {
+		return &ImmediateRunningJob{name: "local"}, nil
+	}
+	return declareVars(sh, std, "local", opts, names)
+}
+
+// parseDeclareOptions parses the options of declare and local.  It returns
+// the remaining arguments.
+func parseDeclareOptions(cmd string, args []string) (declareOpts, []string, error) {
+	var opts declareOpts
+	for len(args) > 0 && len(args[0]) > 1 && (args[0][0] == '-' || args[0][0] == '+') {
+		arg := args[0]
+		args = args[1:]
+		if arg == "--" {
+			break
+		}
+		for _, c := range arg[1:] {
+			switch c {
+			case 'a':
+				opts.array = true
+			case 'A':
+				opts.assoc = true
+			case 'p':
+				opts.print = true
+			case 'f':
+				opts.funcs = true
+			case 'F':
+				opts.funcNames = true
+			case 'g':
+				opts.global = true
+			default:
+				attr, ok := varAttrFlag(c)
+				if !ok {
+					return opts, nil, fmt.Errorf("%s: %c%c: invalid option", cmd, arg[0], c)
+				}
+				if arg[0] == '-' {
+					opts.set |= attr
+				} else {
+					opts.unset |= attr
+				}
+			}
+		}
+	}
+	return opts, args, nil
+}
+
+func builtinExport(sh *Shell, std *StdStreams, args []string) (RunningJob, error) {
+	opts := declareOpts{set: VarExport}
+	for len(args) > 0 && len(args[0]) > 1 && args[0][0] == '-' {
+		arg := args[0]
+		args = args[1:]
+		if arg == "--" {
+			break
+		}
+		for _, c := range arg[1:] {
+			switch c {
+			case 'n':
+				opts.set, opts.unset = 0, VarExport
+			case 'p':
+				opts.print = true
+			case 'f':
+				return nil, errors.New("export: -f: exporting functions is not supported")
+			default:
+				return nil, fmt.Errorf("export: -%c: invalid option", c)
+			}
+		}
+	}
+	if opts.print || len(args) == 0 {
+		printVars(sh, std, declareOpts{set: VarExport})
+		return &ImmediateRunningJob{name: "export"}, nil
+	}
+	return declareVars(sh, std, "export", opts, args)
+}
+
+func builtinReadonly(sh *Shell, std *StdStreams, args []string) (RunningJob, error) {
+	opts := declareOpts{set: VarReadonly}
+	for len(args) > 0 && len(args[0]) > 1 && args[0][0] == '-' {
+		arg := args[0]
+		args = args[1:]
+		if arg == "--" {
+			break
+		}
+		for _, c := range arg[1:] {
+			switch c {
+			case 'a':
+				opts.array = true
+			case 'A':
+				opts.assoc = true
+			case 'p':
+				opts.print = true
+			case 'f':
+				return nil, errors.New("readonly: -f: readonly functions are not supported")
+			default:
+				return nil, fmt.Errorf("readonly: -%c: invalid option", c)
+			}
+		}
+	}
+	if opts.print || len(args) == 0 {
+		printVars(sh, std, declareOpts{set: VarReadonly})
+		return &ImmediateRunningJob{name: "readonly"}, nil
+	}
+	return declareVars(sh, std, "readonly", opts, args)
+}
+
+// declareVars implements declare, local, export and readonly.  With no names it
+// prints the variables matching opts.
+func declareVars(sh *Shell, std *StdStreams, cmd string, opts declareOpts, names []string) (RunningJob, error) {
+	if opts.funcs || opts.funcNames {
+		return declareFuncs(sh, std, cmd, opts, names), nil
+	}
+	if len(names) == 0 {
+		printVars(sh, std, opts)
+		return &ImmediateRunningJob{name: cmd}, nil
+	}
+	code := 0
+	for _, arg := range names {
+		if opts.print {
+			if !printVar(sh, std, arg) {
+				fmt.Fprintf(std.Err, "meshell: %s: %s: not found\n", cmd, arg)
+				code = 1
+			}
+			continue
+		}
+		if err := declareVar(sh, opts, arg); err != nil {
+			fmt.Fprintf(std.Err, "meshell: %s: %s\n", cmd, err)
+			code = 1
+		}
+	}
+	return &ImmediateRunningJob{name: cmd, outcome: JobOutcome{ExitCode: code}}, nil
+}
+
+// declareVar applies opts to a variable given as name, name=value or
+// name[subscript]=value.
+func declareVar(sh *Shell, opts declareOpts, arg string) error {
+	name, val := arg, ""
+	i := strings.IndexByte(arg, '=')
+	hasVal := i != -1
+	if hasVal {
+		name, val = arg[:i], arg[i+1:]
+	}
+	name, sub, hasSub := splitSubscript(name)
+	if !isName(name) {
+		return fmt.Errorf("`%s': not a valid identifier", arg)
+	}
+	// Compound assignments are passed by the parser as name=(...), so there is
+	// no telling them from quoted values in parentheses, which older versions
+	// of bash also took for compound assignments.
+	compound := hasVal && !hasSub && strings.HasPrefix(val, "(") && strings.HasSuffix(val, ")")
+	// A new local variable hides any variable or array with the same name
+	created := opts.local && !sh.IsLocalVar(name)
+	if created {
+		sh.SetLocalVar(name, "")
+	}
+	isArray := sh.getIndexedArray(name) != nil
+	isAssoc := sh.GetAssoc(name) != nil
+	switch {
+	case opts.assoc || opts.array || isAssoc || isArray || hasSub || compound:
+		switch {
+		case opts.assoc && isArray:
+			return fmt.Errorf("%s: cannot convert indexed to associative array", name)
+		case opts.array && isAssoc:
+			return fmt.Errorf("%s: cannot convert associative to indexed array", name)
+		case !isArray && !isAssoc:
+			// A variable becomes the first element of the array
+			if sh.varAttrs(name)&VarReadonly != 0 {
+				return fmt.Errorf("%s: readonly variable", name)
+			}
+			v := sh.lookupVar(name)
+			if created {
+				v = nil
+			}
+			if opts.assoc {
+				assoc := map[string]string{}
+				if v != nil {
+					assoc["0"] = v.Value
+				}
+				sh.SetAssoc(name, assoc)
+			} else {
+				arr := []string{}
+				if v != nil {
+					arr = append(arr, v.Value)
+				}
+				sh.SetArray(name, arr)
+			}
+		}
+		sh.SetVarAttrs(name, opts.set&^VarReadonly)
+		if err := sh.ClearVarAttrs(name, opts.unset); err != nil {
+			return err
+		}
+		switch {
+		case compound:
+			elems, err := parseCompoundValue(val)
+			if err != nil {
+				return err
+			}
+			if err := sh.AssignArray(name, elems); err != nil {
+				return err
+			}
+		case hasVal:
+			if !hasSub {
+				sub = "0"
+			}
+			if err := sh.SetArrayElement(name, sub, val); err != nil {
+				return err
+			}
+		}
+		sh.SetVarAttrs(name, opts.set&VarReadonly)
+	default:
+		// Make the variable readonly after assigning its value
+		sh.SetVarAttrs(name, opts.set&^VarReadonly)
+		if err := sh.ClearVarAttrs(name, opts.unset); err != nil {
+			return err
+		}
+		if hasVal {
+			if err := sh.SetVar(name, val); err != nil {
+				return err
+			}
+		}
+		sh.SetVarAttrs(name, opts.set&VarReadonly)
+	}
+	return nil
+}
+
+// splitSubscript splits an array element reference "name[sub]".
+func splitSubscript(ref string) (string, string, bool) {
+	if i := strings.IndexByte(ref, '['); i > 0 && strings.HasSuffix(ref, "]") {
+		return ref[:i], ref[i+1 : len(ref)-1], true
+	}
+	return ref, "", false
+}
+
+// formatArrayElems returns the elements of a compound assignment in
+// parentheses, quoted so that they can be read back.
+func formatArrayElems(elems []arrayElem) string {
+	parts := make([]string, len(elems))
+	for i, e := range elems {
+		parts[i] = shellQuote(e.val)
+		if e.hasSub {
+			parts[i] = "[" + quoteIfNeeded(e.sub) + "]=" + parts[i]
+		}
+	}
+	return "(" + strings.Join(parts, " ") + ")"
+}
+
+// parseCompoundValue parses the value of a compound assignment given to
+// declare, e.g. "(a 'b c' [5]=d)".  Quotes and backslashes are removed but
+// nothing is expanded.
+func parseCompoundValue(val string) ([]arrayElem, error) {
+	var elems []arrayElem
+	s := val[1 : len(val)-1]
+	for {
+		s = strings.TrimLeft(s, " \t\n")
+		if s == "" {
+			return elems, nil
+		}
+		var e arrayElem
+		if s[0] == '[' {
+			var ok bool
+			e.sub, s, ok = unquoteWord(s[1:], "]")
+			if !ok || !strings.HasPrefix(s, "]=") {
+				return nil, fmt.Errorf("%s: bad array subscript", val)
+			}
+			e.hasSub = true
+			s = s[2:]
+		}
+		var ok bool
+		e.val, s, ok = unquoteWord(s, "")
+		if !ok {
+			return nil, fmt.Errorf("%s: unterminated quote", val)
+		}
+		elems = append(elems, e)
+	}
+}
+
+// unquoteWord removes the quotes and backslashes from the word at the start of
+// s, which ends with an unquoted blank or a character in stop.  It returns the
+// word, the rest of s and false if a quote is not closed.
+func unquoteWord(s, stop string) (string, string, bool) {
+	var b strings.Builder
+	for s != "" {
+		switch c := s[0]; {
+		case c == '\'' || c == '"':
+			i := 1
+			for i < len(s) && s[i] != c {
+				if c == '"' && s[i] == '\\' && i+1 < len(s) {
+					i++
+				}
+				b.WriteByte(s[i])
+				i++
+			}
+			if i == len(s) {
+				return b.String(), "", false
+			}
+			s = s[i+1:]
+		case c == '\\' && len(s) > 1:
+			b.WriteByte(s[1])
+			s = s[2:]
+		case c == ' ' || c == '\t' || c == '\n' || strings.IndexByte(stop, c) >= 0:
+			return b.String(), s, true
+		default:
+			b.WriteByte(c)
+			s = s[1:]
+		}
+	}
+	return b.String(), "", true
+}
+
+// declareFuncs lists functions for declare -f and -F.
+func declareFuncs(sh *Shell, std *StdStreams, cmd string, opts declareOpts, names []string) RunningJob {
+	namesOnly := opts.funcNames && !opts.funcs && len(names) > 0
+	if len(names) == 0 {
+		names = make([]string, 0, len(sh.functions))
+		for name := range sh.functions {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+	}
+	code := 0
+	for _, name := range names {
+		f := sh.GetFunction(name)
+		switch {
+		case f == nil:
+			code = 1
+		case namesOnly:
+			fmt.Fprintln(std.Out, name)
+		case opts.funcNames:
+			fmt.Fprintf(std.Out, "declare -f %s\n", name)
+		default:
+			fmt.Fprintf(std.Out, "function %s() %s\n", name, f.Source)
+		}
+	}
+	return &ImmediateRunningJob{name: cmd, outcome: JobOutcome{ExitCode: code}}
+}
+
+// printVars prints the shell variables matching opts in a form that can be
+// read back by the shell.
+func printVars(sh *Shell, std *StdStreams, opts declareOpts) {
+	if !opts.array && !opts.assoc {
+		for _, name := range sh.varNames() {
+			if v := sh.lookupVar(name); v.Attrs&opts.set == opts.set {
+				printVar(sh, std, name)
+			}
+		}
+	}
+	for _, name := range sh.arrayNames() {
+		v := sh.lookupVar(name)
+		switch {
+		case opts.array && v.Array == nil, opts.assoc && v.Assoc == nil:
+		case v.Attrs&opts.set == opts.set:
+			printVar(sh, std, name)
+		}
+	}
+}
+
+// attrFlags returns the declare options for the attributes attrs.
+func attrFlags(attrs VarAttrs) string {
+	flags := ""
+	for _, f := range varAttrFlags {
+		if attrs&f.attr != 0 {
+			flags += string(f.flag)
+		}
+	}
+	return flags
+}
+
+// printVar prints the declaration of one variable.  It returns false if there
+// is no variable with that name.
+func printVar(sh *Shell, std *StdStreams, name string) bool {
+	v := sh.lookupVar(name)
+	if v == nil {
+		return false
+	}
+	var elems []string
+	switch {
+	case v.Array != nil:
+		for _, i := range v.Array.indexes() {
+			elems = append(elems, fmt.Sprintf("[%d]=%s", i, shellQuote(v.Array[i])))
+		}
+		fmt.Fprintf(std.Out, "declare -a%s %s=(%s)\n", attrFlags(v.Attrs), name, strings.Join(elems, " "))
+	case v.Assoc != nil:
+		for _, k := range sortedKeys(v.Assoc) {
+			elems = append(elems, fmt.Sprintf("[%s]=%s", quoteIfNeeded(k), shellQuote(v.Assoc[k])))
+		}
+		fmt.Fprintf(std.Out, "declare -A%s %s=(%s)\n", attrFlags(v.Attrs), name, strings.Join(elems, " "))
+	default:
+		flags := attrFlags(v.Attrs)
+		if flags == "" {
+			flags = "-"
+		}
+		fmt.Fprintf(std.Out, "declare -%s %s=%s\n", flags, name, shellQuote(v.Value))
+	}
+	return true
+}
+
+func builtinUnset(sh *Shell, std *StdStreams, args []string) (RunningJob, error) {
+	var mode rune
+	for len(args) > 0 && len(args[0]) > 1 && args[0][0] == '-' {
+		arg := args[0]
+		args = args[1:]
+		if arg == "--" {
+			break
+		}
+		for _, c := range arg[1:] {
+			if c != 'v' && c != 'f' {
+				return nil, fmt.Errorf("unset: -%c: invalid option", c)
+			}
+			mode = c
+		}
+	}
+	code := 0
+	for _, arg := range args {
+		name, sub, hasSub := splitSubscript(arg)
+		var err error
+		switch {
+		case mode == 'f':
+			sh.UnsetFunction(arg)
+		case !isName(name):
+			err = fmt.Errorf("`%s': not a valid identifier", arg)
+		case hasSub:
+			err = unsetElement(sh, name, sub)
+		case mode == 'v' || isVarSet(sh, name):
+			err = sh.UnsetVar(name)
+		default:
+			sh.UnsetFunction(name)
+		}
+		if err != nil {
+			fmt.Fprintf(std.Err, "meshell: unset: %s\n", err)
+			code = 1
+		}
+	}
+	return &ImmediateRunningJob{name: "unset", outcome: JobOutcome{ExitCode: code}}, nil
+}
+
+// unsetElement removes an element of an array.
+func unsetElement(sh *Shell, name, sub string) error {
+	if assoc := sh.GetAssoc(name); assoc != nil {
+		delete(assoc, sub)
+		return nil
+	}
+	arr := sh.getIndexedArray(name)
+	if arr == nil {
+		return nil
+	}
+	idx, err := evalArith(sh, sub)
+	if err != nil {
+		return err
+	}
+	idx, ok := arr.index(idx)
+	if !ok {
+		return fmt.Errorf("%s[%s]: bad array subscript", name, sub)
+	}
+	delete(arr, idx)
+	return nil
+}
+
+// isVarSet returns true if there is a variable or array called name.
+func isVarSet(sh *Shell, name string) bool {
+	return sh.lookupVar(name) != nil
+}